@@ -0,0 +1,187 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+var (
+	// tempSocketDir is the directory of the default socket when the user has no runtime
+	// directory; Listen creates it for the current user alone
+	tempSocketDir = filepath.Join(os.TempDir(), "simple-vpn-"+strconv.Itoa(os.Getuid()))
+
+	// DefaultSocket is the path of the control socket when none is given, in a directory only
+	// the current user may use
+	DefaultSocket = filepath.Join(socketDir(), "simple-vpn.sock")
+
+	// ErrNoSession is returned when a session ID names no session
+	ErrNoSession = errors.New("No such session")
+
+	// ErrSocketInUse is returned when another server is already listening on the control socket
+	ErrSocketInUse = errors.New("Another server is already listening on the control socket")
+
+	// ErrUnsafeDirectory is returned when the directory of the default socket exists but other
+	// users may use it, so they could have put something at the path
+	ErrUnsafeDirectory = errors.New("Directory of the control socket may be used by other users")
+)
+
+// socketDir returns the user's runtime directory, or else a directory of the user's own in the
+// temporary directory
+func socketDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return tempSocketDir
+}
+
+// SessionInfo describes a session with a client
+type SessionInfo struct {
+	ID          string
+	Identity    string `json:",omitempty"`
+	PeerAddress string
+
+	// Epoch counts the session keys agreed since the handshake
+	Epoch uint64
+	RTT   time.Duration
+	Stats remote.SessionStats
+}
+
+// Backend is the server the control socket manages
+type Backend interface {
+	// Sessions returns the sessions with clients, sorted by ID
+	Sessions() []SessionInfo
+
+	// Kick closes a session, telling the client it was disconnected
+	Kick(id string) error
+
+	// Rekey agrees a new session key with a client
+	Rekey(id string) error
+
+	// Reload reads the server's config files again
+	Reload() error
+
+	// Shutdown disconnects every client and stops the server
+	Shutdown() error
+}
+
+// Server answers requests on the control socket; they are plain HTTP with JSON bodies:
+//
+//	GET  /sessions            lists the sessions
+//	GET  /sessions/ID         shows a session
+//	POST /sessions/ID/kick    closes a session
+//	POST /sessions/ID/rekey   agrees a new session key
+//	POST /reload              reads the config files again
+//	POST /shutdown            stops the server
+type Server struct {
+	backend  Backend
+	listener net.Listener
+	path     string
+}
+
+// errorReply is the body of a failed request
+type errorReply struct {
+	Error string
+}
+
+// Listen serves the backend on a Unix socket at path which only the current user may use; a
+// socket left behind by a server which is no longer running is replaced
+func Listen(path string, backend Backend) (s *Server, err error) {
+	if filepath.Dir(path) == tempSocketDir {
+		if err = privateDir(tempSocketDir); err != nil {
+			return nil, err
+		}
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, ErrSocketInUse
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	s = &Server{backend: backend, path: path}
+	if s.listener, err = listenPrivate(path); err != nil {
+		return nil, err
+	}
+	go http.Serve(s.listener, s)
+	return
+}
+
+// Close stops serving and removes the socket
+func (s *Server) Close() (err error) {
+	err = s.listener.Close()
+	os.Remove(s.path)
+	return
+}
+
+// ServeHTTP routes a request to the backend
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		reply  interface{}
+		method = http.MethodPost
+		run    func()
+	)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "sessions":
+		method = http.MethodGet
+		run = func() { reply = s.backend.Sessions() }
+	case len(parts) == 2 && parts[0] == "sessions":
+		method = http.MethodGet
+		run = func() { reply, err = s.session(parts[1]) }
+	case len(parts) == 3 && parts[0] == "sessions" && parts[2] == "kick":
+		run = func() { err = s.backend.Kick(parts[1]) }
+	case len(parts) == 3 && parts[0] == "sessions" && parts[2] == "rekey":
+		run = func() { err = s.backend.Rekey(parts[1]) }
+	case len(parts) == 1 && parts[0] == "reload":
+		run = func() { err = s.backend.Reload() }
+	case len(parts) == 1 && parts[0] == "shutdown":
+		// answer before the server goes away
+		run = func() { go s.backend.Shutdown() }
+	default:
+		writeJSON(w, http.StatusNotFound, errorReply{"No such command"})
+		return
+	}
+	if r.Method != method {
+		writeJSON(w, http.StatusMethodNotAllowed, errorReply{"Use " + method})
+		return
+	}
+	run()
+
+	switch {
+	case err == ErrNoSession:
+		writeJSON(w, http.StatusNotFound, errorReply{err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorReply{err.Error()})
+	case reply != nil:
+		writeJSON(w, http.StatusOK, reply)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// session returns the session with the ID
+func (s *Server) session(id string) (info SessionInfo, err error) {
+	for _, info = range s.backend.Sessions() {
+		if info.ID == id {
+			return
+		}
+	}
+	return SessionInfo{}, ErrNoSession
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,88 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Client sends commands to a server's control socket
+type Client struct {
+	http *http.Client
+}
+
+// Dial returns a client of the control socket at path; nothing is sent until a command is
+func Dial(path string) *Client {
+	return &Client{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}}
+}
+
+// Sessions lists the server's sessions
+func (c *Client) Sessions() (sessions []SessionInfo, err error) {
+	err = c.do(http.MethodGet, "/sessions", &sessions)
+	return
+}
+
+// Session shows one of the server's sessions
+func (c *Client) Session(id string) (info SessionInfo, err error) {
+	err = c.do(http.MethodGet, "/sessions/"+url.PathEscape(id), &info)
+	return
+}
+
+// Kick closes one of the server's sessions
+func (c *Client) Kick(id string) error {
+	return c.do(http.MethodPost, "/sessions/"+url.PathEscape(id)+"/kick", nil)
+}
+
+// Rekey has the server agree a new session key with a client
+func (c *Client) Rekey(id string) error {
+	return c.do(http.MethodPost, "/sessions/"+url.PathEscape(id)+"/rekey", nil)
+}
+
+// Reload has the server read its config files again
+func (c *Client) Reload() error {
+	return c.do(http.MethodPost, "/reload", nil)
+}
+
+// Shutdown stops the server
+func (c *Client) Shutdown() error {
+	return c.do(http.MethodPost, "/shutdown", nil)
+}
+
+// do sends a command and decodes the reply into v, unless it is nil
+func (c *Client) do(method, path string, v interface{}) (err error) {
+	var (
+		req  *http.Request
+		resp *http.Response
+	)
+	// the host is ignored, since the socket is dialled instead
+	if req, err = http.NewRequest(method, "http://simple-vpn"+path, nil); err != nil {
+		return
+	}
+	if resp, err = c.http.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var reply errorReply
+		if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil || reply.Error == "" {
+			return errors.New("Server answered " + resp.Status)
+		}
+		if reply.Error == ErrNoSession.Error() {
+			return ErrNoSession
+		}
+		return errors.New(reply.Error)
+	}
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+	}
+	return
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package admin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// listenPrivate listens on a Unix socket which only the current user may use; the socket is
+// created in a directory only the user may enter and linked to the path once its permissions
+// are set, so there is no moment when others could connect to it. Linking fails if anything is
+// at the path already
+func listenPrivate(path string) (l net.Listener, err error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".simple-vpn-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	created := filepath.Join(dir, "ctl.sock")
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: created, Net: "unix"})
+	if err != nil {
+		return
+	}
+	ul.SetUnlinkOnClose(false)
+	if err = os.Chmod(created, 0600); err == nil {
+		err = os.Link(created, path)
+	}
+	if err != nil {
+		ul.Close()
+		return nil, err
+	}
+	return ul, nil
+}
+
+// privateDir creates a directory only the current user may use, or checks that the one which
+// exists is, since anyone may have created it first in a shared directory
+func privateDir(dir string) (err error) {
+	if err = os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || fi.Mode().Perm()&0077 != 0 || !ok || int(stat.Uid) != os.Getuid() {
+		return ErrUnsafeDirectory
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package admin
+
+import (
+	"net"
+	"os"
+)
+
+// listenPrivate listens on a Unix socket; its directory keeps it private
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
+
+// privateDir creates a directory only the current user may use
+func privateDir(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
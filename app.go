@@ -1,39 +1,391 @@
-package main
-
-import (
-	"fyne.io/fyne"
-	"fyne.io/fyne/app"
-	"fyne.io/fyne/layout"
-	"fyne.io/fyne/theme"
-	"fyne.io/fyne/widget"
-	"github.com/pwang347/simple-vpn/client"
-	"github.com/pwang347/simple-vpn/crypto"
-	"github.com/pwang347/simple-vpn/icon"
-	"github.com/pwang347/simple-vpn/server"
-)
-
-func main() {
-	crypto.Init()
-
-	app := app.New()
-	w := app.NewWindow("CPEN 442 | VPN")
-	w.SetIcon(icon.IconBitmap)
-	app.Settings().SetTheme(theme.LightTheme())
-
-	initLayout := fyne.NewContainerWithLayout(layout.NewCenterLayout(),
-		widget.NewVBox(
-			widget.NewLabel("Select application role:"),
-			widget.NewButton("Client", func() {
-				client.Start(w, app)
-			}),
-			widget.NewButton("Server", func() {
-				server.Start(w, app)
-			}),
-		),
-	)
-
-	w.SetContent(initLayout)
-	w.Resize(fyne.NewSize(640, 400))
-	w.CenterOnScreen()
-	w.ShowAndRun()
-}
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"fyne.io/fyne"
+	"fyne.io/fyne/app"
+	"fyne.io/fyne/layout"
+	"fyne.io/fyne/theme"
+	"fyne.io/fyne/widget"
+	"github.com/pwang347/simple-vpn/admin"
+	"github.com/pwang347/simple-vpn/auth"
+	"github.com/pwang347/simple-vpn/client"
+	"github.com/pwang347/simple-vpn/crypto"
+	"github.com/pwang347/simple-vpn/icon"
+	"github.com/pwang347/simple-vpn/packet"
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/server"
+	"github.com/pwang347/simple-vpn/tunnel"
+)
+
+// listFlag is a flag which may be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// splitList splits a comma separated flag value, ignoring empty items
+func splitList(s string) (items []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// hostname returns the host's name, which identifies the client by default
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+// userCommand manages the user database with the user add|remove|disable|enable|list subcommands,
+// and enrolls users for one-time codes with the totp|totp-remove subcommands
+func userCommand(args []string) (err error) {
+	var (
+		flags    = flag.NewFlagSet("user", flag.ExitOnError)
+		path     = flags.String("users", "users.json", "file keeping the users and their verifiers")
+		totpPath = flags.String("totp", "totp.json", "file keeping the seeds of users' one-time codes")
+		issuer   = flags.String("issuer", "simple-vpn", "name authenticator apps show for enrolled users")
+		users    *auth.Users
+		totp     *auth.TOTP
+		seed     []byte
+	)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: simple-vpn user [flags] add|remove|disable|enable|totp|totp-remove name, or list")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if users, err = auth.LoadUsers(*path); err != nil {
+		return
+	}
+
+	command, name := flags.Arg(0), flags.Arg(1)
+	if command != "list" && (name == "" || flags.NArg() != 2) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	switch command {
+	case "add":
+		var secret string
+		fmt.Fprint(os.Stderr, "Secret for "+name+": ")
+		if secret, err = bufio.NewReader(os.Stdin).ReadString('\n'); err != nil && secret == "" {
+			return
+		}
+		if secret = strings.TrimRight(secret, "\r\n"); secret == "" {
+			return errors.New("Secret must not be empty")
+		}
+		return users.Add(name, secret)
+	case "remove":
+		return users.Remove(name)
+	case "disable":
+		return users.SetDisabled(name, true)
+	case "enable":
+		return users.SetDisabled(name, false)
+	case "totp":
+		if totp, err = auth.LoadTOTP(*totpPath); err != nil {
+			return
+		}
+		if seed, err = totp.Enroll(name); err != nil {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "Add this URI to "+name+"'s authenticator app, e.g. as a QR code:")
+		fmt.Println(auth.OTPAuthURI(*issuer, name, seed))
+		return
+	case "totp-remove":
+		if totp, err = auth.LoadTOTP(*totpPath); err != nil {
+			return
+		}
+		return totp.Remove(name)
+	case "list":
+		names, disabled := users.List()
+		for _, name := range names {
+			if disabled[name] {
+				name += " (disabled)"
+			}
+			fmt.Println(name)
+		}
+		return
+	}
+	flags.Usage()
+	os.Exit(2)
+	return
+}
+
+// ctlCommand manages a running server through its control socket with the
+// ctl list|show|kick|rekey|reload|shutdown subcommands
+func ctlCommand(args []string) (err error) {
+	var (
+		flags    = flag.NewFlagSet("ctl", flag.ExitOnError)
+		socket   = flags.String("socket", admin.DefaultSocket, "control socket of the server, given to it with -admin-socket")
+		sessions []admin.SessionInfo
+		info     admin.SessionInfo
+	)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: simple-vpn ctl [flags] list|reload|shutdown, or show|kick|rekey id")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	c := admin.Dial(*socket)
+
+	command, id := flags.Arg(0), flags.Arg(1)
+	needsID := command == "show" || command == "kick" || command == "rekey"
+	if needsID && (id == "" || flags.NArg() != 2) || !needsID && flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	switch command {
+	case "list":
+		if sessions, err = c.Sessions(); err != nil {
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tIDENTITY\tPEER\tEPOCH\tRTT\tSENT\tRECEIVED")
+		for _, info := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%d\t%d\n", info.ID, info.Identity, info.PeerAddress, info.Epoch,
+				info.RTT.Round(time.Millisecond), info.Stats.BytesSent, info.Stats.BytesReceived)
+		}
+		return w.Flush()
+	case "show":
+		if info, err = c.Session(id); err != nil {
+			return
+		}
+		fmt.Println("ID:                " + info.ID)
+		fmt.Println("Identity:          " + info.Identity)
+		fmt.Println("Peer address:      " + info.PeerAddress)
+		fmt.Printf("Key epoch:         %d\n", info.Epoch)
+		fmt.Println("RTT:               " + info.RTT.Round(time.Millisecond).String())
+		fmt.Printf("Records sent:      %d (%d bytes)\n", info.Stats.RecordsSent, info.Stats.BytesSent)
+		fmt.Printf("Records received:  %d (%d bytes)\n", info.Stats.RecordsReceived, info.Stats.BytesReceived)
+		fmt.Printf("Compression:       %.1fx\n", info.Stats.CompressionRatio())
+		return
+	case "kick":
+		return c.Kick(id)
+	case "rekey":
+		return c.Rekey(id)
+	case "reload":
+		return c.Reload()
+	case "shutdown":
+		return c.Shutdown()
+	}
+	flags.Usage()
+	os.Exit(2)
+	return
+}
+
+// loadServerConfig reads the server's config files into the options, at startup and again
+// whenever the server is asked to reload
+func loadServerConfig(o *server.Options, routePolicy, pushRoutes, usersFile, authenticator, totpFile string) (err error) {
+	if routePolicy != "" {
+		if o.Routes, err = packet.LoadRoutePolicy(routePolicy); err != nil {
+			return
+		}
+	} else {
+		o.Routes = &packet.RoutePolicy{Default: packet.RouteSet{Include: splitList(pushRoutes)}}
+		if err = o.Routes.Validate(); err != nil {
+			return
+		}
+	}
+	if usersFile != "" && authenticator != "" {
+		return errors.New("Only one of -users and -auth may be given")
+	} else if usersFile != "" {
+		if o.Auth, err = auth.LoadUsers(usersFile); err != nil {
+			return
+		}
+	} else if authenticator != "" {
+		if o.Auth, err = auth.Parse(authenticator); err != nil {
+			return
+		}
+	}
+	if totpFile != "" {
+		if o.Auth == nil {
+			return errors.New("One-time codes need users, from -users or -auth")
+		}
+		o.TOTP, err = auth.LoadTOTP(totpFile)
+	}
+	return
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		exitOnError(userCommand(os.Args[2:]))
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		exitOnError(ctlCommand(os.Args[2:]))
+		return
+	}
+
+	var (
+		localForwards  listFlag
+		remoteForwards listFlag
+		remotePorts    string
+		socksUser      string
+		tunAddresses   string
+		tunConfig      packet.Config
+		pool           string
+		poolLeases     string
+		pushDNS        string
+		pushRoutes     string
+		routePolicy    string
+		dnsRules       listFlag
+		transport      string
+		padding        string
+		usersFile      string
+		authenticator  string
+		totpFile       string
+		userAuth       string
+		clientOptions  client.Options
+		serverOptions  server.Options
+		err            error
+	)
+	flag.StringVar(&transport, "transport", "tcp", "transport carrying the session, tcp, udp or ws; udp suits packet tunnelling best, ws passes through HTTP proxies")
+	flag.StringVar(&clientOptions.Transport.WebSocketPath, "ws-path", remote.DefaultWebSocketPath, "HTTP path of the WebSocket endpoint, which a tcp or ws server also serves")
+	flag.BoolVar(&clientOptions.Transport.TLS, "tls", false, "run the tcp or ws transport inside TLS 1.3, so it looks like HTTPS when served on port 443")
+	flag.StringVar(&clientOptions.Transport.CertFile, "tls-cert", "", "PEM certificate the server presents, or the client if the server requires client certificates")
+	flag.StringVar(&clientOptions.Transport.KeyFile, "tls-key", "", "PEM private key of -tls-cert")
+	flag.StringVar(&clientOptions.Transport.CAFile, "tls-ca", "", "PEM certificates verifying the server instead of the system roots, or on a server, verifying required client certificates")
+	flag.StringVar(&clientOptions.Transport.ServerName, "tls-server-name", "", "name the client verifies the server's certificate against, instead of the server address")
+	flag.StringVar(&padding, "pad", "none", "pad records to hide their length, none, buckets of growing powers of two or fixed multiples of -pad-size")
+	flag.IntVar(&clientOptions.Padding.Size, "pad-size", remote.DefaultPaddingSize, "size records are padded to a multiple of with -pad fixed")
+	flag.DurationVar(&clientOptions.Padding.CoverInterval, "cover", 0, "send a cover record whenever nothing was sent for the interval, e.g. 100ms, so idle periods don't show")
+	flag.BoolVar(&clientOptions.Compress, "compress", false, "compress tunnelled streams and packets with DEFLATE if the peer agrees, which helps bulk transfers over slow links")
+	flag.StringVar(&clientOptions.SendFile, "send-file", "", "send the file to the peer once connected; sending a file again resumes an interrupted transfer")
+	flag.StringVar(&tunnel.DownloadDir, "download-dir", ".", "directory where files accepted from the peer are saved")
+	flag.Var(&localForwards, "L", "forward a local port to host:hostport through the server, as [bind:]port:host:hostport")
+	flag.Var(&remoteForwards, "R", "forward a port on the server to host:hostport through the client, as [bind:]port:host:hostport")
+	flag.StringVar(&remotePorts, "remote-ports", "", "ports the server lets clients forward with -R, e.g. 8000-8100,9000")
+	flag.BoolVar(&serverOptions.GatewayPorts, "gateway-ports", false, "let clients forward ports with -R on any of the server's addresses, instead of only loopback")
+	flag.StringVar(&clientOptions.SOCKSAddress, "socks", "", "serve a SOCKS5 proxy through the server on the address, e.g. 127.0.0.1:1080")
+	flag.StringVar(&socksUser, "socks-user", "", "require SOCKS5 proxy clients to log in as username:password")
+	flag.StringVar(&clientOptions.HTTPProxyAddress, "http-proxy", "", "serve an HTTP proxy through the server on the address, e.g. 127.0.0.1:3128")
+	flag.StringVar(&tunAddresses, "tun-addr", "", "tunnel IP packets through a TUN interface with the addresses, e.g. 10.8.0.1/24,fd00:8::1/64, or auto to use the addresses from the server's pool (Linux only)")
+	flag.StringVar(&tunConfig.Name, "tun-name", "", "name of the TUN interface")
+	flag.IntVar(&tunConfig.MTU, "tun-mtu", packet.DefaultMTU, "MTU of the TUN interface")
+	flag.StringVar(&pool, "pool", "", "lease client TUN addresses from the prefixes, e.g. 10.8.0.0/24,fd00:8::/64")
+	flag.StringVar(&poolLeases, "pool-leases", "leases.json", "file keeping the pool's leases across restarts")
+	flag.StringVar(&pushDNS, "push-dns", "", "name servers pushed to clients, e.g. 10.8.0.1")
+	flag.StringVar(&pushRoutes, "push-routes", "", "prefixes clients route through their TUN interface, e.g. 192.168.1.0/24")
+	flag.StringVar(&routePolicy, "route-policy", "", "JSON file with the routes pushed to each client or group of clients, instead of -push-routes")
+	flag.StringVar(&clientOptions.DNSAddress, "dns", "", "serve a DNS stub resolving through the server on the address, e.g. 127.0.0.1:5353")
+	flag.Var(&dnsRules, "dns-rule", "send DNS queries for a domain to another resolver, as domain=host:port or domain=tunnel")
+	flag.StringVar(&serverOptions.Push.Resolver, "dns-resolver", tunnel.SystemResolver(), "resolver the server uses for clients' DNS queries")
+	flag.StringVar(&clientOptions.Identity, "id", hostname(), "identity the client presents to the server, which keys its leased addresses; clients authenticating with -user are identified as the user")
+	flag.BoolVar(&serverOptions.Netstack, "netstack", false, "terminate tunnelled IP packets on the server in a userspace network stack, which needs no root")
+	flag.StringVar(&usersFile, "users", "", "give each user its own secret from the file managed with the user subcommand, instead of one shared secret")
+	flag.StringVar(&authenticator, "auth", "", "check users' passwords with htpasswd:file or exec:program, which clients send once the shared secret has authenticated the server, or use users:file like -users")
+	flag.StringVar(&totpFile, "totp", "", "challenge users for a one-time code from the seeds in the file, enrolled with the user totp subcommand, as a second factor")
+	flag.StringVar(&clientOptions.Username, "user", "", "user to authenticate as, if the server authenticates users; the Password field takes the user's secret or password, as -user-auth says")
+	flag.StringVar(&userAuth, "user-auth", string(auth.ModeKey), "how to authenticate as -user: key, with the secret from a server's -users database, or password, sent once the shared secret authenticated a server started with -auth")
+	flag.BoolVar(&clientOptions.EndToEnd, "e2e", false, "encrypt messages to other clients at a hub end-to-end, so the hub can't read them")
+	flag.BoolVar(&serverOptions.Hub, "hub", false, "serve many clients at once and relay messages between them, over the tcp or ws transport")
+	flag.StringVar(&serverOptions.AdminSocket, "admin-socket", "", "serve a control socket on the path, e.g. "+admin.DefaultSocket+", so the ctl subcommand can manage the running server")
+	flag.Parse()
+
+	clientOptions.UserAuth, err = auth.ParseMode(userAuth)
+	exitOnError(err)
+	clientOptions.Transport.Kind, err = remote.ParseTransport(transport)
+	exitOnError(err)
+	exitOnError(clientOptions.Transport.Validate())
+	serverOptions.Transport = clientOptions.Transport
+	clientOptions.Padding.Mode, err = remote.ParsePaddingMode(padding)
+	exitOnError(err)
+	exitOnError(clientOptions.Padding.Validate())
+	serverOptions.Padding = clientOptions.Padding
+	serverOptions.Compress = clientOptions.Compress
+	serverOptions.SendFile = clientOptions.SendFile
+	for _, spec := range localForwards {
+		fwd, err := tunnel.ParseForward(spec)
+		exitOnError(err)
+		clientOptions.LocalForwards = append(clientOptions.LocalForwards, fwd)
+	}
+	for _, spec := range remoteForwards {
+		fwd, err := tunnel.ParseForward(spec)
+		exitOnError(err)
+		clientOptions.RemoteForwards = append(clientOptions.RemoteForwards, fwd)
+	}
+	for _, spec := range dnsRules {
+		rule, err := tunnel.ParseDNSRule(spec)
+		exitOnError(err)
+		clientOptions.DNSRules = append(clientOptions.DNSRules, rule)
+	}
+	if clientOptions.Username != "" {
+		clientOptions.Identity = clientOptions.Username
+	}
+	serverOptions.RemoteForwardPorts, err = tunnel.ParsePortRanges(remotePorts)
+	exitOnError(err)
+	if tunAddresses == "auto" {
+		clientOptions.TUN = &tunConfig
+	} else if tunAddresses != "" {
+		tunConfig.Addresses = splitList(tunAddresses)
+		exitOnError(tunConfig.Validate())
+		clientOptions.TUN = &tunConfig
+		serverOptions.TUN = &tunConfig
+	}
+	if pool != "" {
+		serverOptions.Pool, err = packet.NewPool(splitList(pool), poolLeases)
+		exitOnError(err)
+		if serverOptions.TUN == nil && !serverOptions.Netstack {
+			serverConfig := tunConfig
+			serverConfig.Addresses = serverOptions.Pool.ServerAddresses()
+			exitOnError(serverConfig.Validate())
+			serverOptions.TUN = &serverConfig
+		}
+		serverOptions.Push.MTU = tunConfig.MTU
+	}
+	serverOptions.Push.DNS = splitList(pushDNS)
+	serverOptions.Reload = func(o *server.Options) error {
+		return loadServerConfig(o, routePolicy, pushRoutes, usersFile, authenticator, totpFile)
+	}
+	exitOnError(serverOptions.Reload(&serverOptions))
+	if socksUser != "" {
+		clientOptions.SOCKSCredentials, err = tunnel.ParseCredentials(socksUser)
+		exitOnError(err)
+	}
+
+	crypto.Init()
+
+	app := app.New()
+	w := app.NewWindow("CPEN 442 | VPN")
+	w.SetIcon(icon.IconBitmap)
+	app.Settings().SetTheme(theme.LightTheme())
+
+	initLayout := fyne.NewContainerWithLayout(layout.NewCenterLayout(),
+		widget.NewVBox(
+			widget.NewLabel("Select application role:"),
+			widget.NewButton("Client", func() {
+				client.Start(w, app, clientOptions)
+			}),
+			widget.NewButton("Server", func() {
+				server.Start(w, app, serverOptions)
+			}),
+		),
+	)
+
+	w.SetContent(initLayout)
+	w.Resize(fyne.NewSize(640, 400))
+	w.CenterOnScreen()
+	w.ShowAndRun()
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrDenied is returned when an authenticator turns a user down
+	ErrDenied = errors.New("Authentication denied")
+
+	// ErrBadAuthenticator is returned when an authenticator spec can't be parsed
+	ErrBadAuthenticator = errors.New("Authenticator must be users:file, htpasswd:file or exec:program")
+)
+
+// Mode is how a client authenticates as a user; the client picks it rather than the server,
+// whose choice in the handshake is not authenticated
+type Mode string
+
+const (
+	// ModeKey encrypts the handshake with a key derived from the user's secret, so the secret
+	// is never sent; servers keeping verifiers expect it
+	ModeKey Mode = "key"
+
+	// ModePassword sends the password encrypted with the session key, once the shared secret
+	// authenticated the server; servers checking passwords against a directory expect it
+	ModePassword Mode = "password"
+)
+
+// ParseMode parses the name of a user authentication mode
+func ParseMode(s string) (mode Mode, err error) {
+	switch mode = Mode(s); mode {
+	case ModeKey, ModePassword:
+		return
+	}
+	return "", errors.New("User authentication must be key or password")
+}
+
+// Authenticator decides which users may connect; the server consults it during the handshake
+// with the username the client sent
+type Authenticator interface {
+	// Authenticate checks the password a client sent for a user, which the client encrypts
+	// with the session key once it is agreed
+	Authenticate(username, password string) error
+}
+
+// KeyAuthenticator is an authenticator keeping a verifier for each user, which encrypts the
+// handshake in place of the shared secret, so the password is never sent
+type KeyAuthenticator interface {
+	Authenticator
+
+	// Lookup returns the salt and rounds a user derives its verifier with, and the key the
+	// handshake is encrypted with; for users who may not connect the error is set, but a
+	// key nobody knows is returned so the handshake can carry on without telling the client
+	Lookup(username string) (salt []byte, iterations int, key string, err error)
+}
+
+// Parse returns the authenticator for a spec of the form kind:argument
+func Parse(spec string) (a Authenticator, err error) {
+	i := strings.Index(spec, ":")
+	if i < 0 || i == len(spec)-1 {
+		return nil, ErrBadAuthenticator
+	}
+	switch kind, arg := spec[:i], spec[i+1:]; kind {
+	case "users":
+		return LoadUsers(arg)
+	case "htpasswd":
+		return LoadHtpasswd(arg)
+	case "exec":
+		return NewExec(strings.Fields(arg))
+	}
+	return nil, ErrBadAuthenticator
+}
+
+// Authenticate checks a user's password against its verifier
+func (u *Users) Authenticate(username, password string) (err error) {
+	var (
+		salt       []byte
+		iterations int
+		key        string
+	)
+	if salt, iterations, key, err = u.Lookup(username); err != nil {
+		return
+	}
+	if !hmac.Equal([]byte(Key(Verifier(password, salt, iterations))), []byte(key)) {
+		return ErrDenied
+	}
+	return
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultExecTimeout is how long an external program may take to decide
+const DefaultExecTimeout = 10 * time.Second
+
+// Exec authenticates users by running an external program, so sites can check passwords
+// against their own directory; the program reads the username and the password on separate
+// lines of its standard input and writes allow or deny on the first line of its output
+type Exec struct {
+	command []string
+
+	// Timeout is how long the program may take before the user is denied
+	Timeout time.Duration
+}
+
+// NewExec returns an authenticator running the program with its arguments
+func NewExec(command []string) (e *Exec, err error) {
+	if len(command) == 0 {
+		return nil, errors.New("Authenticator needs a program to run")
+	}
+	if _, err = exec.LookPath(command[0]); err != nil {
+		return nil, err
+	}
+	return &Exec{command: command, Timeout: DefaultExecTimeout}, nil
+}
+
+// Authenticate runs the program for the user; anything but allow, including the program
+// failing, denies the user
+func (e *Exec) Authenticate(username, password string) (err error) {
+	if strings.ContainsAny(username, "\r\n") || strings.ContainsAny(password, "\r\n") {
+		return ErrDenied
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.Timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n")
+	cmd.Stdout = &output
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	// children of the program may hold its output open after it is killed, so don't wait for them
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		return errors.New("Authenticator program did not decide within " + e.Timeout.String())
+	}
+	if err != nil {
+		return ErrDenied
+	}
+	line, _ := bufio.NewReader(&output).ReadString('\n')
+	if strings.TrimSpace(line) != "allow" {
+		return ErrDenied
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// jsonFile is a JSON file changed both by a running server and from the command line
+type jsonFile struct {
+	path   string
+	what   string
+	loaded [sha256.Size]byte
+}
+
+// load decodes the file into v if it changed since it was last loaded, reporting whether it
+// did; v is left alone if the file was removed
+func (f *jsonFile) load(v interface{}) (changed bool, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(f.path); os.IsNotExist(err) {
+		changed = f.loaded != [sha256.Size]byte{}
+		f.loaded = [sha256.Size]byte{}
+		return changed, nil
+	} else if err != nil {
+		return
+	}
+	if sha256.Sum256(data) == f.loaded {
+		return
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return false, errors.New("Could not parse " + f.what + " in " + f.path)
+	}
+	f.loaded = sha256.Sum256(data)
+	return true, nil
+}
+
+// save writes v to a temporary file and moves it into place, so a crash can't corrupt it
+func (f *jsonFile) save(v interface{}) (err error) {
+	var data []byte
+	if data, err = json.MarshalIndent(v, "", "  "); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(f.path+".tmp", data, 0600); err != nil {
+		return
+	}
+	if err = os.Rename(f.path+".tmp", f.path); err == nil {
+		f.loaded = sha256.Sum256(data)
+	}
+	return
+}
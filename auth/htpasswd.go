@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	apr1Prefix = "$apr1$"
+	shaPrefix  = "{SHA}"
+
+	// the alphabet crypt(3) encodes hashes in
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Htpasswd authenticates users against a file made with Apache's htpasswd tool; entries
+// hashed with MD5 (htpasswd -m) and SHA-1 (htpasswd -s) are supported, but not bcrypt
+type Htpasswd struct {
+	mutex  sync.Mutex
+	path   string
+	hashes map[string]string
+}
+
+// LoadHtpasswd loads the users from the htpasswd file at path; the file is read again on
+// each authentication, so changes take effect without restarting the server
+func LoadHtpasswd(path string) (h *Htpasswd, err error) {
+	h = &Htpasswd{path: path}
+	if err = h.load(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Authenticate checks a user's password against its hash in the file
+func (h *Htpasswd) Authenticate(username, password string) (err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err = h.load(); err != nil {
+		return
+	}
+	hash, ok := h.hashes[username]
+	if !ok {
+		return ErrUnknownUser
+	}
+
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, apr1Prefix):
+		salt := strings.SplitN(hash[len(apr1Prefix):], "$", 2)[0]
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		computed = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	if computed == "" || subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) != 1 {
+		return ErrDenied
+	}
+	return
+}
+
+// load reads the name:hash lines of the file, skipping blank lines and comments
+func (h *Htpasswd) load() (err error) {
+	var file *os.File
+	if file, err = os.Open(h.path); err != nil {
+		return
+	}
+	defer file.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return errors.New("Could not parse " + h.path + ", lines must be name:hash")
+		}
+		name, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, apr1Prefix) && !strings.HasPrefix(hash, shaPrefix) {
+			return errors.New("Hash of " + name + " in " + h.path + " is not supported, use htpasswd -m or -s")
+		}
+		hashes[name] = hash
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	h.hashes = hashes
+	return
+}
+
+// apr1 hashes the password with Apache's variant of the MD5 crypt algorithm
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	alternate := md5.Sum([]byte(password + salt + password))
+
+	ctx := md5.New()
+	ctx.Write([]byte(password + apr1Prefix + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alternate[:])
+		} else {
+			ctx.Write(alternate[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte{password[0]})
+		}
+	}
+	sum := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx = md5.New()
+		if i&1 == 1 {
+			ctx.Write([]byte(password))
+		} else {
+			ctx.Write(sum)
+		}
+		if i%3 != 0 {
+			ctx.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			ctx.Write([]byte(password))
+		}
+		if i&1 == 1 {
+			ctx.Write(sum)
+		} else {
+			ctx.Write([]byte(password))
+		}
+		sum = ctx.Sum(nil)
+	}
+
+	var encoded []byte
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			encoded = append(encoded, cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(sum[0], sum[6], sum[12], 4)
+	encode(sum[1], sum[7], sum[13], 4)
+	encode(sum[2], sum[8], sum[14], 4)
+	encode(sum[3], sum[9], sum[15], 4)
+	encode(sum[4], sum[10], sum[5], 4)
+	encode(0, 0, sum[11], 2)
+	return apr1Prefix + salt + "$" + string(encoded)
+}
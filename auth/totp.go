@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// TOTPPeriod is how long each one-time code is valid for
+	TOTPPeriod = 30 * time.Second
+
+	// TOTPDigits is the number of digits in a one-time code
+	TOTPDigits = 6
+
+	// TOTPSkew is how many periods a code may be off by, allowing for clock drift
+	TOTPSkew = 1
+
+	seedLength = 20
+)
+
+var (
+	// ErrNotEnrolled is returned when a user without a one-time code seed authenticates
+	ErrNotEnrolled = errors.New("User is not enrolled for one-time codes")
+
+	// ErrBadCode is returned when a one-time code is wrong or has expired
+	ErrBadCode = errors.New("One-time code is wrong or has expired")
+
+	// ErrCodeReused is returned when a one-time code, or an older one, was already used
+	ErrCodeReused = errors.New("One-time code was already used")
+)
+
+// TOTPSeed is a user's entry in the one-time code file
+type TOTPSeed struct {
+	Seed []byte
+
+	// LastCounter is the time step of the last code accepted, so codes can't be replayed
+	LastCounter int64 `json:",omitempty"`
+}
+
+// TOTP is a file-backed store of the seeds users generate RFC 6238 one-time codes from
+type TOTP struct {
+	mutex sync.Mutex
+	seeds map[string]*TOTPSeed
+	file  jsonFile
+}
+
+// LoadTOTP loads the seeds from the file at path, which need not exist yet
+func LoadTOTP(path string) (t *TOTP, err error) {
+	t = &TOTP{
+		seeds: make(map[string]*TOTPSeed),
+		file:  jsonFile{path: path, what: "one-time code seeds"},
+	}
+	if err = t.refresh(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Enroll gives a user a new seed, replacing any it had, and returns it
+func (t *TOTP) Enroll(name string) (seed []byte, err error) {
+	seed = make([]byte, seedLength)
+	if _, err = rand.Read(seed); err != nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err = t.refresh(); err != nil {
+		return
+	}
+	t.seeds[name] = &TOTPSeed{Seed: seed}
+	return seed, t.file.save(t.seeds)
+}
+
+// Remove forgets a user's seed
+func (t *TOTP) Remove(name string) (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err = t.refresh(); err != nil {
+		return
+	}
+	if _, ok := t.seeds[name]; !ok {
+		return ErrNotEnrolled
+	}
+	delete(t.seeds, name)
+	return t.file.save(t.seeds)
+}
+
+// Verify checks a user's one-time code at the time, allowing for clock drift of TOTPSkew
+// periods; each code is accepted once, and never after a later one was
+func (t *TOTP) Verify(name, code string, now time.Time) (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err = t.refresh(); err != nil {
+		return
+	}
+	seed, ok := t.seeds[name]
+	if !ok {
+		return ErrNotEnrolled
+	}
+
+	current := now.Unix() / int64(TOTPPeriod/time.Second)
+	for counter := current - TOTPSkew; counter <= current+TOTPSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(TOTPCode(seed.Seed, counter)), []byte(code)) != 1 {
+			continue
+		}
+		if counter <= seed.LastCounter {
+			return ErrCodeReused
+		}
+		seed.LastCounter = counter
+		return t.file.save(t.seeds)
+	}
+	return ErrBadCode
+}
+
+// refresh reloads the seeds if the file changed since they were loaded
+func (t *TOTP) refresh() (err error) {
+	var changed bool
+	seeds := make(map[string]*TOTPSeed)
+	if changed, err = t.file.load(&seeds); changed {
+		t.seeds = seeds
+	}
+	return
+}
+
+// TOTPCode returns the one-time code of the seed for a time step, as in RFC 6238 with SHA-1
+func TOTPCode(seed []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(sha1.New, seed)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%modulo)
+}
+
+// OTPAuthURI returns the otpauth URI authenticator apps enroll a user's seed from
+func OTPAuthURI(issuer, name string, seed []byte) string {
+	query := url.Values{}
+	query.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(seed))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTPDigits))
+	query.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+	label := url.PathEscape(issuer + ":" + name)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
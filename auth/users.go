@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultIterations is how many rounds of PBKDF2 derive a user's verifier from its secret
+	DefaultIterations = 100000
+
+	// MaxIterations bounds the rounds a client will run at the server's request
+	MaxIterations = 10 * DefaultIterations
+
+	saltLength = 16
+)
+
+var (
+	// ErrUnknownUser is returned when a user is not in the database
+	ErrUnknownUser = errors.New("No such user")
+
+	// ErrUserExists is returned when adding a user which is already in the database
+	ErrUserExists = errors.New("User already exists")
+
+	// ErrUserDisabled is returned when a disabled user tries to authenticate
+	ErrUserDisabled = errors.New("User is disabled")
+
+	// ErrBadUsername is returned when a username is empty or has surrounding spaces
+	ErrBadUsername = errors.New("Username must not be empty or have surrounding spaces")
+
+	// ErrIterations is returned when the server asks for a verifier with too few or too many rounds
+	ErrIterations = errors.New("Server asked for an unreasonable number of PBKDF2 rounds")
+)
+
+// User is a user's entry in the database; only a verifier derived from the user's secret is
+// kept, so the secret itself can't be read from the file
+type User struct {
+	Salt       []byte
+	Iterations int
+	Verifier   []byte
+	Disabled   bool `json:",omitempty"`
+}
+
+// Users is a file-backed database of the users allowed to authenticate, each with its own secret
+type Users struct {
+	mutex    sync.Mutex
+	users    map[string]*User
+	file     jsonFile
+	fakeSalt []byte
+}
+
+// LoadUsers loads the users from the file at path, which need not exist yet
+func LoadUsers(path string) (u *Users, err error) {
+	u = &Users{
+		users:    make(map[string]*User),
+		file:     jsonFile{path: path, what: "users"},
+		fakeSalt: make([]byte, sha256.Size),
+	}
+	if _, err = rand.Read(u.fakeSalt); err != nil {
+		return nil, err
+	}
+	if err = u.refresh(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// refresh reloads the users if the file changed since they were loaded, so that users added,
+// removed or disabled from the command line take effect on a running server
+func (u *Users) refresh() (err error) {
+	var changed bool
+	users := make(map[string]*User)
+	if changed, err = u.file.load(&users); changed {
+		u.users = users
+	}
+	return
+}
+
+// Add adds a user with the secret it authenticates with
+func (u *Users) Add(name, secret string) (err error) {
+	if name == "" || strings.TrimSpace(name) != name {
+		return ErrBadUsername
+	}
+	user := &User{Salt: make([]byte, saltLength), Iterations: DefaultIterations}
+	if _, err = rand.Read(user.Salt); err != nil {
+		return
+	}
+	user.Verifier = Verifier(secret, user.Salt, user.Iterations)
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if err = u.refresh(); err != nil {
+		return
+	}
+	if _, ok := u.users[name]; ok {
+		return ErrUserExists
+	}
+	u.users[name] = user
+	return u.save()
+}
+
+// Remove removes a user
+func (u *Users) Remove(name string) (err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if err = u.refresh(); err != nil {
+		return
+	}
+	if _, ok := u.users[name]; !ok {
+		return ErrUnknownUser
+	}
+	delete(u.users, name)
+	return u.save()
+}
+
+// SetDisabled disables a user, or enables it again, without forgetting its secret
+func (u *Users) SetDisabled(name string, disabled bool) (err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if err = u.refresh(); err != nil {
+		return
+	}
+	user, ok := u.users[name]
+	if !ok {
+		return ErrUnknownUser
+	}
+	user.Disabled = disabled
+	return u.save()
+}
+
+// List returns the names of the users, sorted, and whether each is disabled
+func (u *Users) List() (names []string, disabled map[string]bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.refresh()
+	disabled = make(map[string]bool)
+	for name, user := range u.users {
+		names = append(names, name)
+		disabled[name] = user.Disabled
+	}
+	sort.Strings(names)
+	return
+}
+
+// Lookup returns the salt and rounds the user derives its verifier with, and the key the
+// handshake is encrypted with; for unknown and disabled users the error is set, but a salt
+// which stays the same for each name and a key nobody knows are returned, so the handshake
+// can carry on without telling the client whether the user exists
+func (u *Users) Lookup(name string) (salt []byte, iterations int, key string, err error) {
+	u.mutex.Lock()
+	if err = u.refresh(); err != nil {
+		u.mutex.Unlock()
+		return
+	}
+	user, ok := u.users[name]
+	u.mutex.Unlock()
+	switch {
+	case !ok:
+		err = ErrUnknownUser
+	case user.Disabled:
+		err = ErrUserDisabled
+	default:
+		return user.Salt, user.Iterations, Key(user.Verifier), nil
+	}
+
+	mac := hmac.New(sha256.New, u.fakeSalt)
+	mac.Write([]byte(name))
+	unknown := make([]byte, sha256.Size)
+	rand.Read(unknown)
+	return mac.Sum(nil)[:saltLength], DefaultIterations, Key(unknown), err
+}
+
+// save writes the users to the file
+func (u *Users) save() error {
+	return u.file.save(u.users)
+}
+
+// Verifier derives a user's verifier from its secret with PBKDF2-HMAC-SHA256
+func Verifier(secret string, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, []byte(secret))
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	verifier := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range verifier {
+			verifier[j] ^= u[j]
+		}
+	}
+	return verifier
+}
+
+// ClientKey derives the key a client encrypts the handshake with from its secret, with the
+// salt and rounds the server sent
+func ClientKey(secret string, salt []byte, iterations int) (key string, err error) {
+	if iterations < 1 || iterations > MaxIterations {
+		return "", ErrIterations
+	}
+	return Key(Verifier(secret, salt, iterations)), nil
+}
+
+// Key returns the key the handshake is encrypted with for a verifier
+func Key(verifier []byte) string {
+	return hex.EncodeToString(verifier)
+}
@@ -1,7 +1,6 @@
 package client
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
@@ -14,42 +13,146 @@ import (
 	"time"
 
 	"fyne.io/fyne"
+	"fyne.io/fyne/dialog"
 	"fyne.io/fyne/layout"
 	"fyne.io/fyne/widget"
+	"github.com/pwang347/simple-vpn/auth"
 	"github.com/pwang347/simple-vpn/crypto"
+	"github.com/pwang347/simple-vpn/hub"
+	"github.com/pwang347/simple-vpn/packet"
 	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/tunnel"
 	"github.com/pwang347/simple-vpn/ui"
 )
 
+// Options configures the client beyond the fields of the form
+type Options struct {
+	// LocalForwards are local ports forwarded through the tunnel while connected
+	LocalForwards []tunnel.Forward
+
+	// RemoteForwards are ports on the server forwarded back through the tunnel while connected
+	RemoteForwards []tunnel.Forward
+
+	// SOCKSAddress is where a SOCKS5 proxy is served while connected, if not empty
+	SOCKSAddress string
+
+	// SOCKSCredentials are required from SOCKS5 proxy clients, if not nil
+	SOCKSCredentials *tunnel.Credentials
+
+	// HTTPProxyAddress is where an HTTP proxy is served while connected, if not empty
+	HTTPProxyAddress string
+
+	// TUN configures a TUN interface tunnelling IP packets while connected, if not nil; without
+	// addresses, it is opened with the addresses pushed by the server
+	TUN *packet.Config
+
+	// Identity is presented to the server, which keys the client's leased addresses with it
+	Identity string
+
+	// DNSAddress is where a DNS stub resolving through the tunnel is served while connected, if not empty
+	DNSAddress string
+
+	// DNSRules send queries for some domains to other resolvers instead of through the tunnel
+	DNSRules []tunnel.DNSRule
+
+	// Transport carries the session to the server
+	Transport remote.TransportConfig
+
+	// Padding hides the length and timing of the records sent
+	Padding remote.PaddingConfig
+
+	// SendFile is the path of a file sent to the server once connected
+	SendFile string
+
+	// Compress offers to compress bulk records, which the server may accept
+	Compress bool
+
+	// EndToEnd encrypts messages to other clients at a hub with keys the hub doesn't know
+	EndToEnd bool
+
+	// Username names the user to authenticate as, if the server authenticates users
+	Username string
+
+	// UserAuth is how to authenticate as the user; a server asking for another way is refused,
+	// so it can't make the client send its password. The key is used if it is empty
+	UserAuth auth.Mode
+}
+
 var (
+	options              Options
 	conn                 net.Conn
 	ipAddressField       *widget.Entry
 	portField            *widget.Entry
 	secretField          *widget.Entry
+	passwordField        *widget.Entry
+	timeoutField         *widget.Entry
+	statusLabel          *widget.Label
+	routesLabel          *widget.Label
 	connectBtn           *widget.Button
 	disconnectBtn        *widget.Button
 	inputArea            *widget.Entry
 	inputAreaPlaceholder = "Connection must be established first"
 	inputBtn             *widget.Button
+	fileField            *widget.Entry
+	fileBtn              *widget.Button
+	fileProgress         *widget.ProgressBar
+	fileSent             bool
 	outputArea           *widget.Entry
 	continueBtn          *widget.Button
 	nonce                int
 	sessionKey           string
+	authKey              string
+	compression          remote.Compression
+	session              *remote.Session
+	endpoint             *hub.Endpoint
+	streams              *remote.Mux
+	peerTimeout          time.Duration
+	autoReconnect        bool
+	reconnecting         bool
+	closedByUser         bool
+	cancelReconnect      chan struct{}
+	outbox               [][]byte
+	resolver             string
 	window               fyne.Window
+	peerSelect           *widget.Select
 	mutex                sync.Mutex
 )
 
+const (
+	// toServer is the peer picker's entry sending to the server itself
+	toServer = "Server"
+
+	// toEveryone is the peer picker's entry sending to every other client at a hub
+	toEveryone = "Everyone"
+)
+
 func handleConnect() {
-	var err error
+	var (
+		err     error
+		timeout int
+	)
+
+	mutex.Lock()
+	closedByUser = false
+	mutex.Unlock()
 
 	connectBtn.Disable()
 	ipAddressField.SetReadOnly(true)
 	portField.SetReadOnly(true)
 	secretField.SetReadOnly(true)
+	passwordField.SetReadOnly(true)
+	timeoutField.SetReadOnly(true)
 	ui.Log("Trying to connect to " + ipAddressField.Text + " on port " + portField.Text)
 
+	if timeout, err = strconv.Atoi(timeoutField.Text); err != nil || timeout <= 0 {
+		ui.LogE(errors.New("Peer timeout must be a positive number of seconds"))
+		handleDisconnect()
+		return
+	}
+	peerTimeout = time.Duration(timeout) * time.Second
+
 	// TODO: form validation
-	if conn, err = remote.Connect(ipAddressField.Text, portField.Text); err != nil {
+	if conn, err = remote.ConnectTransport(options.Transport, ipAddressField.Text, portField.Text); err != nil {
 		ui.LogE(err)
 		handleDisconnect()
 		return
@@ -64,14 +167,112 @@ func handleConnect() {
 		return
 	}
 
+	startSession()
 	inputArea.SetReadOnly(false)
 	inputArea.SetPlaceHolder("")
 	inputBtn.Enable()
+	fileBtn.Enable()
+}
+
+func startSession() {
+	session = remote.NewSession(conn, sessionKey, peerTimeout)
+	session.Trace = traceRecord
+	session.SetPadding(options.Padding)
+	session.SetCompression(compression)
+	session.OnRTT = func(rtt time.Duration) {
+		statusLabel.SetText("Connected, RTT " + rtt.Round(time.Millisecond).String() + compressionStatus(session))
+	}
+	session.OnRekey = func(epoch uint64) {
+		ui.Log(fmt.Sprintf("Agreed session key %d with the server", epoch))
+	}
+	statusLabel.SetText("Connected")
+	streams = remote.NewMux(session, true)
+	endpoint = nil
+	if options.EndToEnd {
+		endpoint = newEndpoint(session)
+	}
+	go recvLoop(session, streams)
+	if err := session.WriteControl(remote.RecordHello, remote.Hello{Identity: options.Identity}); err != nil {
+		ui.LogE(err)
+	}
+	go tunnel.Serve(streams, tunnel.AcceptFiles(tunnel.ClientPolicy(options.RemoteForwards), promptFile))
+	go startForwards(streams)
+	mutex.Lock()
+	if options.SendFile != "" && !fileSent {
+		go sendFile(streams, options.SendFile)
+	}
+	mutex.Unlock()
+}
+
+// startForwards sets up the port forwards and proxies, which are torn down along with the session
+func startForwards(m *remote.Mux) {
+	for _, fwd := range options.LocalForwards {
+		if _, err := tunnel.ListenLocal(fwd, m); err != nil {
+			ui.LogE(err)
+			continue
+		}
+		ui.Log("Forwarding " + fwd.String() + " through the tunnel")
+	}
+
+	for _, fwd := range options.RemoteForwards {
+		if _, err := tunnel.ListenRemote(fwd, m); err != nil {
+			ui.LogE(err)
+			continue
+		}
+		ui.Log("Forwarding " + fwd.String() + " on the server back through the tunnel")
+	}
+
+	if options.SOCKSAddress != "" {
+		if _, err := tunnel.ListenSOCKS(options.SOCKSAddress, options.SOCKSCredentials, m); err != nil {
+			ui.LogE(err)
+		} else {
+			ui.Log("Serving SOCKS5 proxy on " + options.SOCKSAddress)
+		}
+	}
+
+	if options.DNSAddress != "" {
+		if _, err := tunnel.ListenDNS(options.DNSAddress, options.DNSRules, pushedResolver, m); err != nil {
+			ui.LogE(err)
+		} else {
+			ui.Log("Serving DNS on " + options.DNSAddress)
+		}
+	}
 
-	go recvLoop()
+	if options.HTTPProxyAddress != "" {
+		if _, err := tunnel.ListenHTTPProxy(options.HTTPProxyAddress, m); err != nil {
+			ui.LogE(err)
+		} else {
+			ui.Log("Serving HTTP proxy on " + options.HTTPProxyAddress)
+		}
+	}
+}
+
+// pushedResolver returns the resolver the server offered for DNS queries through the tunnel
+func pushedResolver() string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return resolver
+}
+
+func handleUserDisconnect() {
+	mutex.Lock()
+	closedByUser = true
+	if reconnecting {
+		close(cancelReconnect)
+		reconnecting = false
+	}
+	outbox = nil
+	mutex.Unlock()
+	if session != nil {
+		session.CloseWithAlert(remote.AlertUserDisconnect, "")
+	}
+	handleDisconnect()
 }
 
 func handleDisconnect() {
+	if session != nil {
+		session.Close()
+	}
 	if conn != nil {
 		conn.Close()
 	}
@@ -85,31 +286,159 @@ func handleDisconnect() {
 	ipAddressField.SetReadOnly(false)
 	portField.SetReadOnly(false)
 	secretField.SetReadOnly(false)
+	passwordField.SetReadOnly(false)
+	timeoutField.SetReadOnly(false)
+	statusLabel.SetText("Not connected")
+	routesLabel.SetText("Routes: none")
 
 	inputArea.SetReadOnly(true)
 	inputArea.SetPlaceHolder(inputAreaPlaceholder)
 	inputBtn.Disable()
+	fileBtn.Disable()
+	peerSelect.SetSelected(toServer)
+	peerSelect.Hide()
 	outputArea.SetText("")
 }
 
+func isReconnecting() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return reconnecting
+}
+
+// retryable returns whether an attempt to reconnect failed on the network, so trying again may
+// succeed; the server turning the client away or the user cancelling a prompt is final
+func retryable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, remote.ErrTruncated, remote.ErrWebSocketHandshake, remote.ErrWebSocketFrame:
+		return true
+	}
+	return false
+}
+
+// stopReconnecting gives up reconnecting after an attempt failed for good
+func stopReconnecting(err error) {
+	mutex.Lock()
+	reconnecting = false
+	mutex.Unlock()
+	logClose(err)
+	handleDisconnect()
+}
+
+func reconnect() {
+	var err error
+
+	mutex.Lock()
+	cancel := cancelReconnect
+	mutex.Unlock()
+	statusLabel.SetText("Reconnecting")
+
+	for attempt := 1; ; attempt++ {
+		delay := remote.ReconnectDelay(attempt)
+		ui.Log(fmt.Sprintf("Reconnect attempt %d in %s", attempt, delay.Round(time.Millisecond)))
+		select {
+		case <-cancel:
+			return
+		case <-time.After(delay):
+		}
+
+		if conn, err = remote.ConnectTransport(options.Transport, ipAddressField.Text, portField.Text); err != nil {
+			if !retryable(err) {
+				stopReconnecting(err)
+				return
+			}
+			ui.LogE(err)
+			continue
+		}
+		if err = authenticate(); err != nil {
+			conn.Close()
+			if !retryable(err) {
+				stopReconnecting(err)
+				return
+			}
+			ui.LogE(err)
+			continue
+		}
+
+		mutex.Lock()
+		select {
+		case <-cancel:
+			mutex.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		reconnecting = false
+		mutex.Unlock()
+
+		ui.LogS(fmt.Sprintf("Reconnected to %s after %d attempt(s)", conn.RemoteAddr().String(), attempt))
+		startSession()
+		flushOutbox()
+		return
+	}
+}
+
+func enqueue(message []byte) {
+	mutex.Lock()
+	outbox = append(outbox, message)
+	queued := len(outbox)
+	mutex.Unlock()
+	ui.Log(fmt.Sprintf("Queued message until reconnected (%d queued)", queued))
+}
+
+func flushOutbox() {
+	mutex.Lock()
+	pending := outbox
+	outbox = nil
+	mutex.Unlock()
+
+	for i, message := range pending {
+		if err := session.Send(message); err != nil {
+			ui.LogE(err)
+			mutex.Lock()
+			outbox = append(pending[i:], outbox...)
+			mutex.Unlock()
+			session.Close()
+			return
+		}
+	}
+	if len(pending) > 0 {
+		ui.Log(fmt.Sprintf("Sent %d queued message(s)", len(pending)))
+	}
+}
+
+// step skips the stepper while reconnecting, since nobody is there to press it
+func step(proc func()) {
+	if isReconnecting() {
+		proc()
+		return
+	}
+	ui.Step(proc)
+}
+
 func authenticate() (err error) {
 
-	ui.Step(func() {
+	step(func() {
 		ui.Log("Starting authentication using secret " + secretField.Text)
 	})
 
 	// Msg1: (R_A) -->
 	var (
 		nonceAB []byte
+		offered = remote.OfferedCompression(options.Compress)
 	)
 
-	ui.Step(func() {
+	step(func() {
 		nonceAB = crypto.NewChallenge(crypto.DefaultNonceLength)
 		ui.Log("Generated R_A =\n" + fmt.Sprintf("%x", nonceAB))
 	})
 
-	if ui.Step(func() {
-		msg1 := crypto.AuthenticationPayloadBeginAB{}
+	if step(func() {
+		msg1 := crypto.AuthenticationPayloadBeginAB{Compression: offered, Username: options.Username}
 		copy(msg1.ChallengeAB[:], nonceAB[:])
 		ui.LogO("Sent R_A (msg1) =\n" + fmt.Sprintf("%x", nonceAB))
 		err = remote.WriteMessageStruct(conn, msg1)
@@ -128,24 +457,62 @@ func authenticate() (err error) {
 		decryptedMsg crypto.DecodedSrvrChallengePartialKey
 	)
 
-	if ui.Step(func() {
+	if step(func() {
 		ui.Log("Waiting for Msg2 from server...")
 		if decodedMsg, err = remote.ReadMessageStruct(conn); err != nil {
 			return
 		}
+		if alert, isAlert := decodedMsg.(crypto.AuthenticationAlert); isAlert {
+			err = remote.DecodeAuthenticationAlert(alert, secretField.Text)
+			return
+		}
 		if msg2, ok = decodedMsg.(crypto.AuthenticationPayloadResponseBA); !ok {
 			err = errors.New("Could not parse Msg2")
+			remote.WriteAuthenticationAlert(conn, remote.AlertProtocolViolation, err.Error(), secretField.Text)
 			return
 		}
 		ui.LogI("Received R_B (msg2):\n" + fmt.Sprintf("%x", msg2.ChallengeBA[:]))
 		ui.LogI("Received Encrypt(SRVR, R_A, g^b%p, K_AB) (msg2):\n" + fmt.Sprintf("%x", msg2.EncSrvrChallengeABPartialkeyB[:]))
+		if compression, err = remote.AcceptCompression(offered, msg2.Compression); err != nil {
+			remote.WriteAuthenticationAlert(conn, remote.AlertProtocolViolation, err.Error(), secretField.Text)
+			return
+		}
+		ui.Log("Negotiated compression: " + string(compression))
+	}); err != nil {
+		return
+	}
+
+	// as a user, the handshake is encrypted with a key derived from the user's password, or the
+	// password is sent once the session key is agreed; msg2 is not authenticated yet, so only
+	// the way the client was told to use is accepted
+	authKey = secretField.Text
+	if step(func() {
+		switch {
+		case options.Username == "" && (msg2.Iterations != 0 || msg2.Password):
+			err = errors.New("Server authenticates users, connect with a username")
+		case options.Username == "":
+		case msg2.Iterations == 0 && !msg2.Password:
+			err = errors.New("Server does not authenticate users, connect without a username")
+		case options.UserAuth == auth.ModePassword && !msg2.Password:
+			err = errors.New("Server did not ask for the password of user " + options.Username + ", refusing to authenticate another way")
+		case options.UserAuth == auth.ModePassword:
+		case msg2.Password || msg2.Iterations == 0:
+			err = errors.New("Server did not ask for the key of user " + options.Username + ", refusing to send the password")
+		default:
+			if authKey, err = auth.ClientKey(passwordField.Text, msg2.Salt, msg2.Iterations); err == nil {
+				ui.Log("Derived the key of user " + options.Username + " =\n" + authKey)
+			}
+		}
+		if err != nil {
+			remote.WriteAuthenticationAlert(conn, remote.AlertAuthFailure, err.Error(), secretField.Text)
+		}
 	}); err != nil {
 		return
 	}
 
-	if ui.Step(func() {
+	if step(func() {
 		nonceBA = msg2.ChallengeBA
-		if decrypted, err = crypto.DecryptBytes(msg2.EncSrvrChallengeABPartialkeyB[:], secretField.Text); err != nil {
+		if decrypted, err = crypto.DecryptBytes(msg2.EncSrvrChallengeABPartialkeyB[:], authKey); err != nil {
 			return
 		}
 
@@ -162,9 +529,10 @@ func authenticate() (err error) {
 		return
 	}
 
-	if ui.Step(func() {
+	if step(func() {
 		if !bytes.Equal(decryptedMsg.Challenge[:], nonceAB) {
 			err = errors.New("Server failed authentication challenge")
+			remote.WriteAuthenticationAlert(conn, remote.AlertAuthFailure, err.Error(), authKey)
 			return
 		}
 	}); err != nil {
@@ -178,7 +546,7 @@ func authenticate() (err error) {
 		partialKeyA []byte
 	)
 
-	ui.Step(func() {
+	step(func() {
 		a = crypto.GenerateRandomExponent()
 		ui.Log("Generated a =\n" + crypto.BytesToBigNumString(a))
 
@@ -186,13 +554,34 @@ func authenticate() (err error) {
 		ui.Log("Generated g^a%p =\n" + crypto.BytesToBigNumString(partialKeyA))
 	})
 
-	if ui.Step(func() {
-		if encrypted, err = crypto.EncryptBytes(append(nonceBA[:], partialKeyA[:]...), secretField.Text); err != nil {
+	if step(func() {
+		if encrypted, err = crypto.EncryptBytes(append(nonceBA[:], partialKeyA[:]...), authKey); err != nil {
 			return
 		}
 		ui.Log("Generated Encrypt(R_B, g^a%p, K_AB) =\n" + fmt.Sprintf("%x", encrypted))
 
 		msg3 := crypto.AuthenticationPayloadResponseAB{EncChallengeBAPartialKeyA: encrypted}
+		transcript := remote.CompressionTranscript(offered, compression)
+		msg3.CompressionMAC = crypto.ComputeMAC([]byte(transcript), crypto.BytesToBigNumString(crypto.ConstructKey(partialKeyB, a)))
+		if msg2.Password {
+			key := crypto.BytesToBigNumString(crypto.ConstructKey(partialKeyB, a))
+			if msg3.EncPassword, err = crypto.EncryptMessage(passwordField.Text, key); err != nil {
+				return
+			}
+			ui.Log("Encrypted the password of user " + options.Username + " with the session key")
+		}
+		if msg2.OTP {
+			code, ok := promptCode()
+			if !ok {
+				err = errors.New("No one-time code was entered")
+				return
+			}
+			key := crypto.BytesToBigNumString(crypto.ConstructKey(partialKeyB, a))
+			if msg3.EncCode, err = crypto.EncryptMessage(code, key); err != nil {
+				return
+			}
+			ui.Log("Encrypted the one-time code with the session key")
+		}
 
 		ui.LogO("Sent Encrypt(R_B, g^a%p, K_AB) (msg3):\n" + fmt.Sprintf("%x", msg3.EncChallengeBAPartialKeyA[:]))
 		if err = remote.WriteMessageStruct(conn, msg3); err != nil {
@@ -202,7 +591,7 @@ func authenticate() (err error) {
 		return
 	}
 
-	ui.Step(func() {
+	step(func() {
 		key := crypto.ConstructKey(partialKeyB, a)
 		sessionKey = crypto.BytesToBigNumString(key)
 		ui.LogS("Established Session key:\n" + sessionKey)
@@ -212,77 +601,341 @@ func authenticate() (err error) {
 }
 
 func handleSend() {
-	var (
-		err         error
-		encrypted   []byte
-		messageSize uint64
-	)
-
 	if strings.TrimSpace(inputArea.Text) == "" {
 		return
 	}
 
-	if encrypted, err = crypto.EncryptBytes([]byte(inputArea.Text), sessionKey); err != nil {
+	message := []byte(inputArea.Text)
+	if to := peerSelect.Selected; to != "" && to != toServer {
+		sendRelay(to, message)
+		return
+	}
+	if isReconnecting() {
+		enqueue(message)
+		inputArea.SetText("")
+		return
+	}
+
+	if err := session.Send(message); err != nil {
 		ui.LogE(err)
+		mutex.Lock()
+		retry := autoReconnect
+		mutex.Unlock()
+		if retry {
+			enqueue(message)
+			inputArea.SetText("")
+			session.Close()
+			return
+		}
 		handleDisconnect()
 		return
 	}
 
-	messageSize = uint64(len(encrypted))
-	messageSizeBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(messageSizeBytes, messageSize)
-	encrypted = append(messageSizeBytes, encrypted...)
-	ui.LogO("Sent E(len, message, K_session): " + fmt.Sprintf("%x", encrypted))
+	inputArea.SetText("")
+}
 
-	if _, err := conn.Write(encrypted); err != nil {
+// sendRelay sends a message through the hub to another client, or to every other client
+func sendRelay(to string, message []byte) {
+	relay := remote.Relay{Data: message}
+	if to != toEveryone {
+		relay.To = to
+	}
+	if isReconnecting() {
+		ui.LogE(errors.New("Messages to other clients can't be queued while reconnecting"))
+		return
+	}
+	var err error
+	if endpoint != nil {
+		err = endpoint.Send(relay.To, message)
+	} else {
+		err = session.WriteControl(remote.RecordRelay, relay)
+	}
+	if err != nil {
 		ui.LogE(err)
-		handleDisconnect()
+		return
 	}
-
 	inputArea.SetText("")
 }
 
-func recvLoop() {
-	var (
-		err       error
-		decrypted []byte
-		message   string
-		reader    *bufio.Reader
-	)
-	for {
-		time.Sleep(1000 * time.Millisecond)
-		if conn == nil {
+// newEndpoint starts encrypting messages to other clients end-to-end over the session
+func newEndpoint(s *remote.Session) (e *hub.Endpoint) {
+	e = hub.NewEndpoint(options.Identity, func(msg remote.Relay) error {
+		return s.WriteControl(remote.RecordRelay, msg)
+	})
+	e.OnKey = func(identity, fingerprint string) {
+		ui.Log("Agreed an end-to-end key with " + identity + ", fingerprint " + fingerprint +
+			"; if " + identity + " sees a different one, the hub is intercepting your messages")
+	}
+	return
+}
+
+// receiveRelay returns the message relayed from another client to show, or nil if there is
+// none; messages which can't be read are logged and dropped, since the hub relays them
+func receiveRelay(payload []byte) (message []byte, err error) {
+	var relay remote.Relay
+	if err = remote.ReadControl(payload, &relay); err != nil {
+		return
+	}
+	switch {
+	case endpoint != nil:
+		if message, err = endpoint.Receive(relay); err != nil {
+			ui.LogE(errors.New("Dropped a message from " + relay.From + ": " + err.Error()))
+			return nil, nil
+		}
+	case relay.Sealed || relay.Key != nil:
+		ui.LogE(errors.New(relay.From + " sent a message encrypted end-to-end, connect with -e2e to read it"))
+	default:
+		message = relay.Data
+	}
+	if message != nil {
+		message = []byte(relay.From + ": " + string(message))
+	}
+	return
+}
+
+// showRoster lists the other clients online at the hub in the peer picker
+func showRoster(peers []string) {
+	entries := []string{toServer, toEveryone}
+	for _, peer := range peers {
+		if peer != options.Identity {
+			entries = append(entries, peer)
+		}
+	}
+	peerSelect.Options = entries
+	selected := false
+	for _, entry := range entries {
+		selected = selected || entry == peerSelect.Selected
+	}
+	if !selected {
+		peerSelect.SetSelected(toServer)
+	}
+	peerSelect.Refresh()
+	peerSelect.Show()
+}
+
+// openTUN opens the TUN interface, if configured, with the config pushed by the server and
+// forwards its packets over the session until the session ends
+func openTUN(s *remote.Session, m *remote.Mux, pushed remote.InterfaceConfig) packet.Device {
+	if options.TUN == nil {
+		return nil
+	}
+
+	cfg := *options.TUN
+	if len(cfg.Addresses) == 0 {
+		cfg.Addresses = pushed.Addresses
+	}
+	if pushed.MTU != 0 {
+		cfg.MTU = pushed.MTU
+	}
+	dev, err := packet.OpenTUN(cfg)
+	if err != nil {
+		ui.LogE(err)
+		return nil
+	}
+	ui.Log("Tunnelling packets on " + dev.Name() + " with address " + strings.Join(cfg.Addresses, ", "))
+
+	set := packet.RouteSet{Include: pushed.Routes, Exclude: pushed.Exclude}
+	table, err := packet.NewRouteTable(set)
+	if err != nil {
+		ui.LogE(err)
+		set, table = packet.RouteSet{}, nil
+	}
+	routesLabel.SetText("Routes: " + set.String())
+
+	// excluded prefixes and the server itself must keep their routes outside the tunnel
+	var bypassed []string
+	bypass := set.Exclude
+	routes := set.Routes()
+	if host, _, err := net.SplitHostPort(s.RemoteAddr().String()); err == nil && len(routes) > 0 {
+		if serverIP := net.ParseIP(host); serverIP != nil && table.Match(serverIP) {
+			bits := 128
+			if serverIP.To4() != nil {
+				bits = 32
+			}
+			bypass = append(bypass, serverIP.String()+"/"+strconv.Itoa(bits))
+		}
+	}
+	for _, prefix := range bypass {
+		if err = packet.AddBypassRoute(prefix); err != nil {
+			ui.LogE(err)
 			continue
 		}
-		if reader = bufio.NewReader(conn); reader == nil {
+		bypassed = append(bypassed, prefix)
+		ui.Log("Keeping " + prefix + " outside the tunnel")
+	}
+	for _, route := range routes {
+		if err = packet.AddRoute(dev, route); err != nil {
+			ui.LogE(err)
 			continue
 		}
+		ui.Log("Routing " + route + " through the tunnel")
+	}
+	if len(pushed.DNS) > 0 {
+		ui.Log("Server offers name servers " + strings.Join(pushed.DNS, ", "))
+	}
 
-		messageSizeBytes := make([]byte, 8)
-		if _, err := io.ReadFull(reader, messageSizeBytes); err != nil {
-			ui.LogE(err)
-			handleDisconnect()
-			return
+	go func() {
+		<-m.Done()
+		dev.Close()
+		for _, prefix := range bypassed {
+			packet.DeleteRoute(prefix)
 		}
+	}()
+	go packet.Forward(dev, s, table)
+	return dev
+}
+
+// logClose reports why the session ended, which is only an error if the peer did not close it cleanly
+func logClose(err error) {
+	if remote.IsCleanClose(err) {
+		ui.Log(err.Error())
+		return
+	}
+	ui.LogE(err)
+}
 
-		messageSize := binary.LittleEndian.Uint64(messageSizeBytes[:])
-		ui.LogI("Received message of length: " + strconv.FormatUint(messageSize, 10))
+// compressionStatus describes how well the session's bulk records compressed, if compression was negotiated
+func compressionStatus(s *remote.Session) string {
+	if compression != remote.CompressionDeflate {
+		return ""
+	}
+	return fmt.Sprintf(", compression %.1fx", s.Stats().CompressionRatio())
+}
 
-		encrypted := make([]byte, messageSize)
-		if _, err := io.ReadFull(reader, encrypted); err != nil {
-			ui.LogE(err)
+// handleSendFile sends the file at the path in the file field to the server
+func handleSendFile() {
+	path := strings.TrimSpace(fileField.Text)
+	if path == "" || streams == nil {
+		return
+	}
+	go sendFile(streams, path)
+}
+
+// sendFile offers a file to the server and sends it once accepted, showing its progress
+func sendFile(m *remote.Mux, path string) {
+	ui.Log("Offering " + path + " to the server")
+	fileProgress.SetValue(0)
+	err := tunnel.SendFile(m, path, func(sent, total int64) {
+		fileProgress.SetValue(float64(sent) / float64(total))
+	})
+	if err != nil {
+		ui.LogE(err)
+		return
+	}
+	fileProgress.SetValue(1)
+	mutex.Lock()
+	fileSent = true
+	mutex.Unlock()
+	ui.Log("Sent " + path + ", the server verified its SHA-256")
+}
+
+// promptFile asks the user whether to accept a file offered by the server
+func promptFile(offer tunnel.FileOffer) bool {
+	answer := make(chan bool, 1)
+	dialog.ShowConfirm("Accept file?", fmt.Sprintf("The server offers %s (%d bytes), saved to %s", offer.Name, offer.Size, tunnel.DownloadDir), func(ok bool) {
+		answer <- ok
+	}, window)
+	return <-answer
+}
+
+// promptCode asks the user for the one-time code the server challenged for
+func promptCode() (code string, ok bool) {
+	answer := make(chan bool, 1)
+	codeField := ui.NewEntry("", "Code from your authenticator app", false, auth.TOTPDigits)
+	dialog.ShowCustomConfirm("One-time code", "Submit", "Cancel", codeField, func(ok bool) {
+		answer <- ok
+	}, window)
+	ok = <-answer
+	return strings.TrimSpace(codeField.Text), ok
+}
+
+func traceRecord(outbound bool, frame []byte) {
+	if outbound {
+		ui.LogO("Sent E(len, message, K_session): " + fmt.Sprintf("%x", frame))
+		return
+	}
+	ui.LogI("Received encrypted text: " + fmt.Sprintf("%x", frame))
+}
+
+func recvLoop(s *remote.Session, m *remote.Mux) {
+	var (
+		err     error
+		ty      remote.RecordType
+		payload []byte
+		message string
+		config  remote.InterfaceConfig
+		dev     packet.Device
+	)
+	defer m.Close(nil)
+
+	for {
+		if ty, payload, err = s.ReadRecord(); err != nil {
+			m.Close(err)
+
+			// an alert means the server ended the session on purpose, so only network errors are retried
+			_, isAlert := err.(*remote.AlertError)
+			mutex.Lock()
+			retry := autoReconnect && !closedByUser && !isAlert
+			if retry {
+				reconnecting = true
+				cancelReconnect = make(chan struct{})
+			}
+			mutex.Unlock()
+			if retry {
+				ui.LogE(err)
+				s.Close()
+				reconnect()
+				return
+			}
+			logClose(err)
 			handleDisconnect()
 			return
 		}
 
-		ui.LogI("Received encrypted text: " + fmt.Sprintf("%x", encrypted))
-		if decrypted, err = crypto.DecryptBytes(encrypted, sessionKey); err != nil {
+		switch {
+		case remote.IsStreamRecord(ty):
+			err = m.HandleRecord(ty, payload)
+		case ty == remote.RecordPacket:
+			if dev != nil {
+				packet.Inject(dev, payload)
+			}
+		case ty == remote.RecordConfig:
+			if err = remote.ReadControl(payload, &config); err != nil {
+				break
+			}
+			mutex.Lock()
+			resolver = config.Resolver
+			mutex.Unlock()
+			if dev == nil {
+				dev = openTUN(s, m, config)
+			}
+		case ty == remote.RecordRoster:
+			var roster remote.Roster
+			if err = remote.ReadControl(payload, &roster); err != nil {
+				break
+			}
+			showRoster(roster.Peers)
+			if endpoint != nil {
+				err = endpoint.Introduce(roster.Peers)
+			}
+		case ty == remote.RecordRelay:
+			if payload, err = receiveRelay(payload); err == nil && payload == nil {
+				continue
+			}
+		case ty != remote.RecordData:
+			err = fmt.Errorf("Unexpected record type %d", ty)
+		}
+		if err != nil {
 			ui.LogE(err)
+			s.CloseWithAlert(remote.AlertProtocolViolation, err.Error())
 			handleDisconnect()
 			return
 		}
+		if ty != remote.RecordData && ty != remote.RecordRelay {
+			continue
+		}
 
-		message = string(decrypted)
+		message = string(payload)
 		ui.Log("Decrypted message: " + message)
 		outputArea.SetText(ui.StringWrap(message+"\n"+outputArea.Text, ui.WrapWordLength))
 		window.Resize(window.Canvas().Size())
@@ -290,21 +943,33 @@ func recvLoop() {
 }
 
 // Start initializes the client application
-func Start(w fyne.Window, app fyne.App) {
+func Start(w fyne.Window, app fyne.App, opts Options) {
 
 	w.Resize(fyne.NewSize(960, 440))
 	window = w
+	options = opts
 
 	ipAddressField = ui.NewEntry(remote.DefaultIPAddress, "", false, 42)
 	portField = ui.NewEntry(remote.DefaultPort, "", false, 42)
 
 	secretField = ui.NewEntry("", "Shared Secret Value", false, 42)
+	passwordField = widget.NewPasswordEntry()
+	passwordField.SetPlaceHolder("Password of " + options.Username)
+	timeoutField = ui.NewEntry(strconv.Itoa(int(remote.DefaultDeadPeerTimeout/time.Second)), "", false, 42)
+	statusLabel = widget.NewLabel("Not connected")
+	routesLabel = widget.NewLabel("Routes: none")
 
 	connectBtn = widget.NewButton("Connect", handleConnect)
-	disconnectBtn = ui.NewButton("Disconnect", handleDisconnect, true)
+	disconnectBtn = ui.NewButton("Disconnect", handleUserDisconnect, true)
 
 	inputArea = ui.NewEntry("", inputAreaPlaceholder, true, 51)
 	inputBtn = ui.NewButton("Send", handleSend, true)
+	peerSelect = widget.NewSelect([]string{toServer}, func(string) {})
+	peerSelect.SetSelected(toServer)
+	peerSelect.Hide()
+	fileField = ui.NewEntry("", "Path of the file to send", false, 0)
+	fileBtn = ui.NewButton("Send File", handleSendFile, true)
+	fileProgress = widget.NewProgressBar()
 
 	outputArea = ui.NewMultiLineEntry("", "", true)
 	continueBtn = ui.NewStepperButton("Step")
@@ -313,6 +978,10 @@ func Start(w fyne.Window, app fyne.App) {
 	form.Append("IP Address", ipAddressField)
 	form.Append("Port", portField)
 	form.Append("Secret", secretField)
+	if options.Username != "" {
+		form.Append("Password", passwordField)
+	}
+	form.Append("Peer Timeout (s)", timeoutField)
 
 	headings := fyne.NewContainerWithLayout(layout.NewGridLayout(1),
 		widget.NewHBox(
@@ -324,10 +993,24 @@ func Start(w fyne.Window, app fyne.App) {
 
 	leftTopCell := widget.NewVBox(
 		form,
-		widget.NewHBox(layout.NewSpacer(), connectBtn, disconnectBtn),
+		widget.NewHBox(
+			statusLabel,
+			layout.NewSpacer(),
+			ui.NewCheck("Reconnect", func(b bool) {
+				mutex.Lock()
+				autoReconnect = b
+				mutex.Unlock()
+			}, false),
+			connectBtn,
+			disconnectBtn),
+		routesLabel,
 		ui.NewBoldedLabel("Data to be Sent"),
 		inputArea,
-		widget.NewHBox(layout.NewSpacer(), inputBtn),
+		widget.NewHBox(layout.NewSpacer(), peerSelect, inputBtn),
+		ui.NewBoldedLabel("File to be Sent"),
+		fileField,
+		fileProgress,
+		widget.NewHBox(layout.NewSpacer(), fileBtn),
 		ui.NewBoldedLabel("Data as Received"),
 	)
 	leftMidCell := widget.NewScrollContainer(widget.NewVBox(outputArea))
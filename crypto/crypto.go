@@ -12,4 +12,5 @@ func Init() {
 	gob.Register(AuthenticationPayloadBeginAB{})
 	gob.Register(AuthenticationPayloadResponseBA{})
 	gob.Register(AuthenticationPayloadResponseAB{})
+	gob.Register(AuthenticationAlert{})
 }
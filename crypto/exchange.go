@@ -59,17 +59,51 @@ var (
 // AuthenticationPayloadBeginAB is the message format for the first step of authentication
 type AuthenticationPayloadBeginAB struct {
 	ChallengeAB [DefaultNonceLength]byte
+
+	// Compression lists the payload compression the client supports, in order of preference
+	Compression []string
+
+	// Username names the user the client authenticates as, if the server has a user database
+	Username string
 }
 
 // AuthenticationPayloadResponseBA is the message format for the second step of authentication
 type AuthenticationPayloadResponseBA struct {
 	ChallengeBA                   [DefaultNonceLength]byte
 	EncSrvrChallengeABPartialkeyB []byte
+
+	// Compression is the payload compression the server picked from the client's list
+	Compression string
+
+	// Salt and Iterations derive the user's verifier from its secret, if the client sent a username
+	Salt       []byte
+	Iterations int
+
+	// Password is set when the server checks the user's password once the session key is agreed
+	Password bool
+
+	// OTP is set when the server challenges for a one-time code once the session key is agreed
+	OTP bool
 }
 
 // AuthenticationPayloadResponseAB is the message format for the third step of authentication
 type AuthenticationPayloadResponseAB struct {
 	EncChallengeBAPartialKeyA []byte
+
+	// EncPassword is the user's password encrypted with the session key, if the server asked for it
+	EncPassword []byte
+
+	// EncCode is the user's one-time code encrypted with the session key, if the server asked for it
+	EncCode []byte
+
+	// CompressionMAC authenticates the compression the client offered and accepted with the
+	// session key, so the server can tell if the negotiation was tampered with
+	CompressionMAC []byte
+}
+
+// AuthenticationAlert is the message format for aborting authentication, encrypted with the shared secret
+type AuthenticationAlert struct {
+	EncReason []byte
 }
 
 // DecodedChallengePartialKey is the decoded challenge key appended to the partial key
@@ -0,0 +1,23 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// MACLength is the length of a message authentication code
+const MACLength = sha256.Size
+
+// ComputeMAC returns the HMAC-SHA256 of the data; the MAC key is derived from the specified
+// key so that it differs from the encryption key
+func ComputeMAC(data []byte, key string) []byte {
+	macKey := sha256.Sum256([]byte("MAC" + key))
+	mac := hmac.New(sha256.New, macKey[:])
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// VerifyMAC checks the MAC of the data in constant time
+func VerifyMAC(data []byte, mac []byte, key string) bool {
+	return hmac.Equal(mac, ComputeMAC(data, key))
+}
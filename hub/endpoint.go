@@ -0,0 +1,261 @@
+package hub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pwang347/simple-vpn/crypto"
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+const sealHeaderLength = 12
+
+var (
+	// ErrNotSealed is returned when a message from another client was not encrypted end-to-end
+	ErrNotSealed = errors.New("Message was not encrypted end-to-end, the hub may have forged it")
+
+	// ErrBadSeal is returned when a message encrypted end-to-end fails authentication or was replayed
+	ErrBadSeal = errors.New("Message encrypted end-to-end failed authentication")
+)
+
+// Endpoint encrypts the messages a client relays through a hub end-to-end; it exchanges a
+// Diffie-Hellman key with each other client through the hub, so the hub only sees who
+// messages are for and not what they say
+type Endpoint struct {
+	mutex      sync.Mutex
+	identity   string
+	exponent   []byte
+	partialKey []byte
+	peers      map[string]*peerKey
+	roster     []string
+	send       func(msg remote.Relay) error
+
+	// OnKey is called when a key is agreed with another client, with the fingerprint both
+	// clients should see if the hub did not intercept the exchange
+	OnKey func(identity, fingerprint string)
+}
+
+// peerKey is the key shared with another client, and the messages waiting for it
+type peerKey struct {
+	partialKey []byte
+	key        string
+	sendSeq    uint64
+	recvSeq    uint64
+	pending    [][]byte
+}
+
+// NewEndpoint returns an endpoint for the client with the identity, which relays messages
+// through the hub with send
+func NewEndpoint(identity string, send func(msg remote.Relay) error) *Endpoint {
+	exponent := crypto.GenerateRandomExponent()
+	return &Endpoint{
+		identity:   identity,
+		exponent:   exponent,
+		partialKey: crypto.GeneratePartialKey(exponent),
+		peers:      make(map[string]*peerKey),
+		send:       send,
+	}
+}
+
+// Introduce updates the clients online from a roster, sending this client's partial key
+// to each new one and forgetting the keys of clients which left
+func (e *Endpoint) Introduce(peers []string) (err error) {
+	var introduce []string
+	e.mutex.Lock()
+	e.roster = nil
+	online := make(map[string]bool)
+	for _, peer := range peers {
+		if peer == e.identity {
+			continue
+		}
+		online[peer] = true
+		e.roster = append(e.roster, peer)
+		if _, ok := e.peers[peer]; !ok {
+			e.peers[peer] = &peerKey{}
+			introduce = append(introduce, peer)
+		}
+	}
+	for peer := range e.peers {
+		if !online[peer] {
+			delete(e.peers, peer)
+		}
+	}
+	e.mutex.Unlock()
+
+	for _, peer := range introduce {
+		if err = e.send(remote.Relay{To: peer, Key: e.partialKey}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Send encrypts a message for another client, or for every other client if to is empty;
+// messages for a client whose key is not agreed yet are sent once it is
+func (e *Endpoint) Send(to string, data []byte) (err error) {
+	var (
+		msgs []remote.Relay
+		msg  remote.Relay
+	)
+	e.mutex.Lock()
+	recipients := []string{to}
+	if to == "" {
+		recipients = e.roster
+	}
+	for _, peer := range recipients {
+		pk, ok := e.peers[peer]
+		switch {
+		case !ok:
+			err = ErrUnknownPeer
+		case pk.key == "":
+			pk.pending = append(pk.pending, data)
+			continue
+		default:
+			msg, err = e.seal(peer, pk, data)
+		}
+		if err != nil {
+			e.mutex.Unlock()
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	e.mutex.Unlock()
+
+	for _, msg := range msgs {
+		if err = e.send(msg); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Receive handles a message relayed from another client, returning the decrypted message
+// or nil if it was part of a key exchange
+func (e *Endpoint) Receive(msg remote.Relay) (data []byte, err error) {
+	if msg.Key != nil {
+		return nil, e.agree(msg.From, msg.Key)
+	}
+	if !msg.Sealed {
+		return nil, ErrNotSealed
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	pk, ok := e.peers[msg.From]
+	if !ok || pk.key == "" || len(msg.Data) < crypto.MACLength {
+		return nil, ErrBadSeal
+	}
+	macOffset := len(msg.Data) - crypto.MACLength
+	if !crypto.VerifyMAC(sealed(msg.From, e.identity, msg.Data[:macOffset]), msg.Data[macOffset:], pk.key) {
+		return nil, ErrBadSeal
+	}
+	var decrypted []byte
+	if decrypted, err = crypto.DecryptBytes(append([]byte{}, msg.Data[:macOffset]...), pk.key); err != nil {
+		return
+	}
+	if len(decrypted) < sealHeaderLength {
+		return nil, ErrBadSeal
+	}
+	seq := binary.BigEndian.Uint64(decrypted)
+	length := binary.BigEndian.Uint32(decrypted[8:sealHeaderLength])
+	if seq <= pk.recvSeq || int(length) > len(decrypted)-sealHeaderLength {
+		return nil, ErrBadSeal
+	}
+	pk.recvSeq = seq
+	return decrypted[sealHeaderLength : sealHeaderLength+int(length)], nil
+}
+
+// Fingerprint returns the fingerprint of the key agreed with another client, or an empty
+// string if none was agreed yet
+func (e *Endpoint) Fingerprint(identity string) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	pk, ok := e.peers[identity]
+	if !ok || pk.key == "" {
+		return ""
+	}
+	return e.fingerprint(pk)
+}
+
+// agree derives the key shared with another client from its partial key, replying with
+// this client's partial key if the other client has not seen it yet
+func (e *Endpoint) agree(from string, partialKey []byte) (err error) {
+	e.mutex.Lock()
+	pk, ok := e.peers[from]
+	if !ok {
+		// the key may arrive before the roster announcing the client
+		pk = &peerKey{}
+		e.peers[from] = pk
+	}
+	if bytes.Equal(pk.partialKey, partialKey) {
+		e.mutex.Unlock()
+		return
+	}
+	// a new partial key means the other client started over, so it needs ours again
+	pending := pk.pending
+	*pk = peerKey{
+		partialKey: partialKey,
+		key:        crypto.BytesToBigNumString(crypto.ConstructKey(partialKey, e.exponent)),
+	}
+	msgs := []remote.Relay{{To: from, Key: e.partialKey}}
+	for _, data := range pending {
+		var msg remote.Relay
+		if msg, err = e.seal(from, pk, data); err != nil {
+			e.mutex.Unlock()
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	fingerprint := e.fingerprint(pk)
+	e.mutex.Unlock()
+
+	if e.OnKey != nil {
+		e.OnKey(from, fingerprint)
+	}
+	for _, msg := range msgs {
+		if err = e.send(msg); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// seal encrypts a message for another client, numbering it so that it can't be replayed;
+// the MAC covers who the message is from and to, so the hub can't reflect it back
+func (e *Endpoint) seal(to string, pk *peerKey, data []byte) (msg remote.Relay, err error) {
+	pk.sendSeq++
+	plain := make([]byte, sealHeaderLength, sealHeaderLength+len(data))
+	binary.BigEndian.PutUint64(plain, pk.sendSeq)
+	binary.BigEndian.PutUint32(plain[8:], uint32(len(data)))
+	plain = append(plain, data...)
+
+	var encrypted []byte
+	if encrypted, err = crypto.EncryptBytes(plain, pk.key); err != nil {
+		return
+	}
+	mac := crypto.ComputeMAC(sealed(e.identity, to, encrypted), pk.key)
+	return remote.Relay{To: to, Data: append(encrypted, mac...), Sealed: true}, nil
+}
+
+// fingerprint hashes both partial keys in the same order on either client
+func (e *Endpoint) fingerprint(pk *peerKey) string {
+	keys := []string{string(e.partialKey), string(pk.partialKey)}
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(keys[0] + keys[1]))
+	return fmt.Sprintf("%x-%x-%x-%x", sum[0:2], sum[2:4], sum[4:6], sum[6:8])
+}
+
+// sealed prefixes the data with the identities it is from and to for authentication
+func sealed(from, to string, data []byte) []byte {
+	buf := make([]byte, 0, 4+len(from)+len(to)+len(data))
+	buf = append(buf, byte(len(from)>>8), byte(len(from)))
+	buf = append(buf, from...)
+	buf = append(buf, byte(len(to)>>8), byte(len(to)))
+	buf = append(buf, to...)
+	return append(buf, data...)
+}
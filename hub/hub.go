@@ -0,0 +1,147 @@
+package hub
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+var (
+	// ErrUnknownPeer is returned when a message is addressed to a client which is not online
+	ErrUnknownPeer = errors.New("No such client is online")
+
+	// ErrNotJoined is returned when a client sends a message before identifying itself
+	ErrNotJoined = errors.New("Client must identify itself before relaying messages")
+
+	// ErrIdentityTaken is returned when a client joins under the identity of a client online
+	ErrIdentityTaken = errors.New("Another client is online with that identity")
+)
+
+// Hub relays messages between the clients connected to a server; each message is decrypted
+// with the sender's session key and encrypted again with the receiver's
+type Hub struct {
+	mutex  sync.Mutex
+	peers  map[string]*remote.Session
+	closed bool
+
+	// OnRoster is called with the identities online whenever a client joins or leaves
+	OnRoster func(peers []string)
+}
+
+// New returns a hub with no clients
+func New() *Hub {
+	return &Hub{peers: make(map[string]*remote.Session)}
+}
+
+// Join adds a client under its identity, unless another client is online with it; a client
+// reconnecting before its old session timed out must wait for it to. A client joining once
+// the hub is closed is closed itself
+func (h *Hub) Join(identity string, s *remote.Session) error {
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		s.CloseWithAlert(remote.AlertUserDisconnect, "")
+		return nil
+	}
+	if current, ok := h.peers[identity]; ok && current != s {
+		h.mutex.Unlock()
+		return ErrIdentityTaken
+	}
+	h.peers[identity] = s
+	h.mutex.Unlock()
+	h.pushRoster()
+	return nil
+}
+
+// Leave removes a client, unless its identity was already taken over by a newer session
+func (h *Hub) Leave(identity string, s *remote.Session) {
+	h.mutex.Lock()
+	current, ok := h.peers[identity]
+	if ok && current == s {
+		delete(h.peers, identity)
+	}
+	h.mutex.Unlock()
+	if ok && current == s {
+		h.pushRoster()
+	}
+}
+
+// Peers returns the identities of the clients online, sorted
+func (h *Hub) Peers() (peers []string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for identity := range h.peers {
+		peers = append(peers, identity)
+	}
+	sort.Strings(peers)
+	return
+}
+
+// Session returns the session of the client with the identity, or nil if it is not online
+func (h *Hub) Session(identity string) *remote.Session {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.peers[identity]
+}
+
+// Relay passes a message from a client to the client it is addressed to, or to every other
+// client if it isn't addressed to one
+func (h *Hub) Relay(from string, msg remote.Relay) (err error) {
+	if from == "" {
+		return ErrNotJoined
+	}
+	msg.From = from
+	if msg.To != "" {
+		s := h.Session(msg.To)
+		if s == nil {
+			return ErrUnknownPeer
+		}
+		return s.WriteControl(remote.RecordRelay, msg)
+	}
+	for _, s := range h.sessions(from) {
+		s.WriteControl(remote.RecordRelay, msg)
+	}
+	return nil
+}
+
+// Broadcast sends a data record to every client
+func (h *Hub) Broadcast(data []byte) {
+	for _, s := range h.sessions("") {
+		s.Send(data)
+	}
+}
+
+// Close closes every client's session, and those of clients joining after
+func (h *Hub) Close() {
+	h.mutex.Lock()
+	h.closed = true
+	h.mutex.Unlock()
+	for _, s := range h.sessions("") {
+		s.CloseWithAlert(remote.AlertUserDisconnect, "")
+	}
+}
+
+// sessions returns the sessions of every client except the one with the identity
+func (h *Hub) sessions(except string) (sessions []*remote.Session) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for identity, s := range h.peers {
+		if identity != except {
+			sessions = append(sessions, s)
+		}
+	}
+	return
+}
+
+// pushRoster tells every client and the server who is online
+func (h *Hub) pushRoster() {
+	roster := remote.Roster{Peers: h.Peers()}
+	for _, s := range h.sessions("") {
+		s.WriteControl(remote.RecordRoster, roster)
+	}
+	if h.OnRoster != nil {
+		h.OnRoster(roster.Peers)
+	}
+}
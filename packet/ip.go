@@ -0,0 +1,132 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	ipv4HeaderLength = 20
+	ipv6HeaderLength = 40
+	defaultTTL       = 64
+)
+
+// ipHeader is the part of an IP header the userspace stack needs
+type ipHeader struct {
+	version int
+	src     net.IP
+	dst     net.IP
+	proto   byte
+	payload []byte
+}
+
+// parseIP parses an IPv4 or IPv6 packet; fragments and IPv6 extension headers are not supported
+func parseIP(b []byte) (h ipHeader, ok bool) {
+	if !Valid(b) {
+		return
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		headerLength := int(b[0]&0x0f) * 4
+		totalLength := int(binary.BigEndian.Uint16(b[2:4]))
+		if headerLength < ipv4HeaderLength || totalLength < headerLength || totalLength > len(b) {
+			return
+		}
+		if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+			return
+		}
+		if checksum(b[:headerLength], 0) != 0 {
+			return
+		}
+		h = ipHeader{4, copyIP(b[12:16]), copyIP(b[16:20]), b[9], b[headerLength:totalLength]}
+	case 6:
+		payloadLength := int(binary.BigEndian.Uint16(b[4:6]))
+		if ipv6HeaderLength+payloadLength > len(b) {
+			return
+		}
+		h = ipHeader{6, copyIP(b[8:24]), copyIP(b[24:40]), b[6], b[ipv6HeaderLength : ipv6HeaderLength+payloadLength]}
+	}
+	ok = true
+	return
+}
+
+func copyIP(b []byte) net.IP {
+	return append(net.IP{}, b...)
+}
+
+// buildIP wraps a TCP or UDP segment in an IP header, filling in all checksums
+func buildIP(version int, src, dst net.IP, proto byte, segment []byte) (pkt []byte) {
+	checksumOffset := 16
+	if proto == protoUDP {
+		checksumOffset = 6
+	}
+	segment[checksumOffset] = 0
+	segment[checksumOffset+1] = 0
+	sum := checksum(segment, pseudoHeaderSum(src, dst, proto, len(segment)))
+	if sum == 0 && proto == protoUDP {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[checksumOffset:], sum)
+
+	if version == 4 {
+		pkt = make([]byte, ipv4HeaderLength, ipv4HeaderLength+len(segment))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(ipv4HeaderLength+len(segment)))
+		binary.BigEndian.PutUint16(pkt[6:], 0x4000)
+		pkt[8] = defaultTTL
+		pkt[9] = proto
+		copy(pkt[12:16], src.To4())
+		copy(pkt[16:20], dst.To4())
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt, 0))
+	} else {
+		pkt = make([]byte, ipv6HeaderLength, ipv6HeaderLength+len(segment))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(segment)))
+		pkt[6] = proto
+		pkt[7] = defaultTTL
+		copy(pkt[8:24], src.To16())
+		copy(pkt[24:40], dst.To16())
+	}
+	return append(pkt, segment...)
+}
+
+// verifySegment checks the checksum of a TCP or UDP segment
+func verifySegment(h ipHeader) bool {
+	if h.proto == protoUDP && len(h.payload) >= 8 && binary.BigEndian.Uint16(h.payload[6:]) == 0 {
+		return h.version == 4
+	}
+	return checksum(h.payload, pseudoHeaderSum(h.src, h.dst, h.proto, len(h.payload))) == 0
+}
+
+func pseudoHeaderSum(src, dst net.IP, proto byte, length int) (sum uint32) {
+	if ip := src.To4(); ip != nil {
+		src, dst = ip, dst.To4()
+	}
+	for _, ip := range []net.IP{src, dst} {
+		for i := 0; i+1 < len(ip); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+		}
+	}
+	sum += uint32(proto)
+	sum += uint32(length)
+	return
+}
+
+// checksum returns the internet checksum of the data, see https://tools.ietf.org/html/rfc1071
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
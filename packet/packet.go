@@ -0,0 +1,94 @@
+package packet
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// DefaultMTU leaves room for the record and TCP/IP headers around tunnelled packets
+const DefaultMTU = 1400
+
+// Config configures a TUN interface
+type Config struct {
+	// Name is the interface name; the kernel picks one if it is empty
+	Name string
+
+	// Addresses are the addresses of the interface in CIDR notation, e.g. 10.8.0.1/24 and
+	// fd00:8::1/64; a client may leave them empty to use the addresses pushed by the server
+	Addresses []string
+
+	// MTU is the max size of packets read from the interface
+	MTU int
+}
+
+// Validate checks the config and fills in defaults
+func (cfg *Config) Validate() (err error) {
+	if len(cfg.Addresses) == 0 {
+		return errors.New("TUN interface needs an address")
+	}
+	for _, address := range cfg.Addresses {
+		if _, _, err = net.ParseCIDR(address); err != nil {
+			return errors.New("TUN address must be in CIDR notation, e.g. 10.8.0.1/24")
+		}
+	}
+	if cfg.MTU == 0 {
+		cfg.MTU = DefaultMTU
+	}
+	if cfg.MTU < 576 || cfg.MTU > remote.MaxRecordLength {
+		return errors.New("TUN MTU is out of range")
+	}
+	return
+}
+
+// Device reads and writes whole IP packets
+type Device interface {
+	io.ReadWriteCloser
+
+	// Name returns the name of the interface
+	Name() string
+
+	// MTU returns the max size of packets read from the device
+	MTU() int
+}
+
+// Valid returns whether the buffer starts like an IPv4 or IPv6 packet
+func Valid(b []byte) bool {
+	if len(b) < 20 {
+		return false
+	}
+	version := b[0] >> 4
+	return version == 4 || (version == 6 && len(b) >= 40)
+}
+
+// Forward reads packets from the device and sends them as records over the session until either
+// fails; if routes is not nil, packets to destinations it does not match are dropped
+func Forward(dev Device, s *remote.Session, routes *RouteTable) (err error) {
+	var n int
+	buf := make([]byte, dev.MTU())
+	for {
+		if n, err = dev.Read(buf); err != nil {
+			return
+		}
+		if !Valid(buf[:n]) {
+			continue
+		}
+		if routes != nil && !routes.Match(Destination(buf[:n])) {
+			continue
+		}
+		if err = s.WriteRecord(remote.RecordPacket, buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// Inject writes a packet received from the session to the device, dropping anything that is not an IP packet
+func Inject(dev Device, b []byte) (err error) {
+	if !Valid(b) {
+		return
+	}
+	_, err = dev.Write(b)
+	return
+}
@@ -0,0 +1,178 @@
+package packet
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var (
+	// ErrPoolExhausted is returned when every address in the pool is leased
+	ErrPoolExhausted = errors.New("Address pool is exhausted")
+)
+
+// Pool leases tunnel addresses to clients, giving each identity the same addresses every time;
+// the first address of each prefix belongs to the server
+type Pool struct {
+	mutex    sync.Mutex
+	prefixes []*net.IPNet
+	leases   map[string][]string
+	used     map[string]bool
+	path     string
+}
+
+// NewPool creates a pool leasing addresses from at most one IPv4 and one IPv6 prefix in CIDR
+// notation; leases are loaded from and saved to the file at path unless it is empty
+func NewPool(prefixes []string, path string) (p *Pool, err error) {
+	p = &Pool{
+		leases: make(map[string][]string),
+		used:   make(map[string]bool),
+		path:   path,
+	}
+
+	families := make(map[int]bool)
+	for _, prefix := range prefixes {
+		var network *net.IPNet
+		if _, network, err = net.ParseCIDR(prefix); err != nil {
+			return nil, errors.New("Pool prefix must be in CIDR notation, e.g. 10.8.0.0/24")
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones < 2 {
+			return nil, errors.New("Pool prefix " + prefix + " is too small")
+		}
+		if families[bits] {
+			return nil, errors.New("Pool can have only one IPv4 and one IPv6 prefix")
+		}
+		families[bits] = true
+		p.prefixes = append(p.prefixes, network)
+	}
+	if len(p.prefixes) == 0 {
+		return nil, errors.New("Pool needs a prefix")
+	}
+
+	if path == "" {
+		return
+	}
+	var data []byte
+	if data, err = ioutil.ReadFile(path); os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &p.leases); err != nil {
+		return nil, errors.New("Could not parse leases in " + path)
+	}
+	for _, addresses := range p.leases {
+		for _, address := range addresses {
+			if ip, _, err := net.ParseCIDR(address); err == nil {
+				p.used[ip.String()] = true
+			}
+		}
+	}
+	return
+}
+
+// ServerAddresses returns the server's addresses in CIDR notation
+func (p *Pool) ServerAddresses() (addresses []string) {
+	for _, network := range p.prefixes {
+		addresses = append(addresses, cidr(offset(network.IP, 1), network))
+	}
+	return
+}
+
+// Assign returns the addresses leased to the identity in CIDR notation, leasing new ones if it has none
+func (p *Pool) Assign(identity string) (addresses []string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if addresses = p.leases[identity]; p.valid(addresses) {
+		return
+	}
+	for _, address := range addresses {
+		if ip, _, err := net.ParseCIDR(address); err == nil {
+			delete(p.used, ip.String())
+		}
+	}
+
+	addresses = nil
+	for _, network := range p.prefixes {
+		ip := p.free(network)
+		if ip == nil {
+			return nil, ErrPoolExhausted
+		}
+		addresses = append(addresses, cidr(ip, network))
+	}
+	for _, address := range addresses {
+		ip, _, _ := net.ParseCIDR(address)
+		p.used[ip.String()] = true
+	}
+	p.leases[identity] = addresses
+	err = p.save()
+	return
+}
+
+// valid returns whether a lease matches the pool's prefixes, which may have changed since it was made
+func (p *Pool) valid(addresses []string) bool {
+	if len(addresses) != len(p.prefixes) {
+		return false
+	}
+	for i, address := range addresses {
+		if ip, network, err := net.ParseCIDR(address); err != nil || network.String() != p.prefixes[i].String() || ip.Equal(offset(network.IP, 1)) {
+			return false
+		}
+	}
+	return true
+}
+
+// free returns the first unleased client address in the prefix, or nil if there is none
+func (p *Pool) free(network *net.IPNet) net.IP {
+	_, bits := network.Mask.Size()
+	for ip := offset(network.IP, 2); network.Contains(ip); ip = offset(ip, 1) {
+		// the all-ones IPv4 address is for broadcast
+		if bits == 32 && !network.Contains(offset(ip, 1)) {
+			break
+		}
+		if !p.used[ip.String()] {
+			return ip
+		}
+	}
+	return nil
+}
+
+// save writes the leases to a temporary file and moves it into place, so a crash can't corrupt them
+func (p *Pool) save() (err error) {
+	if p.path == "" {
+		return
+	}
+	var data []byte
+	if data, err = json.MarshalIndent(p.leases, "", "  "); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(p.path+".tmp", data, 0600); err != nil {
+		return
+	}
+	return os.Rename(p.path+".tmp", p.path)
+}
+
+// offset returns the address n after ip
+func offset(ip net.IP, n int) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0 && n > 0; i-- {
+		sum := int(next[i]) + n
+		next[i] = byte(sum)
+		n = sum >> 8
+	}
+	return next
+}
+
+func cidr(ip net.IP, network *net.IPNet) string {
+	ones, _ := network.Mask.Size()
+	return ip.String() + "/" + strconv.Itoa(ones)
+}
@@ -0,0 +1,196 @@
+package packet
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+)
+
+// RouteSet selects the destinations which go through the tunnel
+type RouteSet struct {
+	// Include are the prefixes routed through the tunnel; everything is included if it is empty
+	Include []string `json:",omitempty"`
+
+	// Exclude are prefixes which stay outside the tunnel even if they are included
+	Exclude []string `json:",omitempty"`
+}
+
+// Empty returns whether the set leaves routing alone
+func (set RouteSet) Empty() bool {
+	return len(set.Include) == 0 && len(set.Exclude) == 0
+}
+
+// String describes the set for display
+func (set RouteSet) String() string {
+	if set.Empty() {
+		return "none"
+	}
+	s := "all"
+	if len(set.Include) > 0 {
+		s = strings.Join(set.Include, ", ")
+	}
+	if len(set.Exclude) > 0 {
+		s += " except " + strings.Join(set.Exclude, ", ")
+	}
+	return s
+}
+
+// allRoutes cover every address in halves, so they take precedence over the default route
+// without replacing it
+var allRoutes = []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"}
+
+// Routes returns the prefixes to route through the TUN interface, which are every address if
+// only exclusions are given
+func (set RouteSet) Routes() []string {
+	if len(set.Include) == 0 && len(set.Exclude) > 0 {
+		return allRoutes
+	}
+	return set.Include
+}
+
+// RouteGroup is a route set shared by its members
+type RouteGroup struct {
+	RouteSet
+	Members []string
+}
+
+// RoutePolicy decides the route set of each client identity: its own set if it has one, else
+// the set of the first group it is a member of by name, else the default set
+type RoutePolicy struct {
+	Default RouteSet
+	Groups  map[string]RouteGroup `json:",omitempty"`
+	Users   map[string]RouteSet   `json:",omitempty"`
+}
+
+// LoadRoutePolicy reads a route policy from a JSON file
+func LoadRoutePolicy(path string) (policy *RoutePolicy, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	policy = &RoutePolicy{}
+	if err = json.Unmarshal(data, policy); err != nil {
+		return nil, errors.New("Could not parse route policy in " + path + ": " + err.Error())
+	}
+	if err = policy.Validate(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Validate checks that every prefix in the policy is in CIDR notation
+func (policy *RoutePolicy) Validate() (err error) {
+	sets := []RouteSet{policy.Default}
+	for _, group := range policy.Groups {
+		sets = append(sets, group.RouteSet)
+	}
+	for _, set := range policy.Users {
+		sets = append(sets, set)
+	}
+	for _, set := range sets {
+		if _, err = NewRouteTable(set); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// For returns the route set of the identity
+func (policy *RoutePolicy) For(identity string) RouteSet {
+	if set, ok := policy.Users[identity]; ok {
+		return set
+	}
+
+	names := make([]string, 0, len(policy.Groups))
+	for name := range policy.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, member := range policy.Groups[name].Members {
+			if member == identity {
+				return policy.Groups[name].RouteSet
+			}
+		}
+	}
+	return policy.Default
+}
+
+// RouteTable matches destinations against a route set
+type RouteTable struct {
+	include []*net.IPNet
+	exclude []*net.IPNet
+}
+
+// NewRouteTable parses the prefixes of a route set
+func NewRouteTable(set RouteSet) (table *RouteTable, err error) {
+	table = &RouteTable{}
+	if table.include, err = parsePrefixes(set.Include); err != nil {
+		return nil, err
+	}
+	if table.exclude, err = parsePrefixes(set.Exclude); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func parsePrefixes(prefixes []string) (networks []*net.IPNet, err error) {
+	for _, prefix := range prefixes {
+		var network *net.IPNet
+		if _, network, err = net.ParseCIDR(prefix); err != nil {
+			return nil, errors.New("Route " + prefix + " must be in CIDR notation, e.g. 10.0.0.0/8")
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+// Match returns whether the destination goes through the tunnel
+func (table *RouteTable) Match(ip net.IP) bool {
+	return (len(table.include) == 0 || contains(table.include, ip)) && !contains(table.exclude, ip)
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Destination returns the destination address of an IP packet, or nil if it is not one
+func Destination(b []byte) net.IP {
+	if !Valid(b) {
+		return nil
+	}
+	if b[0]>>4 == 4 {
+		return net.IP(b[16:20])
+	}
+	return net.IP(b[24:40])
+}
+
+// Source returns the source address of an IP packet, or nil if it is not one
+func Source(b []byte) net.IP {
+	if !Valid(b) {
+		return nil
+	}
+	if b[0]>>4 == 4 {
+		return net.IP(b[12:16])
+	}
+	return net.IP(b[8:24])
+}
+
+// SentFrom returns whether an IP packet was sent from one of the addresses
+func SentFrom(b []byte, addresses []net.IP) bool {
+	src := Source(b)
+	for _, address := range addresses {
+		if src != nil && address.Equal(src) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package packet
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPacketLength is the largest packet the stack sends back to the peer
+	maxPacketLength = 65535
+
+	// udpIdleTimeout is how long a UDP flow is kept without traffic
+	udpIdleTimeout = 60 * time.Second
+
+	// DefaultMaxFlows is how many TCP flows, and how many UDP flows, a stack keeps open at once
+	DefaultMaxFlows = 1024
+
+	outputBacklog = 512
+	tickInterval  = 250 * time.Millisecond
+)
+
+// flowKey identifies a TCP or UDP flow by its addresses as seen by the peer
+type flowKey struct {
+	proto   byte
+	src     [16]byte
+	dst     [16]byte
+	srcPort uint16
+	dstPort uint16
+}
+
+func newFlowKey(h ipHeader, srcPort, dstPort uint16) (key flowKey) {
+	key.proto = h.proto
+	copy(key.src[:], h.src.To16())
+	copy(key.dst[:], h.dst.To16())
+	key.srcPort = srcPort
+	key.dstPort = dstPort
+	return
+}
+
+// Stack is a userspace network stack which terminates the TCP and UDP flows in tunnelled IP
+// packets, opening real sockets on behalf of the peer; it needs no privileges. The stack is a
+// Device, so packets from the peer are written to it and packets for the peer are read from it
+type Stack struct {
+	out       chan []byte
+	mutex     sync.Mutex
+	tcp       map[flowKey]*tcpConn
+	udp       map[flowKey]*udpConn
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Dial opens the real connections for flows
+	Dial func(network, address string) (net.Conn, error)
+
+	// MaxFlows bounds the TCP flows, and the UDP flows, open at once, since each holds a real
+	// socket; new TCP flows beyond it are reset and new UDP flows dropped
+	MaxFlows int
+}
+
+// NewStack creates a userspace network stack
+func NewStack() *Stack {
+	s := &Stack{
+		out:    make(chan []byte, outputBacklog),
+		tcp:    make(map[flowKey]*tcpConn),
+		udp:    make(map[flowKey]*udpConn),
+		closed: make(chan struct{}),
+		Dial: func(network, address string) (net.Conn, error) {
+			return net.DialTimeout(network, address, 10*time.Second)
+		},
+		MaxFlows: DefaultMaxFlows,
+	}
+	go s.tickLoop()
+	return s
+}
+
+// Name returns the name of the stack
+func (s *Stack) Name() string {
+	return "userspace network stack"
+}
+
+// MTU returns the max size of packets read from the stack
+func (s *Stack) MTU() int {
+	return maxPacketLength
+}
+
+// Read returns the next packet for the peer
+func (s *Stack) Read(b []byte) (n int, err error) {
+	select {
+	case pkt := <-s.out:
+		n = copy(b, pkt)
+	case <-s.closed:
+		err = io.EOF
+	}
+	return
+}
+
+// Write handles a packet from the peer; unsupported packets are dropped
+func (s *Stack) Write(b []byte) (n int, err error) {
+	n = len(b)
+	h, ok := parseIP(b)
+	if !ok || !verifySegment(h) {
+		return
+	}
+
+	switch h.proto {
+	case protoTCP:
+		s.handleTCP(h)
+	case protoUDP:
+		s.handleUDP(h)
+	}
+	return
+}
+
+// Close closes every flow
+func (s *Stack) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mutex.Lock()
+		tcp, udp := s.tcp, s.udp
+		s.tcp = make(map[flowKey]*tcpConn)
+		s.udp = make(map[flowKey]*udpConn)
+		s.mutex.Unlock()
+
+		for _, c := range tcp {
+			c.close()
+		}
+		for _, c := range udp {
+			c.conn.Close()
+		}
+	})
+	return nil
+}
+
+// send queues a packet for the peer, dropping it if the peer is not keeping up
+func (s *Stack) send(pkt []byte) {
+	if len(pkt) > maxPacketLength {
+		return
+	}
+	select {
+	case s.out <- pkt:
+	case <-s.closed:
+	default:
+	}
+}
+
+func (s *Stack) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			tcp := make([]*tcpConn, 0, len(s.tcp))
+			for _, c := range s.tcp {
+				tcp = append(tcp, c)
+			}
+			for key, c := range s.udp {
+				if now.Sub(c.lastActive()) > udpIdleTimeout {
+					delete(s.udp, key)
+					c.conn.Close()
+				}
+			}
+			s.mutex.Unlock()
+
+			for _, c := range tcp {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+func address(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// udpConn relays a UDP flow through a real socket
+type udpConn struct {
+	conn   net.Conn
+	mutex  sync.Mutex
+	active time.Time
+}
+
+func (c *udpConn) touch() {
+	c.mutex.Lock()
+	c.active = time.Now()
+	c.mutex.Unlock()
+}
+
+func (c *udpConn) lastActive() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.active
+}
+
+func (s *Stack) handleUDP(h ipHeader) {
+	if len(h.payload) < 8 {
+		return
+	}
+	srcPort := binary.BigEndian.Uint16(h.payload[0:])
+	dstPort := binary.BigEndian.Uint16(h.payload[2:])
+	length := int(binary.BigEndian.Uint16(h.payload[4:]))
+	if length < 8 || length > len(h.payload) {
+		return
+	}
+	data := h.payload[8:length]
+	key := newFlowKey(h, srcPort, dstPort)
+
+	s.mutex.Lock()
+	c, exists := s.udp[key]
+	full := len(s.udp) >= s.MaxFlows
+	s.mutex.Unlock()
+
+	if !exists && full {
+		return
+	}
+	if !exists {
+		conn, err := s.Dial("udp", address(h.dst, dstPort))
+		if err != nil {
+			return
+		}
+		c = &udpConn{conn: conn, active: time.Now()}
+		s.mutex.Lock()
+		s.udp[key] = c
+		s.mutex.Unlock()
+		go s.udpReplies(c, h, srcPort, dstPort)
+	}
+
+	c.touch()
+	c.conn.Write(data)
+}
+
+// udpReplies sends datagrams from the real socket back to the peer until the flow expires
+func (s *Stack) udpReplies(c *udpConn, h ipHeader, srcPort, dstPort uint16) {
+	buf := make([]byte, maxPacketLength)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		c.touch()
+
+		segment := make([]byte, 8+n)
+		binary.BigEndian.PutUint16(segment[0:], dstPort)
+		binary.BigEndian.PutUint16(segment[2:], srcPort)
+		binary.BigEndian.PutUint16(segment[4:], uint16(8+n))
+		copy(segment[8:], buf[:n])
+		s.send(buildIP(h.version, h.dst, h.src, protoUDP, segment))
+	}
+}
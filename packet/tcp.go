@@ -0,0 +1,544 @@
+package packet
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpHeaderLength = 20
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// defaultMSS is the segment size assumed when the peer does not send one
+	defaultMSS = 536
+
+	// advertisedMSS is the segment size the stack accepts from the peer
+	advertisedMSS = 1460
+
+	// minMSS is the smallest segment size taken from the peer; below it, defaultMSS is used
+	minMSS = 64
+
+	// tcpBufferSize bounds the data buffered in each direction of a flow
+	tcpBufferSize = 65535
+
+	initialRTO     = time.Second
+	maxRetransmits = 8
+
+	// maxProbeInterval bounds the backoff between probes of a closed window
+	maxProbeInterval = time.Minute
+)
+
+// tcpSegment is a parsed TCP segment
+type tcpSegment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	flags   byte
+	window  uint16
+	mss     int
+	data    []byte
+}
+
+func parseTCP(b []byte) (seg tcpSegment, ok bool) {
+	if len(b) < tcpHeaderLength {
+		return
+	}
+	dataOffset := int(b[12]>>4) * 4
+	if dataOffset < tcpHeaderLength || dataOffset > len(b) {
+		return
+	}
+	seg = tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b[0:]),
+		dstPort: binary.BigEndian.Uint16(b[2:]),
+		seq:     binary.BigEndian.Uint32(b[4:]),
+		ack:     binary.BigEndian.Uint32(b[8:]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:]),
+		mss:     defaultMSS,
+		data:    b[dataOffset:],
+	}
+
+	options := b[tcpHeaderLength:dataOffset]
+	for len(options) > 0 {
+		kind := options[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			break
+		}
+		if kind == 2 && options[1] == 4 {
+			seg.mss = int(binary.BigEndian.Uint16(options[2:]))
+		}
+		options = options[options[1]:]
+	}
+	ok = true
+	return
+}
+
+// length returns the sequence space used by the segment
+func (seg tcpSegment) length() uint32 {
+	n := uint32(len(seg.data))
+	if seg.flags&tcpSYN != 0 {
+		n++
+	}
+	if seg.flags&tcpFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// buildTCP builds a packet carrying a TCP segment from the destination of h back to its source
+func buildTCP(h ipHeader, seg tcpSegment) []byte {
+	headerLength := tcpHeaderLength
+	if seg.flags&tcpSYN != 0 {
+		headerLength += 4
+	}
+	b := make([]byte, headerLength+len(seg.data))
+	binary.BigEndian.PutUint16(b[0:], seg.srcPort)
+	binary.BigEndian.PutUint16(b[2:], seg.dstPort)
+	binary.BigEndian.PutUint32(b[4:], seg.seq)
+	binary.BigEndian.PutUint32(b[8:], seg.ack)
+	b[12] = byte(headerLength/4) << 4
+	b[13] = seg.flags
+	binary.BigEndian.PutUint16(b[14:], seg.window)
+	if seg.flags&tcpSYN != 0 {
+		b[20], b[21] = 2, 4
+		binary.BigEndian.PutUint16(b[22:], advertisedMSS)
+	}
+	copy(b[headerLength:], seg.data)
+	return buildIP(h.version, h.dst, h.src, protoTCP, b)
+}
+
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// tcpConn terminates a TCP flow from the peer and relays it through a real connection
+type tcpConn struct {
+	stack *Stack
+	key   flowKey
+	h     ipHeader
+	conn  net.Conn
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	established bool
+	closed      bool
+	mss         int
+
+	// send state: sendBuf holds the data from sndUna onwards, some of which may not be sent yet
+	iss      uint32
+	sndUna   uint32
+	sndNxt   uint32
+	sndWnd   uint32
+	sendBuf  []byte
+	eof      bool
+	finSent  bool
+	finAcked bool
+
+	// receive state: recvBuf holds data waiting to be written to the real connection
+	rcvNxt     uint32
+	recvBuf    []byte
+	peerFin    bool
+	lastWindow int
+
+	rto        time.Duration
+	retries    int
+	retransmit time.Time
+}
+
+func (s *Stack) handleTCP(h ipHeader) {
+	seg, ok := parseTCP(h.payload)
+	if !ok {
+		return
+	}
+	key := newFlowKey(h, seg.srcPort, seg.dstPort)
+
+	s.mutex.Lock()
+	c, exists := s.tcp[key]
+	if !exists && seg.flags&(tcpSYN|tcpACK|tcpRST) == tcpSYN && len(s.tcp) < s.MaxFlows {
+		c = &tcpConn{
+			stack:  s,
+			key:    key,
+			h:      h,
+			mss:    seg.mss,
+			iss:    rand.Uint32(),
+			rcvNxt: seg.seq + 1,
+			sndWnd: uint32(seg.window),
+			rto:    initialRTO,
+		}
+		if c.mss > advertisedMSS {
+			c.mss = advertisedMSS
+		} else if c.mss < minMSS {
+			c.mss = defaultMSS
+		}
+		c.sndUna = c.iss
+		c.sndNxt = c.iss + 1
+		c.cond = sync.NewCond(&c.mutex)
+		s.tcp[key] = c
+		s.mutex.Unlock()
+		go c.dial()
+		return
+	}
+	s.mutex.Unlock()
+
+	if !exists {
+		s.reset(h, seg)
+		return
+	}
+	c.receive(seg)
+}
+
+// reset answers a segment which does not belong to any flow
+func (s *Stack) reset(h ipHeader, seg tcpSegment) {
+	if seg.flags&tcpRST != 0 {
+		return
+	}
+	reply := tcpSegment{srcPort: seg.dstPort, dstPort: seg.srcPort}
+	if seg.flags&tcpACK != 0 {
+		reply.seq = seg.ack
+		reply.flags = tcpRST
+	} else {
+		reply.ack = seg.seq + seg.length()
+		reply.flags = tcpRST | tcpACK
+	}
+	s.send(buildTCP(h, reply))
+}
+
+func (s *Stack) removeTCP(c *tcpConn) {
+	s.mutex.Lock()
+	if s.tcp[c.key] == c {
+		delete(s.tcp, c.key)
+	}
+	s.mutex.Unlock()
+}
+
+// dial opens the real connection, answering the peer's SYN once it is up
+func (c *tcpConn) dial() {
+	conn, err := c.stack.Dial("tcp", address(c.h.dst, c.key.dstPort))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		c.sendSegment(tcpRST|tcpACK, 0, nil)
+		c.shutdown()
+		return
+	}
+	c.conn = conn
+	c.sendSegment(tcpSYN|tcpACK, c.iss, nil)
+	c.retransmit = time.Now().Add(c.rto)
+}
+
+// sendSegment sends a segment acknowledging everything received so far; the lock must be held
+func (c *tcpConn) sendSegment(flags byte, seq uint32, data []byte) {
+	window := tcpBufferSize - len(c.recvBuf)
+	c.lastWindow = window
+	c.stack.send(buildTCP(c.h, tcpSegment{
+		srcPort: c.key.dstPort,
+		dstPort: c.key.srcPort,
+		seq:     seq,
+		ack:     c.rcvNxt,
+		flags:   flags,
+		window:  uint16(window),
+		data:    data,
+	}))
+}
+
+// transmit sends as much buffered data as the peer's window allows, then the FIN; the lock must be held
+func (c *tcpConn) transmit(window uint32) {
+	if !c.established {
+		return
+	}
+	outstanding := c.sndNxt - c.sndUna
+	for int(outstanding) < len(c.sendBuf) && outstanding < window {
+		n := len(c.sendBuf) - int(outstanding)
+		if n > c.mss {
+			n = c.mss
+		}
+		if uint32(n) > window-outstanding {
+			n = int(window - outstanding)
+		}
+		if c.sndNxt == c.sndUna {
+			c.retransmit = time.Now().Add(c.rto)
+		}
+		c.sendSegment(tcpACK|tcpPSH, c.sndNxt, c.sendBuf[outstanding:int(outstanding)+n])
+		c.sndNxt += uint32(n)
+		outstanding += uint32(n)
+	}
+
+	if c.eof && !c.finSent && int(outstanding) == len(c.sendBuf) {
+		if c.sndNxt == c.sndUna {
+			c.retransmit = time.Now().Add(c.rto)
+		}
+		c.sendSegment(tcpFIN|tcpACK, c.sndNxt, nil)
+		c.sndNxt++
+		c.finSent = true
+	}
+}
+
+// receive handles a segment from the peer
+func (c *tcpConn) receive(seg tcpSegment) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+
+	if seg.flags&tcpRST != 0 {
+		c.shutdown()
+		return
+	}
+	if seg.flags&tcpSYN != 0 {
+		// the peer did not see our SYN-ACK
+		if !c.established && c.conn != nil {
+			c.sendSegment(tcpSYN|tcpACK, c.iss, nil)
+		}
+		return
+	}
+	if seg.flags&tcpACK == 0 {
+		return
+	}
+
+	if !c.established {
+		if c.conn == nil || seg.ack != c.iss+1 {
+			return
+		}
+		c.established = true
+		c.sndUna = seg.ack
+		c.retries = 0
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go c.readLoop(&wg)
+		go c.writeLoop(&wg)
+		go func() {
+			wg.Wait()
+			c.conn.Close()
+		}()
+	}
+	c.handleAck(seg)
+
+	// data and FIN are only accepted in order
+	acked := false
+	data := seg.data
+	seq := seg.seq
+	if seqBefore(seq, c.rcvNxt) {
+		skip := c.rcvNxt - seq
+		if skip > uint32(len(data)) {
+			skip = uint32(len(data))
+		}
+		data = data[skip:]
+		seq += skip
+	}
+	if len(data) > 0 && seq == c.rcvNxt && !c.peerFin {
+		if free := tcpBufferSize - len(c.recvBuf); len(data) > free {
+			data = data[:free]
+		}
+		c.recvBuf = append(c.recvBuf, data...)
+		c.rcvNxt += uint32(len(data))
+		c.cond.Broadcast()
+	}
+	if len(seg.data) > 0 {
+		acked = true
+	}
+	if seg.flags&tcpFIN != 0 {
+		if !c.peerFin && seg.seq+uint32(len(seg.data)) == c.rcvNxt {
+			c.peerFin = true
+			c.rcvNxt++
+			c.cond.Broadcast()
+		}
+		acked = true
+	}
+	if acked {
+		c.sendSegment(tcpACK, c.sndNxt, nil)
+	}
+
+	if c.peerFin && c.finAcked {
+		c.stack.removeTCP(c)
+	}
+}
+
+// handleAck processes the acknowledgement and window of a segment; the lock must be held
+func (c *tcpConn) handleAck(seg tcpSegment) {
+	limit := c.sndUna + uint32(len(c.sendBuf))
+	if c.finSent {
+		limit++
+	}
+	if seqBefore(seg.ack, c.sndUna) || seqBefore(limit, seg.ack) {
+		return
+	}
+
+	acked := seg.ack - c.sndUna
+	if acked > 0 {
+		data := acked
+		if data > uint32(len(c.sendBuf)) {
+			data = uint32(len(c.sendBuf))
+			c.finAcked = true
+		}
+		c.sendBuf = c.sendBuf[data:]
+		c.sndUna = seg.ack
+		if seqBefore(c.sndNxt, c.sndUna) {
+			c.sndNxt = c.sndUna
+		}
+		c.rto = initialRTO
+		c.retries = 0
+		if c.sndNxt != c.sndUna {
+			c.retransmit = time.Now().Add(c.rto)
+		}
+		c.cond.Broadcast()
+	}
+	c.sndWnd = uint32(seg.window)
+	if c.sndWnd == 0 {
+		// the peer answers while its window is closed, so it is alive and probing carries on
+		c.retries = 0
+	}
+	c.transmit(c.sndWnd)
+}
+
+// tick retransmits unacknowledged segments, resetting the flow if the peer stops responding
+func (c *tcpConn) tick(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	waiting := c.sndNxt != c.sndUna || (c.established && c.sndWnd == 0 && len(c.sendBuf) > 0)
+	if c.closed || c.conn == nil || !waiting || now.Before(c.retransmit) {
+		return
+	}
+
+	c.retries++
+	if c.retries > maxRetransmits {
+		c.sendSegment(tcpRST|tcpACK, c.sndNxt, nil)
+		c.shutdown()
+		return
+	}
+	c.rto *= 2
+	if c.sndWnd == 0 && c.rto > maxProbeInterval {
+		c.rto = maxProbeInterval
+	}
+	c.retransmit = now.Add(c.rto)
+
+	if !c.established {
+		c.sendSegment(tcpSYN|tcpACK, c.iss, nil)
+		return
+	}
+
+	// go back to the first unacknowledged byte, probing with a byte if the window is closed
+	c.sndNxt = c.sndUna
+	c.finSent = false
+	window := c.sndWnd
+	if window == 0 {
+		window = 1
+	}
+	c.transmit(window)
+}
+
+// readLoop sends data from the real connection to the peer
+func (c *tcpConn) readLoop(wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, tcpBufferSize)
+	for {
+		c.mutex.Lock()
+		for !c.closed && len(c.sendBuf) >= tcpBufferSize {
+			c.cond.Wait()
+		}
+		free := tcpBufferSize - len(c.sendBuf)
+		c.mutex.Unlock()
+
+		n, err := c.conn.Read(buf[:free])
+
+		c.mutex.Lock()
+		if c.closed {
+			c.mutex.Unlock()
+			return
+		}
+		c.sendBuf = append(c.sendBuf, buf[:n]...)
+		if err != nil {
+			c.eof = true
+		}
+		c.transmit(c.sndWnd)
+		c.mutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeLoop writes data from the peer to the real connection
+func (c *tcpConn) writeLoop(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		c.mutex.Lock()
+		for !c.closed && !c.peerFin && len(c.recvBuf) == 0 {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mutex.Unlock()
+			return
+		}
+		data := c.recvBuf
+		c.recvBuf = nil
+		c.mutex.Unlock()
+
+		if len(data) == 0 {
+			if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+			return
+		}
+		if _, err := c.conn.Write(data); err != nil {
+			c.mutex.Lock()
+			if !c.closed {
+				c.sendSegment(tcpRST|tcpACK, c.sndNxt, nil)
+				c.shutdown()
+			}
+			c.mutex.Unlock()
+			return
+		}
+
+		// let the peer know the window opened up if it had been squeezed
+		c.mutex.Lock()
+		if !c.closed && c.lastWindow < tcpBufferSize/2 {
+			c.sendSegment(tcpACK, c.sndNxt, nil)
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// shutdown tears the flow down immediately; the lock must be held
+func (c *tcpConn) shutdown() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.stack.removeTCP(c)
+}
+
+// close tears the flow down immediately
+func (c *tcpConn) close() {
+	c.mutex.Lock()
+	c.shutdown()
+	c.mutex.Unlock()
+}
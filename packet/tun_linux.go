@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+package packet
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// see https://www.kernel.org/doc/Documentation/networking/tuntap.txt
+const (
+	tunDevice = "/dev/net/tun"
+	tunSetIFF = 0x400454ca
+	iffTUN    = 0x0001
+	iffNoPI   = 0x1000
+)
+
+type ifReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [24 - 2]byte
+}
+
+type tun struct {
+	*os.File
+	name string
+	mtu  int
+}
+
+func (t *tun) Name() string {
+	return t.name
+}
+
+func (t *tun) MTU() int {
+	return t.mtu
+}
+
+// OpenTUN creates a TUN interface, assigns its address and MTU and brings it up; this
+// needs root or CAP_NET_ADMIN
+func OpenTUN(cfg Config) (dev Device, err error) {
+	var fd int
+	if err = cfg.Validate(); err != nil {
+		return
+	}
+
+	// a non-blocking descriptor lets Close interrupt a pending Read
+	if fd, err = syscall.Open(tunDevice, syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0); err != nil {
+		return
+	}
+
+	req := ifReq{Flags: iffTUN | iffNoPI}
+	copy(req.Name[:syscall.IFNAMSIZ-1], cfg.Name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIFF, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		err = errno
+		return
+	}
+
+	t := &tun{
+		File: os.NewFile(uintptr(fd), tunDevice),
+		name: strings.TrimRight(string(req.Name[:]), "\x00"),
+		mtu:  cfg.MTU,
+	}
+	for _, address := range cfg.Addresses {
+		if err = ip("addr", "add", address, "dev", t.name); err != nil {
+			t.Close()
+			return
+		}
+	}
+	if err = ip("link", "set", "dev", t.name, "mtu", strconv.Itoa(cfg.MTU), "up"); err != nil {
+		t.Close()
+		return
+	}
+	dev = t
+	return
+}
+
+// AddRoute routes the prefix, in CIDR notation, through the TUN interface; a default route is
+// split in two halves so it takes precedence without replacing the host's own default route
+func AddRoute(dev Device, prefix string) (err error) {
+	var network *net.IPNet
+	if _, network, err = net.ParseCIDR(prefix); err != nil {
+		return
+	}
+	if ones, bits := network.Mask.Size(); ones == 0 {
+		lower := &net.IPNet{IP: network.IP, Mask: net.CIDRMask(1, bits)}
+		upper := &net.IPNet{IP: append(net.IP{}, network.IP...), Mask: lower.Mask}
+		upper.IP[0] = 0x80
+		if err = ip("route", "replace", lower.String(), "dev", dev.Name()); err != nil {
+			return
+		}
+		return ip("route", "replace", upper.String(), "dev", dev.Name())
+	}
+	return ip("route", "replace", prefix, "dev", dev.Name())
+}
+
+// AddBypassRoute pins the prefix, in CIDR notation, to the way the host currently routes it, so
+// it stays outside the tunnel when a covering prefix is routed through the TUN interface
+func AddBypassRoute(prefix string) (err error) {
+	var (
+		network *net.IPNet
+		out     []byte
+	)
+	if _, network, err = net.ParseCIDR(prefix); err != nil {
+		return
+	}
+	if out, err = exec.Command("ip", "-o", "route", "get", network.IP.String()).Output(); err != nil {
+		return errors.New("Could not find the route to " + prefix)
+	}
+
+	// keep the gateway and device of e.g. "1.1.1.1 via 192.168.1.1 dev eth0 src 192.168.1.2 uid 0"
+	args := []string{"route", "replace", network.String()}
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "via" || fields[i] == "dev" {
+			args = append(args, fields[i], fields[i+1])
+		}
+	}
+	return ip(args...)
+}
+
+// DeleteRoute removes a route added for the prefix
+func DeleteRoute(prefix string) (err error) {
+	var network *net.IPNet
+	if _, network, err = net.ParseCIDR(prefix); err != nil {
+		return
+	}
+	return ip("route", "del", network.String())
+}
+
+func ip(args ...string) (err error) {
+	var out []byte
+	if out, err = exec.Command("ip", args...).CombinedOutput(); err != nil {
+		err = errors.New("ip " + strings.Join(args, " ") + ": " + strings.TrimSpace(string(out)))
+	}
+	return
+}
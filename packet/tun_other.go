@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package packet
+
+import (
+	"errors"
+)
+
+// OpenTUN is only supported on Linux
+func OpenTUN(cfg Config) (dev Device, err error) {
+	err = errors.New("TUN interfaces are only supported on Linux")
+	return
+}
+
+// AddRoute is only supported on Linux
+func AddRoute(dev Device, prefix string) (err error) {
+	err = errors.New("TUN interfaces are only supported on Linux")
+	return
+}
+
+// AddBypassRoute is only supported on Linux
+func AddBypassRoute(prefix string) (err error) {
+	err = errors.New("TUN interfaces are only supported on Linux")
+	return
+}
+
+// DeleteRoute is only supported on Linux
+func DeleteRoute(prefix string) (err error) {
+	err = errors.New("TUN interfaces are only supported on Linux")
+	return
+}
@@ -0,0 +1,90 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/pwang347/simple-vpn/crypto"
+)
+
+// AlertReason is the reason code carried by an alert record
+type AlertReason uint8
+
+const (
+	// AlertUserDisconnect means the peer closed the session on purpose
+	AlertUserDisconnect AlertReason = iota + 1
+
+	// AlertAuthFailure means the peer rejected our credentials
+	AlertAuthFailure
+
+	// AlertRekeyFailure means the peer could not agree on a new session key
+	AlertRekeyFailure
+
+	// AlertProtocolViolation means the peer received a record it could not accept
+	AlertProtocolViolation
+)
+
+func (r AlertReason) String() string {
+	switch r {
+	case AlertUserDisconnect:
+		return "user disconnect"
+	case AlertAuthFailure:
+		return "authentication failure"
+	case AlertRekeyFailure:
+		return "rekey failure"
+	case AlertProtocolViolation:
+		return "protocol violation"
+	}
+	return fmt.Sprintf("unknown reason %d", uint8(r))
+}
+
+// AlertError is returned when the peer closes the session with an alert
+type AlertError struct {
+	Reason AlertReason
+	Detail string
+}
+
+func (e *AlertError) Error() string {
+	if e.Detail == "" {
+		return "Peer closed the session: " + e.Reason.String()
+	}
+	return "Peer closed the session: " + e.Reason.String() + " (" + e.Detail + ")"
+}
+
+// IsCleanClose returns whether the error is the peer disconnecting on purpose
+func IsCleanClose(err error) bool {
+	alert, ok := err.(*AlertError)
+	return ok && alert.Reason == AlertUserDisconnect
+}
+
+func encodeAlert(reason AlertReason, detail string) []byte {
+	return append([]byte{byte(reason)}, []byte(detail)...)
+}
+
+func decodeAlert(payload []byte) (err error) {
+	if len(payload) == 0 {
+		return ErrMalformedRecord
+	}
+	return &AlertError{Reason: AlertReason(payload[0]), Detail: string(payload[1:])}
+}
+
+// WriteAuthenticationAlert tells a peer that is still authenticating why the handshake was
+// aborted; there is no session key yet, so the alert is encrypted with the shared secret
+func WriteAuthenticationAlert(conn net.Conn, reason AlertReason, detail string, secret string) (err error) {
+	var encrypted []byte
+	if encrypted, err = crypto.EncryptBytes(encodeAlert(reason, detail), secret); err != nil {
+		return
+	}
+	return WriteMessageStruct(conn, crypto.AuthenticationAlert{EncReason: encrypted})
+}
+
+// DecodeAuthenticationAlert returns the error carried by an authentication alert
+func DecodeAuthenticationAlert(msg crypto.AuthenticationAlert, secret string) error {
+	// encryption pads with zeros, which never occur in the reason code or detail text
+	decrypted, err := crypto.DecryptBytes(msg.EncReason, secret)
+	if decrypted = bytes.TrimRight(decrypted, "\x00"); err != nil || len(decrypted) == 0 {
+		return &AlertError{Reason: AlertAuthFailure, Detail: "alert could not be decrypted"}
+	}
+	return decodeAlert(decrypted)
+}
@@ -0,0 +1,29 @@
+package remote
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultReconnectDelay is the delay before the first reconnect attempt
+	DefaultReconnectDelay = time.Second
+
+	// MaxReconnectDelay caps the delay between reconnect attempts
+	MaxReconnectDelay = 30 * time.Second
+)
+
+// ReconnectDelay returns the delay before a reconnect attempt, counting from 1; the delay
+// doubles on every attempt up to MaxReconnectDelay and is jittered by up to half its length
+func ReconnectDelay(attempt int) time.Duration {
+	delay := MaxReconnectDelay
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt <= 16 {
+		if d := DefaultReconnectDelay << uint(attempt-1); d < MaxReconnectDelay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,148 @@
+package remote
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Compression identifies how record payloads are compressed before encryption
+type Compression string
+
+const (
+	// CompressionNone sends payloads as they are
+	CompressionNone Compression = "none"
+
+	// CompressionDeflate compresses each payload on its own with DEFLATE
+	CompressionDeflate Compression = "deflate"
+
+	// recordCompressed is set in the type of records whose payload is compressed
+	recordCompressed = 0x80
+
+	// minCompressLength is the shortest payload worth compressing
+	minCompressLength = 128
+)
+
+// ErrDecompressionBomb is returned when a compressed payload inflates past the max record length
+var ErrDecompressionBomb = errors.New("Compressed payload inflates past the max record length")
+
+// SupportedCompression lists the compression a client offers, in order of preference
+var SupportedCompression = []Compression{CompressionDeflate}
+
+// NegotiateCompression picks the first compression the client offered which the server
+// supports, or none if the server doesn't compress
+func NegotiateCompression(offered []string, enabled bool) Compression {
+	if !enabled {
+		return CompressionNone
+	}
+	for _, name := range offered {
+		for _, c := range SupportedCompression {
+			if Compression(name) == c {
+				return c
+			}
+		}
+	}
+	return CompressionNone
+}
+
+// OfferedCompression returns the compression a client offers in its first handshake message
+func OfferedCompression(enabled bool) (offered []string) {
+	if !enabled {
+		return
+	}
+	for _, c := range SupportedCompression {
+		offered = append(offered, string(c))
+	}
+	return
+}
+
+// AcceptCompression checks the compression the server picked was offered by the client
+func AcceptCompression(offered []string, picked string) (c Compression, err error) {
+	if picked == "" || Compression(picked) == CompressionNone {
+		return CompressionNone, nil
+	}
+	for _, name := range offered {
+		if name == picked {
+			return Compression(picked), nil
+		}
+	}
+	return "", errors.New("Server picked compression which was not offered")
+}
+
+// CompressionTranscript describes the compression offered and picked; the client confirms it
+// under the session key, since the negotiation itself is not encrypted
+func CompressionTranscript(offered []string, picked Compression) string {
+	return strings.Join(offered, ",") + ";" + string(picked)
+}
+
+// SetCompression compresses bulk records sent from now on; interactive data records are
+// never compressed, since their timing and size matter more than their throughput
+func (s *Session) SetCompression(c Compression) {
+	s.mutex.Lock()
+	s.compression = c
+	s.mutex.Unlock()
+}
+
+// compressible returns whether records of the type carry bulk data
+func compressible(ty RecordType) bool {
+	return ty == RecordStreamData || ty == RecordPacket
+}
+
+// compress returns the type byte and payload to encrypt, compressing the payload if that
+// makes it shorter
+func (s *Session) compress(ty RecordType, payload []byte) (byte, []byte) {
+	s.mutex.Lock()
+	c := s.compression
+	s.mutex.Unlock()
+	if c != CompressionDeflate || !compressible(ty) || len(payload) < minCompressLength {
+		return byte(ty), payload
+	}
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(payload)
+	w.Close()
+	if buf.Len() >= len(payload) {
+		return byte(ty), payload
+	}
+
+	s.mutex.Lock()
+	s.stats.PayloadBytes += uint64(len(payload))
+	s.stats.CompressedBytes += uint64(buf.Len())
+	s.mutex.Unlock()
+	return byte(ty) | recordCompressed, buf.Bytes()
+}
+
+// decompress returns the type and payload of a received record, inflating the payload if it
+// was compressed; compressed records are only accepted once compression was negotiated
+func (s *Session) decompress(b byte, payload []byte) (ty RecordType, inflated []byte, err error) {
+	if b&recordCompressed == 0 {
+		return RecordType(b), payload, nil
+	}
+	ty = RecordType(b &^ recordCompressed)
+
+	s.mutex.Lock()
+	c := s.compression
+	s.mutex.Unlock()
+	if c != CompressionDeflate || !compressible(ty) {
+		return 0, nil, ErrMalformedRecord
+	}
+
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+	if inflated, err = ioutil.ReadAll(io.LimitReader(r, MaxRecordLength+1)); err != nil {
+		return 0, nil, ErrMalformedRecord
+	}
+	if len(inflated) > MaxRecordLength {
+		return 0, nil, ErrDecompressionBomb
+	}
+
+	s.mutex.Lock()
+	s.stats.PayloadBytes += uint64(len(inflated))
+	s.stats.CompressedBytes += uint64(len(payload))
+	s.mutex.Unlock()
+	return
+}
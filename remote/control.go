@@ -0,0 +1,75 @@
+package remote
+
+import (
+	"encoding/json"
+)
+
+// Hello is sent by the client in a RecordHello record once the session is up
+type Hello struct {
+	// Identity names the client, so the server can give it the same configuration each time
+	Identity string
+}
+
+// InterfaceConfig is pushed by the server in a RecordConfig record in reply to a Hello
+type InterfaceConfig struct {
+	// Addresses are the client's tunnel addresses in CIDR notation
+	Addresses []string `json:",omitempty"`
+
+	// MTU is the MTU to use on the client's TUN interface
+	MTU int `json:",omitempty"`
+
+	// DNS are the addresses of name servers reachable through the tunnel
+	DNS []string `json:",omitempty"`
+
+	// Routes are the prefixes to route through the tunnel; everything routed to the client's
+	// TUN interface goes through if it is empty
+	Routes []string `json:",omitempty"`
+
+	// Exclude are prefixes kept outside the tunnel even if they are in Routes
+	Exclude []string `json:",omitempty"`
+
+	// Resolver is the address, as seen from the server, of the resolver answering DNS queries
+	// sent through the tunnel
+	Resolver string `json:",omitempty"`
+}
+
+// Relay is a message passed between clients in a RecordRelay record
+type Relay struct {
+	// From is the identity of the sending client, which the hub fills in
+	From string `json:",omitempty"`
+
+	// To is the identity of the receiving client, or empty to send to every other client
+	To string `json:",omitempty"`
+
+	// Data is the message
+	Data []byte `json:",omitempty"`
+
+	// Key is the sender's partial key for an end-to-end key exchange with the receiver
+	Key []byte `json:",omitempty"`
+
+	// Sealed is set when Data is encrypted end-to-end, so only the receiver can read it
+	Sealed bool `json:",omitempty"`
+}
+
+// Roster is pushed by a hub in a RecordRoster record whenever a client comes or goes
+type Roster struct {
+	// Peers are the identities of the clients online, sorted
+	Peers []string
+}
+
+// WriteControl sends a control message as a JSON encoded record
+func (s *Session) WriteControl(ty RecordType, msg interface{}) (err error) {
+	var payload []byte
+	if payload, err = json.Marshal(msg); err != nil {
+		return
+	}
+	return s.WriteRecord(ty, payload)
+}
+
+// ReadControl decodes the payload of a control record
+func ReadControl(payload []byte, msg interface{}) (err error) {
+	if err = json.Unmarshal(payload, msg); err != nil {
+		err = ErrMalformedRecord
+	}
+	return
+}
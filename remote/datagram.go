@@ -0,0 +1,297 @@
+package remote
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pwang347/simple-vpn/crypto"
+)
+
+const (
+	datagramSeqLength      = 8
+	datagramRecordHeader   = 9
+	maxReorderedRecords    = 4096
+	minRetransmitTimeout   = 200 * time.Millisecond
+	retransmitTickInterval = 50 * time.Millisecond
+)
+
+type record struct {
+	ty      RecordType
+	payload []byte
+}
+
+// unackedRecord is a reliable record kept until it is acknowledged; it is not sent until the
+// peer has room to reorder it, so sent is zero until then
+type unackedRecord struct {
+	record
+	sent time.Time
+}
+
+// reliable returns whether records of the type must arrive over a datagram transport; tunnelled
+// packets, keepalives and cover records may be lost, like they would be without the tunnel
+func reliable(ty RecordType) bool {
+	switch ty {
+	case RecordPacket, RecordKeepalive, RecordKeepaliveAck, RecordAck, RecordAlert, RecordCover:
+		return false
+	}
+	return true
+}
+
+// replayWindow remembers which of the last 64 datagram sequence numbers were received
+type replayWindow struct {
+	started bool
+	top     uint64
+	mask    uint64
+}
+
+// accept returns whether a sequence number is new, recording it if so
+func (w *replayWindow) accept(seq uint64) bool {
+	if !w.started || seq > w.top {
+		shift := seq - w.top
+		if !w.started || shift >= 64 {
+			w.mask = 1
+		} else {
+			w.mask = w.mask<<shift | 1
+		}
+		w.started = true
+		w.top = seq
+		return true
+	}
+	diff := w.top - seq
+	if diff >= 64 || w.mask&(1<<diff) != 0 {
+		return false
+	}
+	w.mask |= 1 << diff
+	return true
+}
+
+// writeDatagramRecord numbers reliable records and keeps them until they are acknowledged;
+// records beyond what the peer can reorder are held back, and sent by the retransmit loop once
+// acknowledgements make room
+func (s *Session) writeDatagramRecord(ty RecordType, payload []byte) error {
+	var relSeq uint32
+	wireType, payload := s.compress(ty, payload)
+	if reliable(ty) {
+		s.mutex.Lock()
+		s.relSendSeq++
+		relSeq = s.relSendSeq
+		rec := &unackedRecord{record: record{RecordType(wireType), append([]byte{}, payload...)}}
+		s.unacked[relSeq] = rec
+		inWindow := s.inSendWindow(relSeq)
+		if inWindow {
+			rec.sent = time.Now()
+		}
+		s.mutex.Unlock()
+		if !inWindow {
+			return nil
+		}
+	}
+	return s.sendDatagram(RecordType(wireType), relSeq, payload)
+}
+
+// inSendWindow returns whether the peer has room for a reliable record, however the records
+// before it arrive; the lock must be held
+func (s *Session) inSendWindow(relSeq uint32) bool {
+	return relSeq < s.relAckedNext+maxReorderedRecords
+}
+
+// sendDatagram encrypts a record into a datagram; the datagram sequence number is explicit, so
+// each datagram can be authenticated on its own
+func (s *Session) sendDatagram(ty RecordType, relSeq uint32, payload []byte) (err error) {
+	var encrypted []byte
+
+	rec := make([]byte, datagramRecordHeader+len(payload))
+	rec[0] = byte(ty)
+	binary.BigEndian.PutUint32(rec[1:], relSeq)
+	binary.BigEndian.PutUint32(rec[5:], uint32(len(payload)))
+	copy(rec[datagramRecordHeader:], payload)
+	rec = s.pad(rec, maxDatagramLength)
+
+	key := s.sendingKey()
+	if encrypted, err = crypto.EncryptBytes(rec, key); err != nil {
+		return
+	}
+
+	s.sendMutex.Lock()
+	frame := make([]byte, datagramSeqLength, datagramSeqLength+len(encrypted)+crypto.MACLength)
+	binary.BigEndian.PutUint64(frame, s.sendSeq)
+	s.sendSeq++
+	frame = append(frame, encrypted...)
+	frame = append(frame, crypto.ComputeMAC(frame, key)...)
+	err = s.datagram.WriteDatagram(frame)
+	s.sendMutex.Unlock()
+	if err != nil {
+		return
+	}
+	s.countSent(frame)
+
+	s.mutex.Lock()
+	s.lastSend = time.Now()
+	s.mutex.Unlock()
+	if ty == RecordData && s.Trace != nil {
+		s.Trace(true, frame)
+	}
+	return
+}
+
+// readDatagramRecord returns the next record to deliver; datagrams which fail authentication or
+// were already received are dropped, since anyone can send a datagram
+func (s *Session) readDatagramRecord() (ty RecordType, payload []byte, err error) {
+	for {
+		if len(s.ready) > 0 {
+			next := s.ready[0]
+			s.ready = s.ready[1:]
+			return next.ty, next.payload, nil
+		}
+
+		s.datagram.SetReadDeadline(s.lastAuthentic.Add(s.timeout))
+
+		var frame []byte
+		if frame, err = s.datagram.ReadDatagram(); err != nil {
+			err = s.translateError(err)
+			return
+		}
+		if len(frame) < datagramSeqLength+crypto.MACLength {
+			continue
+		}
+		macOffset := len(frame) - crypto.MACLength
+		key := s.verifyingKey(func(key string) bool {
+			return crypto.VerifyMAC(frame[:macOffset], frame[macOffset:], key)
+		})
+		if key == "" {
+			continue
+		}
+		if !s.replay.accept(binary.BigEndian.Uint64(frame)) {
+			continue
+		}
+		s.lastAuthentic = time.Now()
+		s.confirmKey(key)
+		s.countReceived(frame)
+
+		var decrypted []byte
+		encrypted := append([]byte{}, frame[datagramSeqLength:macOffset]...)
+		if decrypted, err = crypto.DecryptBytes(encrypted, key); err != nil {
+			return
+		}
+		if len(decrypted) < datagramRecordHeader {
+			err = ErrMalformedRecord
+			return
+		}
+		relSeq := binary.BigEndian.Uint32(decrypted[1:])
+		payloadLength := binary.BigEndian.Uint32(decrypted[5:])
+		if int(payloadLength) > len(decrypted)-datagramRecordHeader {
+			err = ErrMalformedRecord
+			return
+		}
+		if ty, payload, err = s.decompress(decrypted[0], decrypted[datagramRecordHeader:datagramRecordHeader+int(payloadLength)]); err != nil {
+			return
+		}
+
+		if ty == RecordData && s.Trace != nil {
+			s.Trace(false, frame)
+		}
+
+		switch {
+		case ty == RecordAck:
+			if err = s.handleAck(payload); err != nil {
+				return
+			}
+		case relSeq == 0:
+			return
+		default:
+			if err = s.receiveReliable(relSeq, record{ty, payload}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// receiveReliable acknowledges a numbered record and queues the records now in order for delivery
+func (s *Session) receiveReliable(relSeq uint32, rec record) (err error) {
+	switch {
+	case relSeq == s.relRecvNext:
+		s.ready = append(s.ready, rec)
+		s.relRecvNext++
+		for {
+			next, ok := s.reordered[s.relRecvNext]
+			if !ok {
+				break
+			}
+			delete(s.reordered, s.relRecvNext)
+			s.ready = append(s.ready, next)
+			s.relRecvNext++
+		}
+	case relSeq > s.relRecvNext && len(s.reordered) < maxReorderedRecords:
+		s.reordered[relSeq] = rec
+	case relSeq > s.relRecvNext:
+		// dropped, so it must not be acknowledged, or it would never be sent again
+		relSeq = 0
+	}
+
+	// acknowledge everything received in order, and this record in case it arrived early
+	ack := make([]byte, 8)
+	binary.BigEndian.PutUint32(ack, s.relRecvNext)
+	binary.BigEndian.PutUint32(ack[4:], relSeq)
+	return s.sendDatagram(RecordAck, 0, ack)
+}
+
+func (s *Session) handleAck(payload []byte) error {
+	if len(payload) != 8 {
+		return ErrMalformedRecord
+	}
+	next := binary.BigEndian.Uint32(payload)
+	relSeq := binary.BigEndian.Uint32(payload[4:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if next > s.relAckedNext {
+		s.relAckedNext = next
+	}
+	delete(s.unacked, relSeq)
+	for seq := range s.unacked {
+		if seq < next {
+			delete(s.unacked, seq)
+		}
+	}
+	return nil
+}
+
+// retransmitLoop sends reliable records again until they are acknowledged, and sends those held
+// back once the peer has room for them
+func (s *Session) retransmitLoop() {
+	ticker := time.NewTicker(retransmitTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.mutex.Lock()
+		timeout := 3 * s.rtt
+		if timeout < minRetransmitTimeout {
+			timeout = minRetransmitTimeout
+		}
+		now := time.Now()
+		var due []uint32
+		for seq, rec := range s.unacked {
+			if s.inSendWindow(seq) && now.Sub(rec.sent) >= timeout {
+				rec.sent = now
+				due = append(due, seq)
+			}
+		}
+		records := make([]record, len(due))
+		for i, seq := range due {
+			records[i] = s.unacked[seq].record
+		}
+		s.mutex.Unlock()
+
+		for i, seq := range due {
+			if err := s.sendDatagram(records[i].ty, seq, records[i].payload); err != nil {
+				return
+			}
+		}
+	}
+}
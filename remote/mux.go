@@ -0,0 +1,489 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultStreamWindow is the number of bytes a peer may send on a stream before it is acknowledged
+	DefaultStreamWindow = 256 * 1024
+
+	// MaxStreamChunk is the max number of stream bytes carried by a single record
+	MaxStreamChunk = 16 * 1024
+
+	// acceptBacklog is the number of opened streams waiting to be accepted
+	acceptBacklog = 16
+
+	streamIDLength = 4
+)
+
+var (
+	// ErrMuxClosed is returned when the session carrying the streams has ended
+	ErrMuxClosed = errors.New("Session carrying the streams has ended")
+
+	// ErrStreamClosed is returned when writing to a stream that was closed
+	ErrStreamClosed = errors.New("Stream is closed")
+
+	// ErrStreamWindow is returned when the peer sends more than the stream window allows
+	ErrStreamWindow = errors.New("Peer exceeded the stream window")
+)
+
+// StreamResetError is returned when the peer aborts a stream
+type StreamResetError struct {
+	Reason string
+}
+
+func (e *StreamResetError) Error() string {
+	return "Stream reset by peer: " + e.Reason
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "Stream deadline exceeded" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// IsStreamRecord returns whether the record belongs to a multiplexed stream
+func IsStreamRecord(ty RecordType) bool {
+	return ty >= RecordStreamOpen && ty <= RecordStreamReset
+}
+
+// Mux multiplexes independent streams over a single session
+type Mux struct {
+	session *Session
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	accept  chan *Stream
+	closed  chan struct{}
+	err     error
+}
+
+// NewMux creates a stream multiplexer over the session; the initiator of the session opens
+// odd stream IDs and the other side opens even ones, so IDs never collide
+func NewMux(session *Session, initiator bool) *Mux {
+	m := &Mux{
+		session: session,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	if initiator {
+		m.nextID = 1
+	}
+	return m
+}
+
+// Open opens a new stream; the header is delivered to the peer when it accepts the stream
+func (m *Mux) Open(header []byte) (st *Stream, err error) {
+	m.mutex.Lock()
+	if m.err != nil {
+		err = m.err
+		m.mutex.Unlock()
+		return
+	}
+	st = newStream(m, m.nextID, header)
+	m.streams[st.id] = st
+	m.nextID += 2
+	m.mutex.Unlock()
+
+	if err = m.session.WriteRecord(RecordStreamOpen, streamPayload(st.id, header)); err != nil {
+		m.remove(st.id)
+	}
+	return
+}
+
+// Accept waits for the peer to open a stream
+func (m *Mux) Accept() (st *Stream, err error) {
+	select {
+	case st = <-m.accept:
+	case <-m.closed:
+		err = m.err
+	}
+	return
+}
+
+// Done returns a channel which is closed once the multiplexer is closed
+func (m *Mux) Done() <-chan struct{} {
+	return m.closed
+}
+
+// Close resets every stream, which is needed once the session has ended
+func (m *Mux) Close(err error) {
+	if err == nil {
+		err = ErrMuxClosed
+	}
+
+	m.mutex.Lock()
+	if m.err != nil {
+		m.mutex.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	close(m.closed)
+	m.mutex.Unlock()
+
+	for _, st := range streams {
+		st.abort(err)
+	}
+}
+
+// HandleRecord applies a stream record received from the peer; an error means the peer
+// violated the protocol and the session should be closed
+func (m *Mux) HandleRecord(ty RecordType, payload []byte) (err error) {
+	if len(payload) < streamIDLength {
+		return ErrMalformedRecord
+	}
+	id := binary.BigEndian.Uint32(payload)
+	payload = payload[streamIDLength:]
+
+	m.mutex.Lock()
+	st, exists := m.streams[id]
+	m.mutex.Unlock()
+
+	if ty == RecordStreamOpen {
+		// the peer may only open IDs of the opposite parity to ours
+		if exists || id%2 == m.nextID%2 {
+			return ErrMalformedRecord
+		}
+		st = newStream(m, id, append([]byte{}, payload...))
+		m.mutex.Lock()
+		m.streams[id] = st
+		m.mutex.Unlock()
+
+		select {
+		case m.accept <- st:
+		default:
+			st.Reset("accept backlog is full")
+		}
+		return
+	}
+
+	// records may still arrive for streams that were closed or reset locally
+	if !exists {
+		return
+	}
+
+	switch ty {
+	case RecordStreamData:
+		err = st.receive(payload)
+	case RecordStreamWindow:
+		if len(payload) != 4 {
+			return ErrMalformedRecord
+		}
+		st.grant(binary.BigEndian.Uint32(payload))
+	case RecordStreamClose:
+		st.receiveClose()
+	case RecordStreamReset:
+		m.remove(id)
+		st.abort(&StreamResetError{Reason: string(payload)})
+	}
+	return
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mutex.Lock()
+	delete(m.streams, id)
+	m.mutex.Unlock()
+}
+
+func streamPayload(id uint32, data []byte) []byte {
+	payload := make([]byte, streamIDLength, streamIDLength+len(data))
+	binary.BigEndian.PutUint32(payload, id)
+	return append(payload, data...)
+}
+
+// Stream is a bidirectional byte stream multiplexed over a session
+type Stream struct {
+	id     uint32
+	mux    *Mux
+	header []byte
+
+	mutex         sync.Mutex
+	writeMutex    sync.Mutex
+	readBuf       bytes.Buffer
+	readClosed    bool
+	writeClosed   bool
+	closed        bool
+	err           error
+	sendWindow    uint32
+	recvWindow    uint32
+	consumed      uint32
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newStream(m *Mux, id uint32, header []byte) *Stream {
+	return &Stream{
+		id:         id,
+		mux:        m,
+		header:     header,
+		sendWindow: DefaultStreamWindow,
+		recvWindow: DefaultStreamWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream ID
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Header returns the header the stream was opened with
+func (st *Stream) Header() []byte {
+	return st.header
+}
+
+// Read reads data sent by the peer, returning io.EOF once the peer has half-closed the stream
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.mutex.Lock()
+		if st.readBuf.Len() > 0 {
+			n, _ = st.readBuf.Read(b)
+			st.consumed += uint32(n)
+
+			// return credit to the peer once half the window was read
+			var credit uint32
+			if st.consumed >= DefaultStreamWindow/2 && !st.readClosed {
+				credit = st.consumed
+				st.recvWindow += credit
+				st.consumed = 0
+			}
+			st.mutex.Unlock()
+
+			if credit > 0 {
+				update := make([]byte, 4)
+				binary.BigEndian.PutUint32(update, credit)
+				st.mux.session.WriteRecord(RecordStreamWindow, streamPayload(st.id, update))
+			}
+			return
+		}
+		if st.err != nil {
+			err = st.err
+			st.mutex.Unlock()
+			return
+		}
+		if st.readClosed || st.closed {
+			st.mutex.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mutex.Unlock()
+
+		if err = wait(st.readable, deadline); err != nil {
+			return
+		}
+	}
+}
+
+// Write sends data to the peer, blocking while the stream window is exhausted
+func (st *Stream) Write(b []byte) (n int, err error) {
+	st.writeMutex.Lock()
+	defer st.writeMutex.Unlock()
+
+	for len(b) > 0 {
+		st.mutex.Lock()
+		if st.err != nil {
+			err = st.err
+			st.mutex.Unlock()
+			return
+		}
+		if st.writeClosed || st.closed {
+			err = ErrStreamClosed
+			st.mutex.Unlock()
+			return
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mutex.Unlock()
+			if err = wait(st.writable, deadline); err != nil {
+				return
+			}
+			continue
+		}
+
+		chunk := len(b)
+		if chunk > MaxStreamChunk {
+			chunk = MaxStreamChunk
+		}
+		if uint32(chunk) > st.sendWindow {
+			chunk = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(chunk)
+		st.mutex.Unlock()
+
+		if err = st.mux.session.WriteRecord(RecordStreamData, streamPayload(st.id, b[:chunk])); err != nil {
+			return
+		}
+		n += chunk
+		b = b[chunk:]
+	}
+	return
+}
+
+// CloseWrite half-closes the stream; the peer reads io.EOF but may keep sending
+func (st *Stream) CloseWrite() (err error) {
+	st.writeMutex.Lock()
+	defer st.writeMutex.Unlock()
+
+	st.mutex.Lock()
+	if st.writeClosed || st.err != nil {
+		st.mutex.Unlock()
+		return
+	}
+	st.writeClosed = true
+	done := st.readClosed
+	st.mutex.Unlock()
+
+	if done {
+		st.mux.remove(st.id)
+	}
+	return st.mux.session.WriteRecord(RecordStreamClose, streamPayload(st.id, nil))
+}
+
+// Close closes the stream; if the peer has not finished sending, the stream is reset instead
+func (st *Stream) Close() (err error) {
+	st.mutex.Lock()
+	if st.closed {
+		st.mutex.Unlock()
+		return
+	}
+	st.closed = true
+	peerDone := st.readClosed || st.err != nil
+	st.mutex.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+
+	if !peerDone {
+		return st.Reset("stream closed")
+	}
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream in both directions
+func (st *Stream) Reset(reason string) (err error) {
+	st.mux.remove(st.id)
+	st.abort(ErrStreamClosed)
+	return st.mux.session.WriteRecord(RecordStreamReset, streamPayload(st.id, []byte(reason)))
+}
+
+// LocalAddr returns the local address of the session
+func (st *Stream) LocalAddr() net.Addr {
+	return st.mux.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.mux.session.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future reads
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.readDeadline = t
+	st.mutex.Unlock()
+	signal(st.readable)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for pending and future writes
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	st.writeDeadline = t
+	st.mutex.Unlock()
+	signal(st.writable)
+	return nil
+}
+
+func (st *Stream) receive(data []byte) (err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if uint32(len(data)) > st.recvWindow {
+		return ErrStreamWindow
+	}
+	st.recvWindow -= uint32(len(data))
+
+	// data for a stream closed locally is dropped, but its credit is returned by the reset
+	if st.closed || st.readClosed {
+		return
+	}
+	st.readBuf.Write(data)
+	signal(st.readable)
+	return
+}
+
+func (st *Stream) grant(credit uint32) {
+	st.mutex.Lock()
+	st.sendWindow += credit
+	st.mutex.Unlock()
+	signal(st.writable)
+}
+
+func (st *Stream) receiveClose() {
+	st.mutex.Lock()
+	st.readClosed = true
+	done := st.writeClosed
+	st.mutex.Unlock()
+	signal(st.readable)
+
+	if done {
+		st.mux.remove(st.id)
+	}
+}
+
+func (st *Stream) abort(err error) {
+	st.mutex.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mutex.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+}
+
+// signal wakes up a waiter without blocking if one is already pending
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until the channel is signalled or the deadline passes
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return timeoutError{}
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return timeoutError{}
+	}
+}
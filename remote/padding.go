@@ -0,0 +1,152 @@
+package remote
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pwang347/simple-vpn/crypto"
+)
+
+// PaddingMode decides how records are padded before encryption to hide their length
+type PaddingMode string
+
+const (
+	// PaddingNone sends records at their own length
+	PaddingNone PaddingMode = "none"
+
+	// PaddingBuckets pads records up to the next of a few sizes growing by powers of two
+	PaddingBuckets PaddingMode = "buckets"
+
+	// PaddingFixed pads records up to a multiple of a fixed size, such as the path MTU
+	PaddingFixed PaddingMode = "fixed"
+
+	// DefaultPaddingSize is the size records are padded to a multiple of in fixed mode
+	DefaultPaddingSize = 1200
+
+	minPaddingBucket = 128
+	maxPaddingBucket = 1 << 16
+
+	// paddingOverhead leaves room within the frame limits for the IV, block padding and MAC
+	paddingOverhead = 128
+)
+
+// PaddingConfig configures length hiding for a session
+type PaddingConfig struct {
+	Mode PaddingMode
+
+	// Size is the size records are padded to a multiple of in fixed mode
+	Size int
+
+	// CoverInterval sends a cover record whenever nothing was sent for the interval, so an
+	// observer sees a constant rate of records while idle; zero disables cover traffic
+	CoverInterval time.Duration
+}
+
+// ParsePaddingMode parses the name of a padding mode
+func ParsePaddingMode(s string) (mode PaddingMode, err error) {
+	switch mode = PaddingMode(s); mode {
+	case PaddingNone, PaddingBuckets, PaddingFixed:
+		return
+	}
+	return "", errors.New("Padding must be none, buckets or fixed")
+}
+
+// Validate checks the padding config, filling in the default size
+func (p *PaddingConfig) Validate() error {
+	if p.Mode == "" {
+		p.Mode = PaddingNone
+	}
+	if p.Mode == PaddingFixed && p.Size == 0 {
+		p.Size = DefaultPaddingSize
+	}
+	if p.Size < 0 || p.CoverInterval < 0 {
+		return errors.New("Padding size and cover interval must not be negative")
+	}
+	if p.CoverInterval > 0 && p.CoverInterval < 10*time.Millisecond {
+		return errors.New("Cover interval must be at least 10ms")
+	}
+	return nil
+}
+
+// paddedLength returns the length to pad a record of the length to, which is never more than
+// the limit unless the record already is
+func (p PaddingConfig) paddedLength(length, limit int) (padded int) {
+	switch p.Mode {
+	case PaddingBuckets:
+		padded = minPaddingBucket
+		for padded < length && padded < maxPaddingBucket {
+			padded *= 2
+		}
+		if padded < length {
+			padded = (length + maxPaddingBucket - 1) / maxPaddingBucket * maxPaddingBucket
+		}
+	case PaddingFixed:
+		if p.Size <= 0 {
+			return length
+		}
+		padded = (length + p.Size - 1) / p.Size * p.Size
+		if padded == 0 {
+			padded = p.Size
+		}
+	default:
+		return length
+	}
+	if padded > limit {
+		padded = limit
+	}
+	if padded < length {
+		padded = length
+	}
+	return
+}
+
+// SetPadding pads the records sent from now on and starts sending cover records if configured;
+// the peer discards padding and cover records whatever its own config
+func (s *Session) SetPadding(p PaddingConfig) {
+	s.mutex.Lock()
+	s.padding = p
+	s.mutex.Unlock()
+	if p.CoverInterval > 0 {
+		go s.coverLoop(p.CoverInterval)
+	}
+}
+
+// pad appends zeros to a plaintext record up to its padded length
+func (s *Session) pad(rec []byte, limit int) []byte {
+	s.mutex.Lock()
+	p := s.padding
+	s.mutex.Unlock()
+	if padded := p.paddedLength(len(rec), limit-paddingOverhead); padded > len(rec) {
+		rec = append(rec, make([]byte, padded-len(rec))...)
+	}
+	return rec
+}
+
+// lengthMask returns the key stream hiding the length of a frame, which is derived from the
+// random IV heading its ciphertext so that no two frames share one
+func lengthMask(seq uint64, iv []byte, key string) []byte {
+	return crypto.ComputeMAC(append(sequenced(seq, []byte("length")), iv...), key)[:frameHeaderLength]
+}
+
+func (s *Session) coverLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.mutex.Lock()
+		idle := time.Since(s.lastSend)
+		s.mutex.Unlock()
+		if idle < interval {
+			continue
+		}
+		if err := s.WriteRecord(RecordCover, nil); err != nil {
+			return
+		}
+	}
+}
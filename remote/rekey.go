@@ -0,0 +1,142 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/pwang347/simple-vpn/crypto"
+)
+
+const (
+	rekeyRequest byte = iota
+	rekeyResponse
+)
+
+var (
+	// ErrRekeyPending is returned when a rekey is asked for while one is already under way
+	ErrRekeyPending = errors.New("A new session key is already being agreed")
+
+	// ErrUnexpectedRekey is returned when the peer answers a rekey which was not asked for
+	ErrUnexpectedRekey = errors.New("Peer answered a rekey which was not asked for")
+)
+
+// pendingRekey is the exponent of a rekey asked for but not yet answered
+type pendingRekey struct {
+	exponent   []byte
+	partialKey []byte
+}
+
+// Rekey asks the peer to agree a new session key with a Diffie-Hellman exchange under the
+// current one; this side switches to it once the peer answers, and the peer once it receives a
+// record under it. Records sent under the old key are still accepted until the next rekey,
+// since they may be in flight or retransmitted
+func (s *Session) Rekey() (err error) {
+	exponent := crypto.GenerateRandomExponent()
+	pending := &pendingRekey{exponent: exponent, partialKey: crypto.GeneratePartialKey(exponent)}
+
+	// until the peer has shown it has the last key, records it sent under the one before may
+	// still be on their way, and another key would push that one out
+	s.mutex.Lock()
+	if s.rekey != nil || s.sendKey != s.recvKey {
+		s.mutex.Unlock()
+		return ErrRekeyPending
+	}
+	s.rekey = pending
+	s.mutex.Unlock()
+	return s.WriteRecord(RecordRekey, append([]byte{rekeyRequest}, pending.partialKey...))
+}
+
+// Epoch returns how many times the session key was replaced since the handshake
+func (s *Session) Epoch() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.epoch
+}
+
+// handleRekey answers a rekey the peer asked for, or completes one this side asked for
+func (s *Session) handleRekey(payload []byte) (err error) {
+	if len(payload) < 2 {
+		return ErrMalformedRecord
+	}
+	partialKey := payload[1:]
+
+	switch payload[0] {
+	case rekeyRequest:
+		s.mutex.Lock()
+		// if both sides asked at once, the larger partial key wins and the other is dropped
+		if s.rekey != nil && bytes.Compare(s.rekey.partialKey, partialKey) > 0 {
+			s.mutex.Unlock()
+			return
+		}
+		s.rekey = nil
+		s.mutex.Unlock()
+
+		exponent := crypto.GenerateRandomExponent()
+		answer := crypto.GeneratePartialKey(exponent)
+		// the answer may be lost and retransmitted, so this side keeps sending under the old
+		// key until the peer shows it has the new one
+		s.switchKey(crypto.BytesToBigNumString(crypto.ConstructKey(partialKey, exponent)), false)
+		if err = s.WriteRecord(RecordRekey, append([]byte{rekeyResponse}, answer...)); err != nil {
+			return
+		}
+	case rekeyResponse:
+		s.mutex.Lock()
+		pending := s.rekey
+		s.rekey = nil
+		s.mutex.Unlock()
+		if pending == nil {
+			return ErrUnexpectedRekey
+		}
+		s.switchKey(crypto.BytesToBigNumString(crypto.ConstructKey(partialKey, pending.exponent)), true)
+	default:
+		return ErrMalformedRecord
+	}
+	return
+}
+
+// switchKey accepts records under the new key or the old one from now on, and sends under the
+// new key if the peer is known to have it
+func (s *Session) switchKey(key string, send bool) {
+	s.mutex.Lock()
+	s.prevKey = s.recvKey
+	s.recvKey = key
+	if send {
+		s.sendKey = key
+	}
+	s.epoch++
+	epoch := s.epoch
+	s.mutex.Unlock()
+	if s.OnRekey != nil {
+		s.OnRekey(epoch)
+	}
+}
+
+// confirmKey starts sending under the new key once a record under it shows the peer has it
+func (s *Session) confirmKey(key string) {
+	s.mutex.Lock()
+	if key == s.recvKey {
+		s.sendKey = key
+	}
+	s.mutex.Unlock()
+}
+
+// sendingKey returns the key records are sent under
+func (s *Session) sendingKey() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sendKey
+}
+
+// verifyingKey returns the current key, or failing that the previous one, if it passes the
+// check, or an empty string if neither does
+func (s *Session) verifyingKey(check func(key string) bool) string {
+	s.mutex.Lock()
+	keys := []string{s.recvKey, s.prevKey}
+	s.mutex.Unlock()
+	for _, key := range keys {
+		if key != "" && check(key) {
+			return key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,426 @@
+package remote
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pwang347/simple-vpn/crypto"
+)
+
+// RecordType identifies the contents of a session record
+type RecordType uint8
+
+const (
+	// RecordData carries application data entered by the user
+	RecordData RecordType = iota
+
+	// RecordKeepalive is sent when the session has been idle
+	RecordKeepalive
+
+	// RecordKeepaliveAck echoes a keepalive back to its sender
+	RecordKeepaliveAck
+
+	// RecordAlert closes the session with a reason code
+	RecordAlert
+
+	// RecordStreamOpen opens a multiplexed stream
+	RecordStreamOpen
+
+	// RecordStreamData carries data for a multiplexed stream
+	RecordStreamData
+
+	// RecordStreamWindow grants the peer more room to send on a multiplexed stream
+	RecordStreamWindow
+
+	// RecordStreamClose half-closes a multiplexed stream
+	RecordStreamClose
+
+	// RecordStreamReset aborts a multiplexed stream
+	RecordStreamReset
+
+	// RecordPacket carries a tunnelled IP packet
+	RecordPacket
+
+	// RecordHello introduces the client to the server once the session is up
+	RecordHello
+
+	// RecordConfig pushes interface configuration from the server to the client
+	RecordConfig
+
+	// RecordAck acknowledges a record received over a datagram transport
+	RecordAck
+
+	// RecordCover is sent when idle to hide when real records are sent, and is discarded
+	RecordCover
+
+	// RecordRelay carries a message between clients through a hub
+	RecordRelay
+
+	// RecordRoster lists the clients online at a hub
+	RecordRoster
+
+	// RecordRekey carries a partial key for agreeing a new session key
+	RecordRekey
+)
+
+const (
+	// DefaultDeadPeerTimeout is how long to wait for a record before the peer is considered dead
+	DefaultDeadPeerTimeout = 15 * time.Second
+
+	// MaxRecordLength is the max length of an encrypted record
+	MaxRecordLength = 1 << 20
+
+	frameHeaderLength  = 8
+	recordHeaderLength = 5
+	ivLength           = 16
+)
+
+var (
+	// ErrPeerTimeout is returned when nothing was received from the peer within the dead peer timeout
+	ErrPeerTimeout = errors.New("Peer did not respond within the dead peer timeout")
+
+	// ErrRecordTooLong is returned when a record exceeds MaxRecordLength
+	ErrRecordTooLong = errors.New("Record exceeds the max record length")
+
+	// ErrMalformedRecord is returned when a decrypted record cannot be parsed
+	ErrMalformedRecord = errors.New("Malformed record")
+
+	// ErrBadRecordMAC is returned when a record fails authentication
+	ErrBadRecordMAC = errors.New("Record failed authentication")
+
+	// ErrTruncated is returned when the connection ends without a close alert
+	ErrTruncated = errors.New("Connection ended without a close alert, data may have been truncated")
+)
+
+// Session is an authenticated connection exchanging records encrypted with the session key
+type Session struct {
+	conn        net.Conn
+	sendKey     string
+	recvKey     string
+	prevKey     string
+	epoch       uint64
+	rekey       *pendingRekey
+	timeout     time.Duration
+	mutex       sync.Mutex
+	sendMutex   sync.Mutex
+	lastSend    time.Time
+	rtt         time.Duration
+	sendSeq     uint64
+	recvSeq     uint64
+	closed      chan struct{}
+	closeOnce   sync.Once
+	padding     PaddingConfig
+	compression Compression
+	stats       SessionStats
+
+	// over a datagram transport, records other than packets and keepalives are numbered,
+	// retransmitted until acknowledged and delivered in order
+	datagram     *DatagramConn
+	replay       replayWindow
+	relSendSeq   uint32
+	relRecvNext  uint32
+	relAckedNext uint32
+	unacked      map[uint32]*unackedRecord
+	reordered    map[uint32]record
+	ready        []record
+
+	// lastAuthentic is when the last datagram passing authentication arrived; anyone can send
+	// datagrams, so only those keep the session alive
+	lastAuthentic time.Time
+
+	// OnRTT is called with the round trip time whenever a keepalive is echoed
+	OnRTT func(rtt time.Duration)
+
+	// OnRekey is called with the new key epoch whenever a new session key is agreed
+	OnRekey func(epoch uint64)
+
+	// Trace is called with the encrypted frame of every data record sent or received
+	Trace func(outbound bool, frame []byte)
+}
+
+// NewSession starts a session over an authenticated connection; keepalives are sent
+// whenever the session is idle for a third of the dead peer timeout
+func NewSession(conn net.Conn, key string, timeout time.Duration) (s *Session) {
+	if timeout <= 0 {
+		timeout = DefaultDeadPeerTimeout
+	}
+	s = &Session{
+		conn:     conn,
+		sendKey:  key,
+		recvKey:  key,
+		timeout:  timeout,
+		lastSend: time.Now(),
+		closed:   make(chan struct{}),
+	}
+	if dc, ok := conn.(*DatagramConn); ok {
+		s.datagram = dc
+		s.relRecvNext = 1
+		s.relAckedNext = 1
+		s.unacked = make(map[uint32]*unackedRecord)
+		s.reordered = make(map[uint32]record)
+		s.lastAuthentic = time.Now()
+		go s.retransmitLoop()
+	}
+	go s.keepaliveLoop()
+	return
+}
+
+// RemoteAddr returns the address of the peer
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// RTT returns the last measured round trip time, or zero if none was measured yet
+func (s *Session) RTT() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rtt
+}
+
+// Close closes the session and the underlying connection
+func (s *Session) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+	})
+	return
+}
+
+// CloseWithAlert tells the peer why the session is ending, then closes it
+func (s *Session) CloseWithAlert(reason AlertReason, detail string) (err error) {
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	err = s.WriteRecord(RecordAlert, encodeAlert(reason, detail))
+	s.Close()
+	return
+}
+
+// Send writes a data record to the session
+func (s *Session) Send(data []byte) error {
+	return s.WriteRecord(RecordData, data)
+}
+
+// WriteRecord encrypts and writes a single record to the session; frames are
+// authenticated together with an implicit sequence number for each direction, and
+// their length is masked so that only padded record sizes are visible
+func (s *Session) WriteRecord(ty RecordType, payload []byte) (err error) {
+	var encrypted []byte
+	if s.datagram != nil {
+		return s.writeDatagramRecord(ty, payload)
+	}
+
+	wireType, payload := s.compress(ty, payload)
+	record := make([]byte, recordHeaderLength+len(payload))
+	record[0] = wireType
+	binary.BigEndian.PutUint32(record[1:recordHeaderLength], uint32(len(payload)))
+	copy(record[recordHeaderLength:], payload)
+	record = s.pad(record, MaxRecordLength)
+
+	key := s.sendingKey()
+	if encrypted, err = crypto.EncryptBytes(record, key); err != nil {
+		return
+	}
+	if len(encrypted)+crypto.MACLength > MaxRecordLength {
+		return ErrRecordTooLong
+	}
+
+	frame := make([]byte, frameHeaderLength, frameHeaderLength+len(encrypted)+crypto.MACLength)
+	binary.LittleEndian.PutUint64(frame, uint64(len(encrypted)+crypto.MACLength))
+	frame = append(frame, encrypted...)
+
+	s.sendMutex.Lock()
+	mask := lengthMask(s.sendSeq, encrypted[:ivLength], key)
+	for i := range mask {
+		frame[i] ^= mask[i]
+	}
+	frame = append(frame, crypto.ComputeMAC(sequenced(s.sendSeq, frame), key)...)
+	s.sendSeq++
+	_, err = s.conn.Write(frame)
+	s.sendMutex.Unlock()
+	if err != nil {
+		return
+	}
+	s.countSent(frame)
+
+	s.mutex.Lock()
+	s.lastSend = time.Now()
+	s.mutex.Unlock()
+	if ty == RecordData && s.Trace != nil {
+		s.Trace(true, frame)
+	}
+	return
+}
+
+// ReadRecord blocks until the next record other than a keepalive is received; an alert
+// from the peer is returned as an *AlertError and closes the session
+func (s *Session) ReadRecord() (ty RecordType, payload []byte, err error) {
+	for {
+		if ty, payload, err = s.readRecord(); err != nil {
+			switch err {
+			case io.EOF, io.ErrUnexpectedEOF:
+				err = ErrTruncated
+			case ErrMalformedRecord, ErrRecordTooLong, ErrBadRecordMAC, ErrDecompressionBomb:
+				s.CloseWithAlert(AlertProtocolViolation, err.Error())
+			}
+			return
+		}
+
+		switch ty {
+		case RecordCover:
+		case RecordRekey:
+			if err = s.handleRekey(payload); err != nil {
+				s.CloseWithAlert(AlertRekeyFailure, err.Error())
+				return
+			}
+		case RecordKeepalive:
+			if err = s.WriteRecord(RecordKeepaliveAck, payload); err != nil {
+				return
+			}
+		case RecordKeepaliveAck:
+			if len(payload) != 8 {
+				err = ErrMalformedRecord
+				s.CloseWithAlert(AlertProtocolViolation, err.Error())
+				return
+			}
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+			rtt := time.Since(sent)
+			s.mutex.Lock()
+			s.rtt = rtt
+			s.mutex.Unlock()
+			if s.OnRTT != nil {
+				s.OnRTT(rtt)
+			}
+		case RecordAlert:
+			err = decodeAlert(payload)
+			s.Close()
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (s *Session) readRecord() (ty RecordType, payload []byte, err error) {
+	if s.datagram != nil {
+		return s.readDatagramRecord()
+	}
+	var (
+		frameHeader = make([]byte, frameHeaderLength+ivLength)
+		frame       []byte
+		encrypted   []byte
+		decrypted   []byte
+	)
+
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+
+	if _, err = io.ReadFull(s.conn, frameHeader); err != nil {
+		err = s.translateError(err)
+		return
+	}
+
+	// the length only unmasks under the session key, so a length out of range means the
+	// frame was not sent under it; after a rekey, the peer may still send under the old key
+	var messageSize uint64
+	key := s.verifyingKey(func(key string) bool {
+		length := make([]byte, frameHeaderLength)
+		mask := lengthMask(s.recvSeq, frameHeader[frameHeaderLength:], key)
+		for i := range length {
+			length[i] = frameHeader[i] ^ mask[i]
+		}
+		messageSize = binary.LittleEndian.Uint64(length)
+		return messageSize <= MaxRecordLength && messageSize >= ivLength+crypto.MACLength
+	})
+	if key == "" {
+		err = ErrBadRecordMAC
+		return
+	}
+
+	frame = make([]byte, frameHeaderLength+messageSize)
+	copy(frame, frameHeader)
+	if _, err = io.ReadFull(s.conn, frame[len(frameHeader):]); err != nil {
+		err = s.translateError(err)
+		return
+	}
+
+	macOffset := len(frame) - crypto.MACLength
+	if !crypto.VerifyMAC(sequenced(s.recvSeq, frame[:macOffset]), frame[macOffset:], key) {
+		err = ErrBadRecordMAC
+		return
+	}
+	s.confirmKey(key)
+	s.recvSeq++
+	s.countReceived(frame)
+
+	// decryption happens in place, so decrypt a copy and keep the frame for tracing
+	encrypted = append([]byte{}, frame[frameHeaderLength:macOffset]...)
+
+	if decrypted, err = crypto.DecryptBytes(encrypted, key); err != nil {
+		return
+	}
+	if len(decrypted) < recordHeaderLength {
+		err = ErrMalformedRecord
+		return
+	}
+
+	payloadLength := binary.BigEndian.Uint32(decrypted[1:recordHeaderLength])
+	if int(payloadLength) > len(decrypted)-recordHeaderLength {
+		err = ErrMalformedRecord
+		return
+	}
+	if ty, payload, err = s.decompress(decrypted[0], decrypted[recordHeaderLength:recordHeaderLength+int(payloadLength)]); err != nil {
+		return
+	}
+
+	if ty == RecordData && s.Trace != nil {
+		s.Trace(false, frame)
+	}
+	return
+}
+
+// sequenced prefixes the data with a sequence number for authentication
+func sequenced(seq uint64, data []byte) []byte {
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(buf, seq)
+	return append(buf, data...)
+}
+
+func (s *Session) translateError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrPeerTimeout
+	}
+	return err
+}
+
+func (s *Session) keepaliveLoop() {
+	interval := s.timeout / 3
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.mutex.Lock()
+		idle := time.Since(s.lastSend)
+		s.mutex.Unlock()
+		if idle < interval {
+			continue
+		}
+
+		timestamp := make([]byte, 8)
+		binary.BigEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()))
+		if err := s.WriteRecord(RecordKeepalive, timestamp); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package remote
+
+// SessionStats counts the traffic of a session
+type SessionStats struct {
+	RecordsSent     uint64
+	RecordsReceived uint64
+
+	// BytesSent and BytesReceived count whole encrypted frames
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// PayloadBytes and CompressedBytes count compressed payloads in both directions, before
+	// and after compression
+	PayloadBytes    uint64
+	CompressedBytes uint64
+}
+
+// CompressionRatio returns how many times smaller compressed payloads were, or 1 if nothing was compressed
+func (st SessionStats) CompressionRatio() float64 {
+	if st.CompressedBytes == 0 {
+		return 1
+	}
+	return float64(st.PayloadBytes) / float64(st.CompressedBytes)
+}
+
+// Stats returns the traffic counted so far
+func (s *Session) Stats() SessionStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+// countSent counts a frame sent
+func (s *Session) countSent(frame []byte) {
+	s.mutex.Lock()
+	s.stats.RecordsSent++
+	s.stats.BytesSent += uint64(len(frame))
+	s.mutex.Unlock()
+}
+
+// countReceived counts a frame received
+func (s *Session) countReceived(frame []byte) {
+	s.mutex.Lock()
+	s.stats.RecordsReceived++
+	s.stats.BytesReceived += uint64(len(frame))
+	s.mutex.Unlock()
+}
@@ -17,9 +17,34 @@ const (
 	DefaultPort = "8080"
 )
 
+// BufferedConn is a connection with buffered reads; since it implements io.ByteReader,
+// gob decoders read from it without consuming bytes past the end of their message
+type BufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// NewBufferedConn wraps a connection with a read buffer
+func NewBufferedConn(conn net.Conn) *BufferedConn {
+	return &BufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Read reads data from the buffer
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// ReadByte reads a single byte from the buffer
+func (c *BufferedConn) ReadByte() (byte, error) {
+	return c.reader.ReadByte()
+}
+
 // Connect returns a connection to a server for a client
 func Connect(ipAddress, port string) (conn net.Conn, err error) {
-	conn, err = net.Dial("tcp", fmt.Sprintf("%s:%s", ipAddress, port))
+	if conn, err = net.Dial("tcp", fmt.Sprintf("%s:%s", ipAddress, port)); err != nil {
+		return
+	}
+	conn = NewBufferedConn(conn)
 	return
 }
 
@@ -32,12 +57,14 @@ func ServeAndAccept(port string) (conn net.Conn, err error) {
 	if l, err = net.Listen("tcp", fmt.Sprintf(":%s", port)); err != nil {
 		return
 	}
+	defer l.Close()
 
 	// note: this blocks until we get a connection
 	if conn, err = l.Accept(); err != nil {
 		return
 	}
 
+	conn = NewBufferedConn(conn)
 	return
 }
 
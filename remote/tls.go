@@ -0,0 +1,117 @@
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+var (
+	// ErrTLSDatagram is returned when TLS is requested over the udp transport
+	ErrTLSDatagram = errors.New("TLS is only supported over the tcp and ws transports")
+
+	// ErrTLSCertificate is returned when a server has no certificate to present
+	ErrTLSCertificate = errors.New("TLS needs a certificate and key file on the server")
+
+	// ErrTLSCA is returned when a CA file holds no certificates
+	ErrTLSCA = errors.New("CA file holds no PEM certificates")
+)
+
+// Validate checks the TLS options make sense for the transport
+func (cfg TransportConfig) Validate() error {
+	if cfg.TLS && cfg.Kind == TransportUDP {
+		return ErrTLSDatagram
+	}
+	return nil
+}
+
+// clientTLS returns the TLS config a client uses to connect to the host
+func (cfg TransportConfig) clientTLS(host string) (config *tls.Config, err error) {
+	config = &tls.Config{MinVersion: tls.VersionTLS13, ServerName: host}
+	if cfg.ServerName != "" {
+		config.ServerName = cfg.ServerName
+	}
+	if cfg.CAFile != "" {
+		if config.RootCAs, err = loadCertPool(cfg.CAFile); err != nil {
+			return
+		}
+	}
+	if cfg.CertFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+			return
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// serverTLS returns the TLS config a server accepts clients with
+func (cfg TransportConfig) serverTLS() (config *tls.Config, err error) {
+	var cert tls.Certificate
+	if cfg.CertFile == "" {
+		return nil, ErrTLSCertificate
+	}
+	if cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+		return
+	}
+	config = &tls.Config{MinVersion: tls.VersionTLS13, Certificates: []tls.Certificate{cert}}
+	if cfg.CAFile != "" {
+		if config.ClientCAs, err = loadCertPool(cfg.CAFile); err != nil {
+			return
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+func loadCertPool(path string) (pool *x509.CertPool, err error) {
+	var pem []byte
+	if pem, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrTLSCA
+	}
+	return
+}
+
+// connectTLS returns a TLS connection to a server, finishing the TLS handshake before the
+// session's own handshake starts
+func connectTLS(cfg TransportConfig, ipAddress, port string) (conn net.Conn, err error) {
+	var (
+		config  *tls.Config
+		tlsConn *tls.Conn
+	)
+	if config, err = cfg.clientTLS(ipAddress); err != nil {
+		return
+	}
+	if tlsConn, err = tls.Dial("tcp", net.JoinHostPort(ipAddress, port), config); err != nil {
+		return
+	}
+	if cfg.Kind == TransportWebSocket {
+		return upgradeWebSocket(tlsConn, net.JoinHostPort(ipAddress, port), cfg.WebSocketPath)
+	}
+	conn = NewBufferedConn(tlsConn)
+	return
+}
+
+// serveAndAcceptTLS returns a TLS connection to a single client for a server, which may then
+// speak raw TCP or WebSocket inside it
+func serveAndAcceptTLS(cfg TransportConfig, port string) (conn net.Conn, err error) {
+	var (
+		config *tls.Config
+		l      net.Listener
+	)
+	if config, err = cfg.serverTLS(); err != nil {
+		return
+	}
+	if l, err = tls.Listen("tcp", fmt.Sprintf(":%s", port), config); err != nil {
+		return
+	}
+	return acceptWebSocket(l, cfg.WebSocketPath)
+}
@@ -0,0 +1,109 @@
+package remote
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transport carries the handshake and session between client and server
+type Transport string
+
+const (
+	// TransportTCP carries records over a TCP connection
+	TransportTCP Transport = "tcp"
+
+	// TransportUDP carries each record in its own UDP datagram, which avoids stacking TCP's
+	// retransmissions on top of those of tunnelled TCP connections
+	TransportUDP Transport = "udp"
+
+	// TransportWebSocket carries records in WebSocket messages, which pass through HTTP
+	// proxies and load balancers; servers accept them alongside raw TCP connections
+	TransportWebSocket Transport = "ws"
+
+	// DefaultWebSocketPath is the HTTP path WebSocket connections are served on
+	DefaultWebSocketPath = "/vpn"
+)
+
+// HandshakeTimeout is how long a new connection may take to show which transport it uses, and
+// to complete the handshake, so silent connections don't pile up
+var HandshakeTimeout = 10 * time.Second
+
+// TransportConfig configures the transport
+type TransportConfig struct {
+	Kind Transport
+
+	// WebSocketPath is the HTTP path of the WebSocket endpoint
+	WebSocketPath string
+
+	// TLS runs the tcp or ws transport inside a TLS 1.3 connection, under the session's own handshake
+	TLS bool
+
+	// CertFile and KeyFile hold the server's certificate, or the client's if it presents one
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the certificates which verify the server on a client; on a server, clients
+	// must present a certificate verified by them
+	CAFile string
+
+	// ServerName overrides the name a client verifies the server's certificate against
+	ServerName string
+}
+
+// ParseTransport parses the name of a transport
+func ParseTransport(s string) (transport Transport, err error) {
+	switch transport = Transport(s); transport {
+	case TransportTCP, TransportUDP, TransportWebSocket:
+		return
+	}
+	return "", errors.New("Transport must be tcp, udp or ws")
+}
+
+// ConnectTransport returns a connection to a server over the transport for a client
+func ConnectTransport(cfg TransportConfig, ipAddress, port string) (conn net.Conn, err error) {
+	if cfg.TLS && cfg.Kind != TransportUDP {
+		return connectTLS(cfg, ipAddress, port)
+	}
+	switch cfg.Kind {
+	case TransportUDP:
+		return ConnectUDP(ipAddress, port)
+	case TransportWebSocket:
+		return ConnectWebSocket(ipAddress, port, cfg.WebSocketPath)
+	}
+	return Connect(ipAddress, port)
+}
+
+// ServeAndAcceptTransport returns a connection over the transport to a single client for a server
+func ServeAndAcceptTransport(cfg TransportConfig, port string) (conn net.Conn, err error) {
+	if cfg.Kind == TransportUDP {
+		return ServeAndAcceptUDP(port)
+	}
+	if cfg.TLS {
+		return serveAndAcceptTLS(cfg, port)
+	}
+	return ServeAndAcceptWebSocket(port, cfg.WebSocketPath)
+}
+
+// ListenTransport returns a listener accepting any number of clients over the transport for a
+// server; the udp transport only serves a single client
+func ListenTransport(cfg TransportConfig, port string) (l net.Listener, err error) {
+	if cfg.Kind == TransportUDP {
+		return nil, errors.New("The udp transport only serves a single client")
+	}
+	if cfg.TLS {
+		var config *tls.Config
+		if config, err = cfg.serverTLS(); err != nil {
+			return
+		}
+		l, err = tls.Listen("tcp", fmt.Sprintf(":%s", port), config)
+	} else {
+		l, err = net.Listen("tcp", fmt.Sprintf(":%s", port))
+	}
+	if err != nil {
+		return
+	}
+	return newTransportListener(l, cfg.WebSocketPath), nil
+}
@@ -0,0 +1,267 @@
+package remote
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	datagramHandshake = 0
+	datagramRecord    = 1
+
+	handshakeHeaderLength = 5
+	maxDatagramLength     = 65535
+
+	// initialHandshakeRTO is how long to wait for the peer's handshake message before sending ours
+	// again; it doubles after every retransmission up to maxHandshakeRTO
+	initialHandshakeRTO = time.Second
+	maxHandshakeRTO     = 8 * time.Second
+)
+
+var (
+	// ErrDatagramTooLong is returned when a record does not fit in a datagram
+	ErrDatagramTooLong = errors.New("Record does not fit in a datagram")
+)
+
+// DatagramConn carries the handshake and session over UDP. Handshake messages are read and
+// written like a stream, with each one retransmitted until the peer answers; records are
+// exchanged as self-contained datagrams with ReadDatagram and WriteDatagram
+type DatagramConn struct {
+	conn   *net.UDPConn
+	raddr  *net.UDPAddr
+	queued [][]byte
+	buf    []byte
+
+	// handshake state: lastFlight is our last handshake message, sent again if the peer's
+	// answer does not arrive, or if the peer repeats itself because ours was lost
+	sendSeq      uint32
+	recvSeq      uint32
+	lastFlight   []byte
+	lastWasWrite bool
+	message      []byte
+}
+
+// ConnectUDP returns a datagram connection to a server for a client
+func ConnectUDP(ipAddress, port string) (conn net.Conn, err error) {
+	var (
+		raddr *net.UDPAddr
+		c     *net.UDPConn
+	)
+	if raddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(ipAddress, port)); err != nil {
+		return
+	}
+	if c, err = net.DialUDP("udp", nil, raddr); err != nil {
+		return
+	}
+	conn = &DatagramConn{conn: c}
+	return
+}
+
+// ServeAndAcceptUDP returns a datagram connection to the first client which sends a datagram to the port
+func ServeAndAcceptUDP(port string) (conn net.Conn, err error) {
+	var (
+		laddr *net.UDPAddr
+		c     *net.UDPConn
+		n     int
+		raddr *net.UDPAddr
+	)
+	if laddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf(":%s", port)); err != nil {
+		return
+	}
+	if c, err = net.ListenUDP("udp", laddr); err != nil {
+		return
+	}
+
+	// note: this blocks until we get a datagram
+	buf := make([]byte, maxDatagramLength)
+	if n, raddr, err = c.ReadFromUDP(buf); err != nil {
+		c.Close()
+		return
+	}
+	conn = &DatagramConn{conn: c, raddr: raddr, queued: [][]byte{buf[:n]}}
+	return
+}
+
+// readRaw reads the next datagram from the peer, ignoring anyone else
+func (c *DatagramConn) readRaw() (datagram []byte, err error) {
+	if len(c.queued) > 0 {
+		datagram, c.queued = c.queued[0], c.queued[1:]
+		return
+	}
+
+	if c.buf == nil {
+		c.buf = make([]byte, maxDatagramLength)
+	}
+	for {
+		var (
+			n    int
+			from *net.UDPAddr
+		)
+		if c.raddr == nil {
+			n, err = c.conn.Read(c.buf)
+		} else {
+			n, from, err = c.conn.ReadFromUDP(c.buf)
+		}
+		if err != nil {
+			return
+		}
+		if c.raddr == nil || (from.IP.Equal(c.raddr.IP) && from.Port == c.raddr.Port) {
+			return append([]byte{}, c.buf[:n]...), nil
+		}
+	}
+}
+
+func (c *DatagramConn) writeRaw(datagram []byte) (err error) {
+	if len(datagram) > maxDatagramLength {
+		return ErrDatagramTooLong
+	}
+	if c.raddr == nil {
+		_, err = c.conn.Write(datagram)
+	} else {
+		_, err = c.conn.WriteToUDP(datagram, c.raddr)
+	}
+	return
+}
+
+// readHandshake returns the next handshake message, retransmitting our last one on timeout
+func (c *DatagramConn) readHandshake() (msg []byte, err error) {
+	rto := initialHandshakeRTO
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for {
+		if c.lastWasWrite {
+			c.conn.SetReadDeadline(time.Now().Add(rto))
+		}
+		var datagram []byte
+		if datagram, err = c.readRaw(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && c.lastWasWrite {
+				c.writeRaw(c.lastFlight)
+				if rto *= 2; rto > maxHandshakeRTO {
+					rto = maxHandshakeRTO
+				}
+				continue
+			}
+			return
+		}
+
+		// records sent right after the handshake may overtake its last message; they are
+		// dropped and sent again later
+		if len(datagram) < handshakeHeaderLength || datagram[0] != datagramHandshake {
+			continue
+		}
+		seq := binary.BigEndian.Uint32(datagram[1:handshakeHeaderLength])
+		if seq == c.recvSeq {
+			c.recvSeq++
+			c.lastWasWrite = false
+			return datagram[handshakeHeaderLength:], nil
+		}
+		c.handleStale(seq)
+	}
+}
+
+// handleStale answers a repeated handshake message from the peer, which means our answer was lost;
+// once the peer has answered our last message there is nothing to repeat, which stops both sides
+// from echoing each other forever
+func (c *DatagramConn) handleStale(seq uint32) {
+	if seq < c.recvSeq && c.lastWasWrite {
+		c.writeRaw(c.lastFlight)
+	}
+}
+
+// Read reads from the current handshake message
+func (c *DatagramConn) Read(b []byte) (n int, err error) {
+	if len(c.message) == 0 {
+		if c.message, err = c.readHandshake(); err != nil {
+			return
+		}
+	}
+	n = copy(b, c.message)
+	c.message = c.message[n:]
+	return
+}
+
+// ReadByte reads a single byte from the current handshake message, so gob decoders never read
+// past the end of a message
+func (c *DatagramConn) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	if _, err := c.Read(b); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Write sends a whole handshake message
+func (c *DatagramConn) Write(b []byte) (n int, err error) {
+	datagram := make([]byte, handshakeHeaderLength+len(b))
+	datagram[0] = datagramHandshake
+	binary.BigEndian.PutUint32(datagram[1:], c.sendSeq)
+	copy(datagram[handshakeHeaderLength:], b)
+
+	c.sendSeq++
+	c.lastFlight = datagram
+	c.lastWasWrite = true
+	if err = c.writeRaw(datagram); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// ReadDatagram returns the next record datagram
+func (c *DatagramConn) ReadDatagram() (frame []byte, err error) {
+	for {
+		var datagram []byte
+		if datagram, err = c.readRaw(); err != nil {
+			return
+		}
+		if len(datagram) == 0 {
+			continue
+		}
+		if datagram[0] == datagramRecord {
+			return datagram[1:], nil
+		}
+		if len(datagram) >= handshakeHeaderLength {
+			c.handleStale(binary.BigEndian.Uint32(datagram[1:handshakeHeaderLength]))
+		}
+	}
+}
+
+// WriteDatagram sends a record datagram
+func (c *DatagramConn) WriteDatagram(frame []byte) error {
+	return c.writeRaw(append([]byte{datagramRecord}, frame...))
+}
+
+// Close closes the socket
+func (c *DatagramConn) Close() error {
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local address
+func (c *DatagramConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer
+func (c *DatagramConn) RemoteAddr() net.Addr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *DatagramConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (c *DatagramConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *DatagramConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
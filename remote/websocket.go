@@ -0,0 +1,367 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// see https://tools.ietf.org/html/rfc6455
+const (
+	webSocketGUID    = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+	wsFin            = 0x80
+	wsMask           = 0x80
+	wsMaxControl     = 125
+	wsMaxFrameLength = MaxRecordLength + 64
+)
+
+var (
+	// ErrWebSocketHandshake is returned when the server does not upgrade the connection
+	ErrWebSocketHandshake = errors.New("Server did not accept the WebSocket upgrade")
+
+	// ErrWebSocketFrame is returned for frames which break the WebSocket protocol
+	ErrWebSocketFrame = errors.New("Invalid WebSocket frame")
+)
+
+// WebSocketConn carries a byte stream in binary WebSocket messages
+type WebSocketConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	client     bool
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+
+	// the data frame being read
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+}
+
+// ConnectWebSocket returns a connection to a server's WebSocket endpoint for a client
+func ConnectWebSocket(ipAddress, port, path string) (conn net.Conn, err error) {
+	var raw net.Conn
+	if raw, err = net.Dial("tcp", net.JoinHostPort(ipAddress, port)); err != nil {
+		return
+	}
+	return upgradeWebSocket(raw, net.JoinHostPort(ipAddress, port), path)
+}
+
+// upgradeWebSocket upgrades a client's connection to a WebSocket for the path on the host
+func upgradeWebSocket(raw net.Conn, host, path string) (conn net.Conn, err error) {
+	var resp *http.Response
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		raw.Close()
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req, _ := http.NewRequest("GET", "http://"+host+path, nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err = req.Write(raw); err != nil {
+		raw.Close()
+		return
+	}
+
+	reader := bufio.NewReader(raw)
+	if resp, err = http.ReadResponse(reader, req); err != nil {
+		raw.Close()
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		raw.Close()
+		return nil, ErrWebSocketHandshake
+	}
+
+	conn = NewBufferedConn(&WebSocketConn{Conn: raw, reader: reader, client: true})
+	return
+}
+
+// ServeAndAcceptWebSocket returns a connection to a single client for a server, which may connect
+// over raw TCP or upgrade an HTTP request for the path to a WebSocket; other HTTP requests, such
+// as health checks from load balancers, are answered without ending the wait
+func ServeAndAcceptWebSocket(port, path string) (conn net.Conn, err error) {
+	var l net.Listener
+	if l, err = net.Listen("tcp", fmt.Sprintf(":%s", port)); err != nil {
+		return
+	}
+	return acceptWebSocket(l, path)
+}
+
+// acceptWebSocket closes the listener once a raw or WebSocket connection was accepted on it
+func acceptWebSocket(l net.Listener, path string) (conn net.Conn, err error) {
+	tl := newTransportListener(l, path)
+	defer tl.Close()
+	return tl.Accept()
+}
+
+// transportListener accepts both raw TCP and WebSocket connections on the same port; they are
+// told apart concurrently, so a silent connection doesn't block the others
+type transportListener struct {
+	net.Listener
+	accepted  chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// timeout is the handshake timeout when the listener was created, which its connections
+	// are classified within
+	timeout time.Duration
+}
+
+func newTransportListener(l net.Listener, path string) *transportListener {
+	tl := &transportListener{
+		Listener: l,
+		accepted: make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+		timeout:  HandshakeTimeout,
+	}
+	go tl.acceptLoop(path)
+	return tl
+}
+
+func (tl *transportListener) acceptLoop(path string) {
+	for {
+		c, err := tl.Listener.Accept()
+		if err != nil {
+			tl.errs <- err
+			return
+		}
+		go func() {
+			if c = classify(c, path, tl.timeout); c == nil {
+				return
+			}
+			select {
+			case tl.accepted <- c:
+			case <-tl.done:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// Accept returns the next connection ready for the handshake
+func (tl *transportListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-tl.accepted:
+		return c, nil
+	case err := <-tl.errs:
+		tl.errs <- err
+		return nil, err
+	}
+}
+
+// Close stops accepting connections
+func (tl *transportListener) Close() (err error) {
+	tl.closeOnce.Do(func() { close(tl.done) })
+	return tl.Listener.Close()
+}
+
+// classify returns the connection ready for the handshake, or nil if it was only an HTTP request
+// or did not show which transport it uses within the timeout
+func classify(conn net.Conn, path string, timeout time.Duration) net.Conn {
+	conn.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	start, err := reader.Peek(4)
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+	if string(start) != "GET " {
+		conn.SetDeadline(time.Time{})
+		return &BufferedConn{Conn: conn, reader: reader}
+	}
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case req.URL.Path != path:
+		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	case !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "":
+		io.WriteString(conn, "HTTP/1.1 426 Upgrade Required\r\nUpgrade: websocket\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	default:
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "+webSocketAccept(key)+"\r\n\r\n")
+		conn.SetDeadline(time.Time{})
+		return NewBufferedConn(&WebSocketConn{Conn: conn, reader: reader})
+	}
+	conn.Close()
+	return nil
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Read reads data from binary messages, answering pings and treating a close frame as the end
+func (c *WebSocketConn) Read(b []byte) (n int, err error) {
+	for c.remaining == 0 {
+		if err = c.readFrameHeader(); err != nil {
+			return
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	if n, err = c.reader.Read(b); err != nil {
+		return
+	}
+	if c.masked {
+		for i := range b[:n] {
+			b[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	return
+}
+
+// readFrameHeader reads frame headers until the next data frame, handling control frames
+func (c *WebSocketConn) readFrameHeader() (err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(c.reader, header); err != nil {
+		return
+	}
+	opcode := header[0] & 0x0f
+	c.masked = header[1]&wsMask != 0
+	length := int64(header[1] & 0x7f)
+
+	// clients mask their frames and servers must not
+	if c.masked == c.client || header[0]&0x70 != 0 {
+		return ErrWebSocketFrame
+	}
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(c.reader, ext); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(ext))
+	}
+	if length < 0 || length > wsMaxFrameLength {
+		return ErrWebSocketFrame
+	}
+	if c.masked {
+		if _, err = io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsOpBinary, wsOpText, wsOpContinuation:
+		c.remaining = length
+		return
+	case wsOpClose, wsOpPing, wsOpPong:
+	default:
+		return ErrWebSocketFrame
+	}
+
+	if length > wsMaxControl || header[0]&wsFin == 0 {
+		return ErrWebSocketFrame
+	}
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	if c.masked {
+		for i := range payload {
+			payload[i] ^= c.mask[i%4]
+		}
+	}
+	switch opcode {
+	case wsOpPing:
+		err = c.writeFrame(wsOpPong, payload)
+	case wsOpClose:
+		c.closeOnce.Do(func() { c.writeFrame(wsOpClose, payload) })
+		err = io.EOF
+	}
+	return
+}
+
+// writeFrame writes a single frame, masked if we are the client
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) (err error) {
+	var frame bytes.Buffer
+	frame.WriteByte(wsFin | opcode)
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = wsMask
+	}
+	switch {
+	case len(payload) < 126:
+		frame.WriteByte(maskBit | byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame.WriteByte(maskBit | 126)
+		binary.Write(&frame, binary.BigEndian, uint16(len(payload)))
+	default:
+		frame.WriteByte(maskBit | 127)
+		binary.Write(&frame, binary.BigEndian, uint64(len(payload)))
+	}
+
+	if c.client {
+		mask := make([]byte, 4)
+		if _, err = rand.Read(mask); err != nil {
+			return
+		}
+		frame.Write(mask)
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+	frame.Write(payload)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err = c.Conn.Write(frame.Bytes())
+	return
+}
+
+// Write sends the data as a binary message
+func (c *WebSocketConn) Write(b []byte) (n int, err error) {
+	if err = c.writeFrame(wsOpBinary, b); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// Close sends a close frame and closes the connection
+func (c *WebSocketConn) Close() error {
+	c.closeOnce.Do(func() { c.writeFrame(wsOpClose, []byte{0x03, 0xe8}) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/pwang347/simple-vpn/admin"
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/ui"
+)
+
+// trackedSession is what the control socket knows of a session
+type trackedSession struct {
+	id       int
+	identity string
+}
+
+// adminBackend lets the control socket manage the server
+type adminBackend struct{}
+
+// serveAdmin serves the control socket, if configured
+func serveAdmin() {
+	var err error
+	if options.AdminSocket == "" {
+		return
+	}
+	if adminServer, err = admin.Listen(options.AdminSocket, adminBackend{}); err != nil {
+		ui.LogE(err)
+		return
+	}
+	ui.Log("Serving the control socket on " + options.AdminSocket)
+}
+
+// trackSession numbers a new session so the control socket can name it
+func trackSession(s *remote.Session) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	nextSessionID++
+	tracked[s] = &trackedSession{id: nextSessionID}
+}
+
+// untrackSession forgets a session which ended
+func untrackSession(s *remote.Session) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(tracked, s)
+}
+
+// identifySession records the identity a session's client introduced itself with
+func identifySession(s *remote.Session, identity string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if t, ok := tracked[s]; ok {
+		t.identity = identity
+	}
+}
+
+// findSession returns the session with the ID
+func findSession(id string) (*remote.Session, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for s, t := range tracked {
+		if strconv.Itoa(t.id) == id {
+			return s, nil
+		}
+	}
+	return nil, admin.ErrNoSession
+}
+
+// Sessions describes the sessions with clients
+func (adminBackend) Sessions() (sessions []admin.SessionInfo) {
+	mutex.Lock()
+	ids := make(map[*remote.Session]trackedSession, len(tracked))
+	for s, t := range tracked {
+		ids[s] = *t
+	}
+	mutex.Unlock()
+
+	for s, t := range ids {
+		sessions = append(sessions, admin.SessionInfo{
+			ID:          strconv.Itoa(t.id),
+			Identity:    t.identity,
+			PeerAddress: s.RemoteAddr().String(),
+			Epoch:       s.Epoch(),
+			RTT:         s.RTT(),
+			Stats:       s.Stats(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		a, _ := strconv.Atoi(sessions[i].ID)
+		b, _ := strconv.Atoi(sessions[j].ID)
+		return a < b
+	})
+	return
+}
+
+// Kick closes a session, which the client may reconnect after
+func (adminBackend) Kick(id string) (err error) {
+	var s *remote.Session
+	if s, err = findSession(id); err != nil {
+		return
+	}
+	ui.Log("Closing session " + id + " from the control socket")
+	return s.CloseWithAlert(remote.AlertUserDisconnect, "Disconnected by the administrator")
+}
+
+// Rekey agrees a new session key with a session's client
+func (adminBackend) Rekey(id string) (err error) {
+	var s *remote.Session
+	if s, err = findSession(id); err != nil {
+		return
+	}
+	ui.Log("Agreeing a new key for session " + id + " from the control socket")
+	return s.Rekey()
+}
+
+// Reload reads the config files again; clients get the new config when they next connect
+func (adminBackend) Reload() (err error) {
+	if options.Reload == nil {
+		return errors.New("Server has no config to reload")
+	}
+	updated := currentOptions()
+	if err = options.Reload(&updated); err != nil {
+		return
+	}
+	// only what is reloaded changes, so options which are never reloaded can be read unlocked
+	mutex.Lock()
+	options.Routes, options.Auth, options.TOTP = updated.Routes, updated.Auth, updated.TOTP
+	mutex.Unlock()
+	ui.Log("Reloaded the config from the control socket")
+	return
+}
+
+// Shutdown disconnects every client and quits
+func (adminBackend) Shutdown() (err error) {
+	ui.Log("Shutting down from the control socket")
+	handleUserDisconnect()
+	adminServer.Close()
+	application.Quit()
+	return
+}
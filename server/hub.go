@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pwang347/simple-vpn/hub"
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/tunnel"
+	"github.com/pwang347/simple-vpn/ui"
+)
+
+// toEveryone is the peer picker's entry sending to every client at the hub
+const toEveryone = "Everyone"
+
+// serveHub accepts any number of clients until the user disconnects, relaying messages
+// between them
+func serveHub(timeout time.Duration) {
+	l, err := remote.ListenTransport(options.Transport, portField.Text)
+	if err != nil {
+		ui.LogE(err)
+		handleDisconnect()
+		return
+	}
+
+	h := hub.New()
+	h.OnRoster = showRoster
+	mutex.Lock()
+	hubListener = l
+	relayHub = h
+	mutex.Unlock()
+	disconnectBtn.Enable()
+	showRoster(nil)
+	inputArea.SetReadOnly(false)
+	inputArea.SetPlaceHolder("")
+	inputBtn.Enable()
+
+	for {
+		var c net.Conn
+		if c, err = l.Accept(); err != nil {
+			return
+		}
+		ui.Log("Accepted connection from " + c.RemoteAddr().String())
+		go authenticateHubClient(h, c, timeout)
+	}
+}
+
+// authenticateHubClient authenticates a client at the hub and serves it; a client which takes
+// longer than the handshake timeout is dropped
+func authenticateHubClient(h *hub.Hub, c net.Conn, timeout time.Duration) {
+	c.SetDeadline(time.Now().Add(remote.HandshakeTimeout))
+	shake, err := authenticate(c)
+	if err != nil {
+		ui.LogE(err)
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	serveHubClient(h, newSession(c, shake, timeout), shake.username)
+}
+
+// serveHubClient handles the records of one client at the hub until its session ends
+func serveHubClient(h *hub.Hub, s *remote.Session, username string) {
+	var (
+		err      error
+		ty       remote.RecordType
+		payload  []byte
+		identity string
+	)
+	m := remote.NewMux(s, false)
+	go tunnel.Serve(m, tunnel.ServerPolicy(options.RemoteForwardPorts, options.GatewayPorts))
+	defer func() {
+		m.Close(err)
+		h.Leave(identity, s)
+		untrackSession(s)
+	}()
+
+	for {
+		if ty, payload, err = s.ReadRecord(); err != nil {
+			logClose(err)
+			return
+		}
+
+		switch {
+		case remote.IsStreamRecord(ty):
+			err = m.HandleRecord(ty, payload)
+		case ty == remote.RecordHello && identity != "":
+			err = errors.New(identity + " identified itself more than once")
+		case ty == remote.RecordHello:
+			var claimed string
+			if claimed, _, err = handleHello(s, payload, username); err != nil {
+				break
+			}
+			if claimed == "" {
+				// messages are relayed by identity, so the hub can't serve a client without one
+				err = errors.New("Client did not identify itself")
+				break
+			}
+			if err = h.Join(claimed, s); err == hub.ErrIdentityTaken {
+				ui.LogE(errors.New("Turned away a second client identifying itself as " + claimed))
+				s.CloseWithAlert(remote.AlertAuthFailure, claimed+" is already connected")
+				return
+			}
+			identity = claimed
+			identifySession(s, identity)
+		case ty == remote.RecordRelay:
+			var relay remote.Relay
+			if err = remote.ReadControl(payload, &relay); err != nil {
+				break
+			}
+			if err = h.Relay(identity, relay); err == hub.ErrUnknownPeer {
+				ui.LogE(errors.New(identity + " sent a message to " + relay.To + ", who is not online"))
+				err = nil
+			}
+		case ty == remote.RecordPacket:
+			// packets are not tunnelled in hub mode
+		case ty == remote.RecordData:
+			message := identity + ": " + string(payload)
+			ui.Log("Decrypted message: " + message)
+			outputArea.SetText(ui.StringWrap(message+"\n"+outputArea.Text, ui.WrapWordLength))
+			window.Resize(window.Canvas().Size())
+		default:
+			err = fmt.Errorf("Unexpected record type %d", ty)
+		}
+		if err != nil {
+			ui.LogE(err)
+			s.CloseWithAlert(remote.AlertProtocolViolation, err.Error())
+			return
+		}
+	}
+}
+
+// showRoster lists the clients online at the hub in the peer picker
+func showRoster(peers []string) {
+	entries := append([]string{toEveryone}, peers...)
+	peerSelect.Options = entries
+	if !contains(entries, peerSelect.Selected) {
+		peerSelect.SetSelected(toEveryone)
+	}
+	peerSelect.Refresh()
+	statusLabel.SetText(fmt.Sprintf("Hub, %d client(s) online", len(peers)))
+}
+
+// sendToPeer sends a message to the client picked in the peer picker, or to every client
+func sendToPeer(message []byte) (err error) {
+	mutex.Lock()
+	h := relayHub
+	mutex.Unlock()
+	if to := peerSelect.Selected; to != toEveryone {
+		s := h.Session(to)
+		if s == nil {
+			return errors.New(to + " is not online")
+		}
+		return s.Send(message)
+	}
+	h.Broadcast(message)
+	return
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -1,12 +1,10 @@
 package server
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -14,40 +12,138 @@ import (
 	"time"
 
 	"fyne.io/fyne"
+	"fyne.io/fyne/dialog"
 	"fyne.io/fyne/layout"
 	"fyne.io/fyne/widget"
+	"github.com/pwang347/simple-vpn/admin"
+	"github.com/pwang347/simple-vpn/auth"
 	"github.com/pwang347/simple-vpn/crypto"
+	"github.com/pwang347/simple-vpn/hub"
+	"github.com/pwang347/simple-vpn/packet"
 	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/tunnel"
 	"github.com/pwang347/simple-vpn/ui"
 )
 
+// Options configures the server beyond the fields of the form
+type Options struct {
+	// RemoteForwardPorts are the ports clients may ask the server to listen on
+	RemoteForwardPorts tunnel.PortRanges
+
+	// GatewayPorts lets clients listen on any of the server's addresses, instead of only loopback
+	GatewayPorts bool
+
+	// TUN configures a TUN interface tunnelling IP packets while connected, if not nil
+	TUN *packet.Config
+
+	// Netstack terminates tunnelled IP packets in a userspace network stack instead of a TUN
+	// interface, so packet tunnelling works without root
+	Netstack bool
+
+	// Pool leases each client its TUN addresses, if not nil
+	Pool *packet.Pool
+
+	// Push is the interface config pushed to clients, along with their leased addresses
+	Push remote.InterfaceConfig
+
+	// Routes decides which destinations each client routes through the tunnel, if not nil
+	Routes *packet.RoutePolicy
+
+	// Transport carries the session to clients
+	Transport remote.TransportConfig
+
+	// Padding hides the length and timing of the records sent
+	Padding remote.PaddingConfig
+
+	// SendFile is the path of a file sent to the client once connected
+	SendFile string
+
+	// Compress accepts clients' offers to compress bulk records
+	Compress bool
+
+	// Hub serves any number of clients at once and relays messages between them, instead of
+	// serving a single client
+	Hub bool
+
+	// Auth decides which users may connect, instead of every client only sharing the secret
+	// entered in the window, if not nil
+	Auth auth.Authenticator
+
+	// TOTP challenges users for a one-time code as a second factor, if not nil
+	TOTP *auth.TOTP
+
+	// AdminSocket is the path of a Unix socket serving the admin.Backend commands, if not empty
+	AdminSocket string
+
+	// Reload reads the config files again into the options, when asked on the admin socket
+	Reload func(o *Options) error
+}
+
 var (
+	options              Options
 	conn                 net.Conn
 	portField            *widget.Entry
 	secretField          *widget.Entry
+	timeoutField         *widget.Entry
+	statusLabel          *widget.Label
 	serveBtn             *widget.Button
 	disconnectBtn        *widget.Button
 	inputArea            *widget.Entry
 	inputAreaPlaceholder = "Connection must be established first"
 	inputBtn             *widget.Button
+	fileField            *widget.Entry
+	fileBtn              *widget.Button
+	fileProgress         *widget.ProgressBar
+	fileSent             bool
 	outputArea           *widget.Entry
 	continueBtn          *widget.Button
 	nonce                int
-	sessionKey           string
+	compression          remote.Compression
+	session              *remote.Session
+	streams              *remote.Mux
+	tunDevice            packet.Device
+	keepServing          bool
+	closedByUser         bool
 	window               fyne.Window
+	peerSelect           *widget.Select
+	hubListener          net.Listener
+	relayHub             *hub.Hub
+	tracked              = make(map[*remote.Session]*trackedSession)
+	nextSessionID        int
+	adminServer          *admin.Server
+	application          fyne.App
 	mutex                sync.Mutex
 )
 
 func handleServe() {
-	var err error
+	var (
+		err     error
+		timeout int
+	)
 
-	ui.Log("Initialized server on port " + portField.Text)
+	mutex.Lock()
+	closedByUser = false
+	mutex.Unlock()
+
+	ui.Log("Initialized server on " + string(options.Transport.Kind) + " port " + portField.Text)
 	serveBtn.Disable()
 	portField.SetReadOnly(true)
 	secretField.SetReadOnly(true)
+	timeoutField.SetReadOnly(true)
+
+	if timeout, err = strconv.Atoi(timeoutField.Text); err != nil || timeout <= 0 {
+		ui.LogE(errors.New("Peer timeout must be a positive number of seconds"))
+		handleDisconnect()
+		return
+	}
+
+	if options.Hub {
+		serveHub(time.Duration(timeout) * time.Second)
+		return
+	}
 
 	// TODO: form validation
-	if conn, err = remote.ServeAndAccept(portField.Text); err != nil {
+	if conn, err = remote.ServeAndAcceptTransport(options.Transport, portField.Text); err != nil {
 		ui.LogE(err)
 		handleDisconnect()
 		return
@@ -56,24 +152,72 @@ func handleServe() {
 	ui.Log("Accepted connection from " + conn.RemoteAddr().String())
 	disconnectBtn.Enable()
 
-	if err = authenticate(); err != nil {
+	var h handshake
+	if h, err = authenticate(conn); err != nil {
 		ui.LogE(err)
 		handleDisconnect()
 		return
 	}
 
+	compression = h.compression
+	session = newSession(conn, h, time.Duration(timeout)*time.Second)
+	session.OnRTT = func(rtt time.Duration) {
+		statusLabel.SetText("Connected, RTT " + rtt.Round(time.Millisecond).String() + compressionStatus(session))
+	}
+	statusLabel.SetText("Connected")
+	streams = remote.NewMux(session, false)
+	go tunnel.Serve(streams, tunnel.AcceptFiles(tunnel.ServerPolicy(options.RemoteForwardPorts, options.GatewayPorts), promptFile))
+	tunDevice = openTUN(session, streams)
+	mutex.Lock()
+	if options.SendFile != "" && !fileSent {
+		go sendFile(streams, options.SendFile)
+	}
+	mutex.Unlock()
+
 	inputArea.SetReadOnly(false)
 	inputArea.SetPlaceHolder("")
 	inputBtn.Enable()
+	fileBtn.Enable()
 
-	go recvLoop()
+	go recvLoop(h.username)
+}
+
+// newSession starts a session with the client which just authenticated
+func newSession(c net.Conn, h handshake, timeout time.Duration) (s *remote.Session) {
+	s = remote.NewSession(c, h.key, timeout)
+	s.Trace = traceRecord
+	s.SetPadding(options.Padding)
+	s.SetCompression(h.compression)
+	s.OnRekey = func(epoch uint64) {
+		ui.Log(fmt.Sprintf("Agreed session key %d with %s", epoch, c.RemoteAddr()))
+	}
+	trackSession(s)
+	return
+}
+
+func handleUserDisconnect() {
+	mutex.Lock()
+	closedByUser = true
+	mutex.Unlock()
+	if session != nil {
+		session.CloseWithAlert(remote.AlertUserDisconnect, "")
+	}
+	handleDisconnect()
 }
 
 func handleDisconnect() {
+	if session != nil {
+		session.Close()
+	}
 	if conn != nil {
 		conn.Close()
 	}
 	mutex.Lock()
+	if hubListener != nil {
+		hubListener.Close()
+		relayHub.Close()
+		hubListener, relayHub = nil, nil
+	}
 	if !disconnectBtn.Disabled() {
 		ui.Log("Disconnected")
 		disconnectBtn.Disable()
@@ -82,16 +226,47 @@ func handleDisconnect() {
 	serveBtn.Enable()
 	portField.SetReadOnly(false)
 	secretField.SetReadOnly(false)
+	timeoutField.SetReadOnly(false)
+	statusLabel.SetText("Not connected")
 
 	inputArea.SetReadOnly(true)
 	inputArea.SetPlaceHolder(inputAreaPlaceholder)
 	inputBtn.Disable()
+	fileBtn.Disable()
 	outputArea.SetText("")
 }
 
-func authenticate() (err error) {
+// step skips the stepper in hub mode, where clients authenticate concurrently and unattended
+func step(proc func()) {
+	if options.Hub {
+		proc()
+		return
+	}
+	ui.Step(proc)
+}
 
-	ui.Step(func() {
+// currentOptions returns the options as last reloaded from the control socket
+func currentOptions() Options {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return options
+}
+
+// handshake is what authenticating a client agreed
+type handshake struct {
+	key         string
+	compression remote.Compression
+
+	// username is the user the client authenticated as, if the server authenticates users
+	username string
+}
+
+// authenticate runs the server's side of the handshake on a connection
+func authenticate(c net.Conn) (h handshake, err error) {
+	// users are checked against the config as it was when the client connected
+	opts := currentOptions()
+
+	step(func() {
 		ui.Log("Starting authentication using secret " + secretField.Text)
 	})
 
@@ -104,23 +279,46 @@ func authenticate() (err error) {
 		decodedMsg interface{}
 	)
 
-	if ui.Step(func() {
+	if step(func() {
 		ui.Log("Waiting for Msg1 from client...")
-		if decodedMsg, err = remote.ReadMessageStruct(conn); err != nil {
+		if decodedMsg, err = remote.ReadMessageStruct(c); err != nil {
 			return
 		}
 
 		if msg1, ok = decodedMsg.(crypto.AuthenticationPayloadBeginAB); !ok {
 			err = errors.New("Could not parse Msg1")
+			remote.WriteAuthenticationAlert(c, remote.AlertProtocolViolation, err.Error(), secretField.Text)
 			return
 		}
 
 		nonceAB = msg1.ChallengeAB
 		ui.LogI("Received R_A (msg1):\n" + fmt.Sprintf("%x", nonceAB[:]))
+		h.compression = remote.NegotiateCompression(msg1.Compression, options.Compress)
+		ui.Log("Negotiated compression: " + string(h.compression))
 	}); err != nil {
 		return
 	}
 
+	// an authenticator keeping verifiers encrypts the handshake with the key of the user the
+	// client claims to be instead of the shared secret; others check the user's password after
+	var (
+		salt       []byte
+		iterations int
+		userErr    error
+	)
+	authKey := secretField.Text
+	keys, byKey := opts.Auth.(auth.KeyAuthenticator)
+	byPassword := opts.Auth != nil && !byKey
+	if opts.Auth != nil {
+		ui.Log("Client claims to be user " + msg1.Username)
+	}
+	if byKey {
+		if salt, iterations, authKey, userErr = keys.Lookup(msg1.Username); authKey == "" {
+			err = userErr
+			return
+		}
+	}
+
 	// Msg2: (R_B, Encrypt(SRVR, R_A, g^b%p, K_AB)) -->
 	var (
 		b            []byte
@@ -130,12 +328,12 @@ func authenticate() (err error) {
 		decryptedMsg crypto.DecodedChallengePartialKey
 	)
 
-	ui.Step(func() {
+	step(func() {
 		nonceBA = crypto.NewChallenge(crypto.DefaultNonceLength)
 		ui.Log("Generated R_B =\n" + fmt.Sprintf("%x", nonceBA))
 	})
 
-	if ui.Step(func() {
+	if step(func() {
 		b = crypto.GenerateRandomExponent()
 		ui.Log("Generated b =\n" + crypto.BytesToBigNumString(b))
 
@@ -145,18 +343,25 @@ func authenticate() (err error) {
 		return
 	}
 
-	if ui.Step(func() {
-		if encrypted, err = crypto.EncryptBytes(append([]byte("SRVR"), append(nonceAB[:], partialKeyB[:]...)...), secretField.Text); err != nil {
+	if step(func() {
+		if encrypted, err = crypto.EncryptBytes(append([]byte("SRVR"), append(nonceAB[:], partialKeyB[:]...)...), authKey); err != nil {
 			return
 		}
 		ui.Log("Generated Encrypt(SRVR, R_A, g^b%p, K_AB)) =\n" + fmt.Sprintf("%x", encrypted))
 
-		msg2 := crypto.AuthenticationPayloadResponseBA{EncSrvrChallengeABPartialkeyB: encrypted}
+		msg2 := crypto.AuthenticationPayloadResponseBA{
+			EncSrvrChallengeABPartialkeyB: encrypted,
+			Compression:                   string(h.compression),
+			Salt:                          salt,
+			Iterations:                    iterations,
+			Password:                      byPassword,
+			OTP:                           opts.TOTP != nil,
+		}
 		copy(msg2.ChallengeBA[:], nonceBA[:])
 
 		ui.LogO("Sent R_A (msg2):\n" + fmt.Sprintf("%x", nonceBA[:]))
 		ui.LogO("Sent Encrypt(SRVR, R_A, g^b%p, K_AB)) (msg2):\n" + fmt.Sprintf("%x", msg2.EncSrvrChallengeABPartialkeyB[:]))
-		if err = remote.WriteMessageStruct(conn, msg2); err != nil {
+		if err = remote.WriteMessageStruct(c, msg2); err != nil {
 			return
 		}
 	}); err != nil {
@@ -169,9 +374,15 @@ func authenticate() (err error) {
 		partialKeyA []byte
 	)
 
-	if ui.Step(func() {
+	if step(func() {
 		ui.Log("Waiting for Msg3 from client...")
-		if decodedMsg, err = remote.ReadMessageStruct(conn); err != nil {
+		if decodedMsg, err = remote.ReadMessageStruct(c); err != nil {
+			return
+		}
+		if alert, isAlert := decodedMsg.(crypto.AuthenticationAlert); isAlert {
+			if err = remote.DecodeAuthenticationAlert(alert, authKey); userErr != nil {
+				err = errors.New("Client failed authentication as " + msg1.Username + ": " + userErr.Error())
+			}
 			return
 		}
 		if msg3, ok = decodedMsg.(crypto.AuthenticationPayloadResponseAB); !ok {
@@ -183,8 +394,8 @@ func authenticate() (err error) {
 		return
 	}
 
-	if ui.Step(func() {
-		if decrypted, err = crypto.DecryptBytes(msg3.EncChallengeBAPartialKeyA[:], secretField.Text); err != nil {
+	if step(func() {
+		if decrypted, err = crypto.DecryptBytes(msg3.EncChallengeBAPartialKeyA[:], authKey); err != nil {
 			return
 		}
 
@@ -200,96 +411,297 @@ func authenticate() (err error) {
 		return
 	}
 
-	if ui.Step(func() {
-		if !bytes.Equal(decryptedMsg.Challenge[:], nonceBA) {
+	if step(func() {
+		if !bytes.Equal(decryptedMsg.Challenge[:], nonceBA) || userErr != nil {
 			err = errors.New("Client failed authentication challenge")
+			if userErr != nil {
+				err = errors.New("Client failed authentication as " + msg1.Username + ": " + userErr.Error())
+			}
+
+			// the client already considers itself authenticated, so it expects session records
+			key := crypto.BytesToBigNumString(crypto.ConstructKey(partialKeyA, b))
+			remote.NewSession(c, key, 0).CloseWithAlert(remote.AlertAuthFailure, err.Error())
 			return
 		}
 	}); err != nil {
 		return
 	}
 
-	ui.Step(func() {
+	if step(func() {
+		key := crypto.BytesToBigNumString(crypto.ConstructKey(partialKeyA, b))
+		transcript := remote.CompressionTranscript(msg1.Compression, h.compression)
+		if !crypto.VerifyMAC([]byte(transcript), msg3.CompressionMAC, key) {
+			err = errors.New("Compression negotiation was tampered with")
+			remote.NewSession(c, key, 0).CloseWithAlert(remote.AlertProtocolViolation, err.Error())
+			return
+		}
+	}); err != nil {
+		return
+	}
+
+	if byPassword {
+		if step(func() {
+			var password string
+			key := crypto.BytesToBigNumString(crypto.ConstructKey(partialKeyA, b))
+			if password, err = crypto.DecryptMessage(msg3.EncPassword, key); err == nil {
+				err = opts.Auth.Authenticate(msg1.Username, strings.TrimRight(password, "\x00"))
+			}
+			if err != nil {
+				err = errors.New("Client failed authentication as " + msg1.Username + ": " + err.Error())
+				remote.NewSession(c, key, 0).CloseWithAlert(remote.AlertAuthFailure, auth.ErrDenied.Error())
+				return
+			}
+			ui.Log("Authenticated user " + msg1.Username)
+		}); err != nil {
+			return
+		}
+	}
+
+	if opts.TOTP != nil {
+		if step(func() {
+			var code string
+			key := crypto.BytesToBigNumString(crypto.ConstructKey(partialKeyA, b))
+			if code, err = crypto.DecryptMessage(msg3.EncCode, key); err == nil {
+				err = opts.TOTP.Verify(msg1.Username, strings.TrimRight(code, "\x00"), time.Now())
+			}
+			if err != nil {
+				// the client is only told it was denied, like for a wrong password, so it can't
+				// learn who is enrolled or which codes were used
+				err = errors.New("Client failed the one-time code challenge as " + msg1.Username + ": " + err.Error())
+				remote.NewSession(c, key, 0).CloseWithAlert(remote.AlertAuthFailure, auth.ErrDenied.Error())
+				return
+			}
+			ui.Log("Verified the one-time code of user " + msg1.Username)
+		}); err != nil {
+			return
+		}
+	}
+
+	step(func() {
 		key := crypto.ConstructKey(partialKeyA, b)
-		sessionKey = crypto.BytesToBigNumString(key)
-		ui.LogS("Established Session key:\n" + sessionKey)
+		h.key = crypto.BytesToBigNumString(key)
+		if opts.Auth != nil || opts.TOTP != nil {
+			h.username = msg1.Username
+		}
+		ui.LogS("Established Session key:\n" + h.key)
 		// continueBtn.Disable()
 	})
 	return
 }
 
 func handleSend() {
-	var (
-		err         error
-		encrypted   []byte
-		messageSize uint64
-	)
-
 	if strings.TrimSpace(inputArea.Text) == "" {
 		return
 	}
 
-	if encrypted, err = crypto.EncryptBytes([]byte(inputArea.Text), sessionKey); err != nil {
-		ui.LogE(err)
-		handleDisconnect()
+	if options.Hub {
+		if err := sendToPeer([]byte(inputArea.Text)); err != nil {
+			ui.LogE(err)
+			return
+		}
+		inputArea.SetText("")
 		return
 	}
 
-	messageSize = uint64(len(encrypted))
-	messageSizeBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(messageSizeBytes, messageSize)
-	encrypted = append(messageSizeBytes, encrypted...)
-	ui.LogO("Sent E(len, message, K_session): " + fmt.Sprintf("%x", encrypted))
-
-	if _, err := conn.Write(encrypted); err != nil {
+	if err := session.Send([]byte(inputArea.Text)); err != nil {
 		ui.LogE(err)
 		handleDisconnect()
+		return
 	}
 
 	inputArea.SetText("")
 }
 
-func recvLoop() {
-	var (
-		err       error
-		decrypted []byte
-		message   string
-		reader    *bufio.Reader
-	)
-	for {
-		time.Sleep(1000 * time.Millisecond)
-		if conn == nil {
-			continue
-		}
-		if reader = bufio.NewReader(conn); reader == nil {
-			continue
+// openTUN opens the TUN interface or userspace network stack, if configured, and forwards its
+// packets over the session until the session ends
+func openTUN(s *remote.Session, m *remote.Mux) packet.Device {
+	var dev packet.Device
+	switch {
+	case options.Netstack:
+		dev = packet.NewStack()
+		ui.Log("Tunnelling packets through a userspace network stack")
+	case options.TUN != nil:
+		tun, err := packet.OpenTUN(*options.TUN)
+		if err != nil {
+			ui.LogE(err)
+			return nil
 		}
+		dev = tun
+		ui.Log("Tunnelling packets on " + dev.Name() + " with address " + strings.Join(options.TUN.Addresses, ", "))
+	default:
+		return nil
+	}
 
-		messageSizeBytes := make([]byte, 8)
-		if _, err := io.ReadFull(reader, messageSizeBytes); err != nil {
-			ui.LogE(err)
-			handleDisconnect()
+	go func() {
+		<-m.Done()
+		dev.Close()
+	}()
+	go packet.Forward(dev, s, nil)
+	return dev
+}
+
+// handleHello pushes the interface config to the client which introduced itself, leasing its
+// addresses from the pool; a client which authenticated as a user is identified as that user,
+// whatever identity it presents, and others need an identity only to lease addresses
+func handleHello(s *remote.Session, payload []byte, username string) (identity string, leased []net.IP, err error) {
+	var hello remote.Hello
+	if err = remote.ReadControl(payload, &hello); err != nil {
+		return
+	}
+	opts := currentOptions()
+	identity = hello.Identity
+	switch {
+	case username != "" && identity != username:
+		identity = username
+		ui.Log("Identifying the client as its user " + identity)
+	case identity != "":
+		ui.Log("Client identified itself as " + identity)
+	case opts.Pool != nil:
+		err = errors.New("Client did not identify itself, which it must to lease addresses")
+		return
+	}
+
+	config := opts.Push
+	if opts.Pool != nil {
+		if config.Addresses, err = opts.Pool.Assign(identity); err != nil {
 			return
 		}
+		ui.Log("Leased " + strings.Join(config.Addresses, ", ") + " to " + identity)
+		for _, address := range config.Addresses {
+			ip, _, _ := net.ParseCIDR(address)
+			leased = append(leased, ip)
+		}
+	}
+	if opts.Routes != nil {
+		routes := opts.Routes.For(identity)
+		config.Routes, config.Exclude = routes.Include, routes.Exclude
+		if !routes.Empty() {
+			ui.Log("Pushing routes to " + identity + ": " + routes.String())
+		}
+	}
+	err = s.WriteControl(remote.RecordConfig, config)
+	return
+}
 
-		messageSize := binary.LittleEndian.Uint64(messageSizeBytes[:])
-		ui.LogI("Received message of length: " + strconv.FormatUint(messageSize, 10))
+// logClose reports why the session ended, which is only an error if the peer did not close it cleanly
+func logClose(err error) {
+	if remote.IsCleanClose(err) {
+		ui.Log(err.Error())
+		return
+	}
+	ui.LogE(err)
+}
 
-		encrypted := make([]byte, messageSize)
-		if _, err := io.ReadFull(reader, encrypted); err != nil {
-			ui.LogE(err)
+// compressionStatus describes how well the session's bulk records compressed, if compression was negotiated
+func compressionStatus(s *remote.Session) string {
+	if compression != remote.CompressionDeflate {
+		return ""
+	}
+	return fmt.Sprintf(", compression %.1fx", s.Stats().CompressionRatio())
+}
+
+// handleSendFile sends the file at the path in the file field to the client
+func handleSendFile() {
+	path := strings.TrimSpace(fileField.Text)
+	if path == "" || streams == nil {
+		return
+	}
+	go sendFile(streams, path)
+}
+
+// sendFile offers a file to the client and sends it once accepted, showing its progress
+func sendFile(m *remote.Mux, path string) {
+	ui.Log("Offering " + path + " to the client")
+	fileProgress.SetValue(0)
+	err := tunnel.SendFile(m, path, func(sent, total int64) {
+		fileProgress.SetValue(float64(sent) / float64(total))
+	})
+	if err != nil {
+		ui.LogE(err)
+		return
+	}
+	fileProgress.SetValue(1)
+	mutex.Lock()
+	fileSent = true
+	mutex.Unlock()
+	ui.Log("Sent " + path + ", the client verified its SHA-256")
+}
+
+// promptFile asks the user whether to accept a file offered by the client
+func promptFile(offer tunnel.FileOffer) bool {
+	answer := make(chan bool, 1)
+	dialog.ShowConfirm("Accept file?", fmt.Sprintf("The client offers %s (%d bytes), saved to %s", offer.Name, offer.Size, tunnel.DownloadDir), func(ok bool) {
+		answer <- ok
+	}, window)
+	return <-answer
+}
+
+func traceRecord(outbound bool, frame []byte) {
+	if outbound {
+		ui.LogO("Sent E(len, message, K_session): " + fmt.Sprintf("%x", frame))
+		return
+	}
+	ui.LogI("Received encrypted text: " + fmt.Sprintf("%x", frame))
+}
+
+func recvLoop(username string) {
+	var (
+		err     error
+		ty      remote.RecordType
+		payload []byte
+		message string
+		leased  []net.IP
+		greeted bool
+	)
+	defer streams.Close(nil)
+	defer untrackSession(session)
+
+	for {
+		if ty, payload, err = session.ReadRecord(); err != nil {
+			streams.Close(err)
+			logClose(err)
 			handleDisconnect()
+
+			// wait for the client to come back after it lost the connection
+			mutex.Lock()
+			reserve := keepServing && !closedByUser
+			mutex.Unlock()
+			if reserve {
+				handleServe()
+			}
 			return
 		}
 
-		ui.LogI("Received encrypted text: " + fmt.Sprintf("%x", encrypted))
-		if decrypted, err = crypto.DecryptBytes(encrypted, sessionKey); err != nil {
+		switch {
+		case remote.IsStreamRecord(ty):
+			err = streams.HandleRecord(ty, payload)
+		case ty == remote.RecordPacket:
+			// a client given addresses from the pool may only send from them
+			if tunDevice != nil && (options.Pool == nil || packet.SentFrom(payload, leased)) {
+				packet.Inject(tunDevice, payload)
+			}
+		case ty == remote.RecordHello && greeted:
+			err = errors.New("Client identified itself more than once")
+		case ty == remote.RecordHello:
+			var identity string
+			if identity, leased, err = handleHello(session, payload, username); err == nil {
+				greeted = true
+				identifySession(session, identity)
+			}
+		case ty != remote.RecordData:
+			err = fmt.Errorf("Unexpected record type %d", ty)
+		}
+		if err != nil {
 			ui.LogE(err)
+			session.CloseWithAlert(remote.AlertProtocolViolation, err.Error())
 			handleDisconnect()
 			return
 		}
+		if ty != remote.RecordData {
+			continue
+		}
 
-		message = string(decrypted)
+		message = string(payload)
 		ui.Log("Decrypted message: " + message)
 		outputArea.SetText(ui.StringWrap(message+"\n"+outputArea.Text, ui.WrapWordLength))
 		window.Resize(window.Canvas().Size())
@@ -297,20 +709,32 @@ func recvLoop() {
 }
 
 // Start initializes the client application
-func Start(w fyne.Window, app fyne.App) {
+func Start(w fyne.Window, app fyne.App, opts Options) {
 
 	w.Resize(fyne.NewSize(960, 440))
 	window = w
+	application = app
+	options = opts
 
 	portField = ui.NewEntry(remote.DefaultPort, "", false, 42)
 
 	secretField = ui.NewEntry("", "Shared Secret Value", false, 42)
+	timeoutField = ui.NewEntry(strconv.Itoa(int(remote.DefaultDeadPeerTimeout/time.Second)), "", false, 42)
+	statusLabel = widget.NewLabel("Not connected")
 
 	serveBtn = widget.NewButton("Serve", handleServe)
-	disconnectBtn = ui.NewButton("Disconnect", handleDisconnect, true)
+	disconnectBtn = ui.NewButton("Disconnect", handleUserDisconnect, true)
 
 	inputArea = ui.NewEntry("", inputAreaPlaceholder, true, 51)
 	inputBtn = ui.NewButton("Send", handleSend, true)
+	peerSelect = widget.NewSelect([]string{toEveryone}, func(string) {})
+	peerSelect.SetSelected(toEveryone)
+	if !options.Hub {
+		peerSelect.Hide()
+	}
+	fileField = ui.NewEntry("", "Path of the file to send", false, 0)
+	fileBtn = ui.NewButton("Send File", handleSendFile, true)
+	fileProgress = widget.NewProgressBar()
 
 	outputArea = ui.NewMultiLineEntry("", "", true)
 	continueBtn = ui.NewStepperButton("Step")
@@ -318,6 +742,7 @@ func Start(w fyne.Window, app fyne.App) {
 	form := widget.NewForm()
 	form.Append("Port", portField)
 	form.Append("Secret", secretField)
+	form.Append("Peer Timeout (s)", timeoutField)
 
 	headings := fyne.NewContainerWithLayout(layout.NewGridLayout(1),
 		widget.NewHBox(
@@ -329,10 +754,23 @@ func Start(w fyne.Window, app fyne.App) {
 
 	leftTopCell := widget.NewVBox(
 		form,
-		widget.NewHBox(layout.NewSpacer(), serveBtn, disconnectBtn),
+		widget.NewHBox(
+			statusLabel,
+			layout.NewSpacer(),
+			ui.NewCheck("Keep Serving", func(b bool) {
+				mutex.Lock()
+				keepServing = b
+				mutex.Unlock()
+			}, false),
+			serveBtn,
+			disconnectBtn),
 		ui.NewBoldedLabel("Data to be Sent"),
 		inputArea,
-		widget.NewHBox(layout.NewSpacer(), inputBtn),
+		widget.NewHBox(layout.NewSpacer(), peerSelect, inputBtn),
+		ui.NewBoldedLabel("File to be Sent"),
+		fileField,
+		fileProgress,
+		widget.NewHBox(layout.NewSpacer(), fileBtn),
 		ui.NewBoldedLabel("Data as Received"))
 	leftMidCell := widget.NewScrollContainer(widget.NewVBox(outputArea))
 	leftCell := fyne.NewContainerWithLayout(layout.NewBorderLayout(leftTopCell, nil, nil, nil), leftTopCell, leftMidCell)
@@ -340,4 +778,5 @@ func Start(w fyne.Window, app fyne.App) {
 	uiLayout := fyne.NewContainerWithLayout(layout.NewGridLayout(2), leftCell, rightCell)
 	w.SetContent(uiLayout)
 	ui.Log("Initialized server")
+	serveAdmin()
 }
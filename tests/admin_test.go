@@ -0,0 +1,227 @@
+package tests
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/admin"
+)
+
+// fakeBackend records the commands it was sent
+type fakeBackend struct {
+	mutex    sync.Mutex
+	sessions []admin.SessionInfo
+	kicked   []string
+	rekeyed  []string
+	reloads  int
+	shutdown chan struct{}
+}
+
+func (b *fakeBackend) Sessions() []admin.SessionInfo {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.sessions
+}
+
+func (b *fakeBackend) find(id string) error {
+	for _, info := range b.sessions {
+		if info.ID == id {
+			return nil
+		}
+	}
+	return admin.ErrNoSession
+}
+
+func (b *fakeBackend) Kick(id string) (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err = b.find(id); err == nil {
+		b.kicked = append(b.kicked, id)
+	}
+	return
+}
+
+func (b *fakeBackend) Rekey(id string) (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err = b.find(id); err == nil {
+		b.rekeyed = append(b.rekeyed, id)
+	}
+	return
+}
+
+func (b *fakeBackend) Reload() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reloads++
+	if b.reloads > 1 {
+		return errors.New("Route policy is malformed")
+	}
+	return nil
+}
+
+func (b *fakeBackend) Shutdown() error {
+	close(b.shutdown)
+	return nil
+}
+
+// serveAdmin serves a fake backend on a control socket in a temporary directory
+func serveAdmin(t *testing.T) (b *fakeBackend, c *admin.Client, cleanup func()) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	path := filepath.Join(dir, "ctl.sock")
+	b = &fakeBackend{
+		sessions: []admin.SessionInfo{
+			{ID: "1", Identity: "alice", PeerAddress: "127.0.0.1:50000", Epoch: 2, RTT: 15 * time.Millisecond},
+			{ID: "2", PeerAddress: "127.0.0.1:50001"},
+		},
+		shutdown: make(chan struct{}),
+	}
+	b.sessions[0].Stats.BytesSent = 1234
+
+	s, err := admin.Listen(path, b)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf(err.Error())
+	}
+	return b, admin.Dial(path), func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestAdminSessions tests that sessions are listed and shown over the control socket
+func TestAdminSessions(t *testing.T) {
+	b, c, cleanup := serveAdmin(t)
+	defer cleanup()
+
+	sessions, err := c.Sessions()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(sessions) != 2 || sessions[0] != b.sessions[0] || sessions[1] != b.sessions[1] {
+		t.Errorf("Expected sessions %v, was %v\n", b.sessions, sessions)
+	}
+
+	info, err := c.Session("1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if info != b.sessions[0] {
+		t.Errorf("Expected session %v, was %v\n", b.sessions[0], info)
+	}
+	if _, err = c.Session("3"); err != admin.ErrNoSession {
+		t.Errorf("Expected %v, was %v\n", admin.ErrNoSession, err)
+	}
+}
+
+// TestAdminCommands tests that commands reach the backend, and its errors reach the client
+func TestAdminCommands(t *testing.T) {
+	b, c, cleanup := serveAdmin(t)
+	defer cleanup()
+
+	if err := c.Kick("2"); err != nil {
+		t.Errorf("Expected the kick to succeed, was %v\n", err)
+	}
+	if err := c.Kick("3"); err != admin.ErrNoSession {
+		t.Errorf("Expected kicking an unknown session to fail with %v, was %v\n", admin.ErrNoSession, err)
+	}
+	if err := c.Rekey("1"); err != nil {
+		t.Errorf("Expected the rekey to succeed, was %v\n", err)
+	}
+	if err := c.Reload(); err != nil {
+		t.Errorf("Expected the first reload to succeed, was %v\n", err)
+	}
+	if err := c.Reload(); err == nil || err.Error() != "Route policy is malformed" {
+		t.Errorf("Expected the second reload to fail with the backend's error, was %v\n", err)
+	}
+	if len(b.kicked) != 1 || b.kicked[0] != "2" || len(b.rekeyed) != 1 || b.rekeyed[0] != "1" {
+		t.Errorf("Expected session 2 kicked and 1 rekeyed, were %v and %v\n", b.kicked, b.rekeyed)
+	}
+
+	if err := c.Shutdown(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	select {
+	case <-b.shutdown:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the backend to shut down\n")
+	}
+}
+
+// TestAdminSocketInUse tests that a live control socket is not taken over, but one left behind is
+func TestAdminSocketInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ctl.sock")
+
+	s, err := admin.Listen(path, &fakeBackend{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = admin.Listen(path, &fakeBackend{}); err != admin.ErrSocketInUse {
+		t.Errorf("Expected %v, was %v\n", admin.ErrSocketInUse, err)
+	}
+	s.Close()
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed on close\n")
+	}
+
+	// a socket left behind by a server which died is replaced
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if s, err = admin.Listen(path, &fakeBackend{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	s.Close()
+
+	// but anything else at the path is left alone
+	if err = ioutil.WriteFile(path, []byte("keep"), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = admin.Listen(path, &fakeBackend{}); err == nil {
+		t.Errorf("Expected a file at the path to stop the socket being served\n")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "keep" {
+		t.Errorf("Expected the file at the path to be left alone\n")
+	}
+}
+
+// TestAdminSocketPrivate tests that only the current user may use the control socket
+func TestAdminSocketPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ctl.sock")
+
+	s, err := admin.Listen(path, &fakeBackend{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("Expected only the owner to have permissions on the socket, was %v\n", perm)
+	}
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/auth"
+)
+
+// authFile writes a file with the contents to a temporary directory
+func authFile(t *testing.T, name, contents string, mode os.FileMode) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	path = filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(contents), mode); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// TestHtpasswd tests that users are authenticated against MD5 and SHA-1 htpasswd entries
+func TestHtpasswd(t *testing.T) {
+	path, cleanup := authFile(t, "htpasswd", `# made with htpasswd -m and -s
+alice:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1
+bob:$apr1$Z7Pmhbm4$RjxA7srcMJOYk.p6PNMC31
+
+carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`, 0600)
+	defer cleanup()
+	a, err := auth.Parse("htpasswd:" + path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tests := []struct {
+		username string
+		password string
+		expected error
+	}{
+		{"alice", "password", nil},
+		{"alice", "passwore", auth.ErrDenied},
+		{"bob", "se cret", nil},
+		{"carol", "password", nil},
+		{"carol", "", auth.ErrDenied},
+		{"dave", "password", auth.ErrUnknownUser},
+	}
+	for _, test := range tests {
+		if err = a.Authenticate(test.username, test.password); err != test.expected {
+			t.Errorf("Expected %v for %s, was %v\n", test.expected, test.username, err)
+		}
+	}
+
+	bcrypt, cleanupBcrypt := authFile(t, "htpasswd", "alice:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC\n", 0600)
+	defer cleanupBcrypt()
+	if _, err = auth.LoadHtpasswd(bcrypt); err == nil {
+		t.Errorf("Expected bcrypt entries to be refused\n")
+	}
+}
+
+// TestExecAuthenticator tests that an external program decides who is allowed
+func TestExecAuthenticator(t *testing.T) {
+	path, cleanup := authFile(t, "check.sh", `#!/bin/sh
+read user
+read password
+if [ "$user" = alice ] && [ "$password" = "s3cr3t" ]; then echo allow; else echo deny; fi
+`, 0700)
+	defer cleanup()
+	a, err := auth.Parse("exec:" + path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = a.Authenticate("alice", "s3cr3t"); err != nil {
+		t.Errorf("Expected alice to be allowed, was %v\n", err)
+	}
+	if err = a.Authenticate("alice", "wrong"); err != auth.ErrDenied {
+		t.Errorf("Expected %v, was %v\n", auth.ErrDenied, err)
+	}
+	if err = a.Authenticate("alice\nallow", "s3cr3t"); err != auth.ErrDenied {
+		t.Errorf("Expected a username spanning lines to be denied, was %v\n", err)
+	}
+
+	slow, cleanupSlow := authFile(t, "slow.sh", "#!/bin/sh\nsleep 5\necho allow\n", 0700)
+	defer cleanupSlow()
+	e, err := auth.NewExec([]string{slow})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	e.Timeout = 100 * time.Millisecond
+	if err = e.Authenticate("alice", "s3cr3t"); err == nil {
+		t.Errorf("Expected a program which doesn't decide in time to deny\n")
+	}
+}
+
+// TestParseAuthenticator tests that authenticator specs name a known backend
+func TestParseAuthenticator(t *testing.T) {
+	for _, spec := range []string{"", "htpasswd", "ldap:server", "exec:"} {
+		if _, err := auth.Parse(spec); err == nil {
+			t.Errorf("Expected %q to be refused\n", spec)
+		}
+	}
+
+	path, cleanup := usersFile(t)
+	defer cleanup()
+	a, err := auth.Parse("users:" + path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	users := a.(*auth.Users)
+	users.Add("alice", "s3cr3t")
+	if err = users.Authenticate("alice", "s3cr3t"); err != nil {
+		t.Errorf("Expected alice to be allowed, was %v\n", err)
+	}
+	if err = users.Authenticate("alice", "wrong"); err != auth.ErrDenied {
+		t.Errorf("Expected %v, was %v\n", auth.ErrDenied, err)
+	}
+	if _, ok := a.(auth.KeyAuthenticator); !ok {
+		t.Errorf("Expected the user database to keep verifiers\n")
+	}
+}
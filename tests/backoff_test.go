@@ -0,0 +1,22 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// TestReconnectDelay tests that reconnect delays grow exponentially and stay within bounds
+func TestReconnectDelay(t *testing.T) {
+	for attempt := 1; attempt <= 40; attempt++ {
+		expected := remote.MaxReconnectDelay
+		if attempt <= 5 {
+			expected = remote.DefaultReconnectDelay << uint(attempt-1)
+		}
+
+		delay := remote.ReconnectDelay(attempt)
+		if delay < expected/2 || delay > expected {
+			t.Errorf("Expected attempt %d to wait between %s and %s, was %s\n", attempt, expected/2, expected, delay)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// TestCompressionNegotiation tests that compression is only used when both sides want it
+func TestCompressionNegotiation(t *testing.T) {
+	offered := remote.OfferedCompression(true)
+	if c := remote.NegotiateCompression(offered, true); c != remote.CompressionDeflate {
+		t.Errorf("Expected deflate, was %s\n", c)
+	}
+	if c := remote.NegotiateCompression(offered, false); c != remote.CompressionNone {
+		t.Errorf("Expected no compression when the server disables it, was %s\n", c)
+	}
+	if c := remote.NegotiateCompression(remote.OfferedCompression(false), true); c != remote.CompressionNone {
+		t.Errorf("Expected no compression when the client disables it, was %s\n", c)
+	}
+	if c := remote.NegotiateCompression([]string{"lz4"}, true); c != remote.CompressionNone {
+		t.Errorf("Expected no compression for unknown offers, was %s\n", c)
+	}
+
+	if c, err := remote.AcceptCompression(offered, "deflate"); err != nil || c != remote.CompressionDeflate {
+		t.Errorf("Expected deflate to be accepted, was %s (%v)\n", c, err)
+	}
+	if _, err := remote.AcceptCompression(nil, "deflate"); err == nil {
+		t.Errorf("Expected compression the client didn't offer to be rejected\n")
+	}
+
+	// stripping the offer or the pick changes what the client confirms
+	confirmed := remote.CompressionTranscript(offered, remote.CompressionDeflate)
+	for _, tampered := range []string{
+		remote.CompressionTranscript(nil, remote.CompressionNone),
+		remote.CompressionTranscript(offered, remote.CompressionNone),
+	} {
+		if tampered == confirmed {
+			t.Errorf("Expected tampering to change the transcript %q\n", confirmed)
+		}
+	}
+}
+
+// TestCompressedSession tests that compressed bulk records arrive intact and are counted
+func TestCompressedSession(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+	a.SetCompression(remote.CompressionDeflate)
+	b.SetCompression(remote.CompressionDeflate)
+
+	bulk := bytes.Repeat([]byte("compressible "), 1000)
+	go func() {
+		a.WriteRecord(remote.RecordStreamData, bulk)
+		a.Send(bulk)
+	}()
+	for _, expected := range []remote.RecordType{remote.RecordStreamData, remote.RecordData} {
+		ty, payload, err := b.ReadRecord()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if ty != expected || !bytes.Equal(payload, bulk) {
+			t.Errorf("Expected record type %d with %d bytes, got type %d with %d bytes\n", expected, len(bulk), ty, len(payload))
+		}
+	}
+
+	sent, received := a.Stats(), b.Stats()
+	if sent.PayloadBytes != uint64(len(bulk)) || received.PayloadBytes != uint64(len(bulk)) {
+		t.Errorf("Expected only the stream record to be compressed, counted %d and %d bytes\n", sent.PayloadBytes, received.PayloadBytes)
+	}
+	if ratio := received.CompressionRatio(); ratio < 10 {
+		t.Errorf("Expected a high compression ratio, was %.1f\n", ratio)
+	}
+	if sent.RecordsSent != 2 || received.RecordsReceived != 2 || sent.BytesSent != received.BytesReceived {
+		t.Errorf("Expected the records sent and received to match, were %+v and %+v\n", sent, received)
+	}
+}
+
+// TestDecompressionBomb tests that payloads inflating past the max record length are rejected,
+// as are compressed records when compression wasn't negotiated
+func TestDecompressionBomb(t *testing.T) {
+	for _, negotiated := range []bool{true, false} {
+		connA, connB := tcpPair(t)
+		a := remote.NewSession(connA, "s3cr3t", time.Hour)
+		b := remote.NewSession(connB, "s3cr3t", time.Hour)
+		a.SetCompression(remote.CompressionDeflate)
+		expected := remote.ErrMalformedRecord
+		payload := bytes.Repeat([]byte{0}, 1000)
+		if negotiated {
+			b.SetCompression(remote.CompressionDeflate)
+			expected = remote.ErrDecompressionBomb
+			payload = make([]byte, 2*remote.MaxRecordLength)
+		}
+
+		go a.WriteRecord(remote.RecordPacket, payload)
+		if _, _, err := b.ReadRecord(); err != expected {
+			t.Errorf("Expected %v, was %v\n", expected, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pwang347/simple-vpn/tunnel"
+)
+
+// dnsQuery builds a query for the A record of the name
+func dnsQuery(id uint16, name string) []byte {
+	msg := []byte{0, 0, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg, id)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(append(msg, byte(len(label))), label...)
+	}
+	return append(msg, 0, 0, 1, 0, 1)
+}
+
+// dnsAnswer answers a query with an A record for the address
+func dnsAnswer(query []byte, ip net.IP) []byte {
+	msg := append([]byte{}, query...)
+	msg[2], msg[3] = 0x81, 0x80
+	msg[7] = 1
+	msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+	return append(msg, ip.To4()...)
+}
+
+// answeredIP returns the address in the first answer of a response built by dnsAnswer
+func answeredIP(t *testing.T, response []byte) net.IP {
+	if len(response) < 4 {
+		t.Fatalf("Short DNS response %x\n", response)
+	}
+	return net.IP(response[len(response)-4:])
+}
+
+// fakeResolver answers every query with the address, over UDP and TCP, counting the queries
+func fakeResolver(t *testing.T, ip net.IP) (address string, queries *int32, closer func()) {
+	queries = new(int32)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			pc.WriteTo(dnsAnswer(buf[:n], ip), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			header := make([]byte, 2)
+			if _, err = conn.Read(header); err == nil {
+				query := make([]byte, binary.BigEndian.Uint16(header))
+				conn.Read(query)
+				atomic.AddInt32(queries, 1)
+				answer := dnsAnswer(query, ip)
+				binary.BigEndian.PutUint16(header, uint16(len(answer)))
+				conn.Write(append(header, answer...))
+			}
+			conn.Close()
+		}
+	}()
+	return pc.LocalAddr().String(), queries, func() { pc.Close(); l.Close() }
+}
+
+// TestDNSTunnel tests that queries to the stub are answered by the server's resolver, then from the cache
+func TestDNSTunnel(t *testing.T) {
+	muxA, muxB := muxPair(t)
+	go tunnel.Serve(muxB, tunnel.ServerPolicy(nil, false))
+	resolver, queries, closer := fakeResolver(t, net.IPv4(10, 1, 2, 3))
+	defer closer()
+
+	stub, err := tunnel.ListenDNS("127.0.0.1:0", nil, func() string { return resolver }, muxA)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	conn, err := net.Dial("udp", stub.Addr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+
+	for _, id := range []uint16{1, 2} {
+		conn.Write(dnsQuery(id, "example.com"))
+		response := make([]byte, 512)
+		n, err := conn.Read(response)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if binary.BigEndian.Uint16(response) != id {
+			t.Errorf("Expected response to query %d, got %d\n", id, binary.BigEndian.Uint16(response))
+		}
+		if ip := answeredIP(t, response[:n]); !ip.Equal(net.IPv4(10, 1, 2, 3)) {
+			t.Errorf("Expected 10.1.2.3, got %v\n", ip)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Errorf("Expected the second query to be answered from the cache, resolver saw %d\n", n)
+	}
+
+	tcp, err := net.Dial("tcp", stub.Addr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer tcp.Close()
+	query := dnsQuery(3, "other.example.com")
+	tcp.Write(append([]byte{0, byte(len(query))}, query...))
+	response := make([]byte, 512)
+	n, err := tcp.Read(response)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ip := answeredIP(t, response[2:n]); !ip.Equal(net.IPv4(10, 1, 2, 3)) {
+		t.Errorf("Expected 10.1.2.3 over TCP, got %v\n", ip)
+	}
+}
+
+// TestDNSRules tests that the most specific rule chooses the resolver of each name
+func TestDNSRules(t *testing.T) {
+	muxA, muxB := muxPair(t)
+	go tunnel.Serve(muxB, tunnel.ServerPolicy(nil, false))
+	remoteResolver, _, closeRemote := fakeResolver(t, net.IPv4(10, 1, 2, 3))
+	defer closeRemote()
+	localResolver, _, closeLocal := fakeResolver(t, net.IPv4(192, 168, 0, 1))
+	defer closeLocal()
+
+	var rules []tunnel.DNSRule
+	for _, spec := range []string{"lan=" + localResolver, "corp.lan=tunnel"} {
+		rule, err := tunnel.ParseDNSRule(spec)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	stub := tunnel.NewDNSStub(rules, func() string { return remoteResolver }, muxA)
+
+	for name, expected := range map[string]net.IP{
+		"printer.lan":    net.IPv4(192, 168, 0, 1),
+		"wiki.corp.lan":  net.IPv4(10, 1, 2, 3),
+		"example.com":    net.IPv4(10, 1, 2, 3),
+		"PRINTER.LAN.":   net.IPv4(192, 168, 0, 1),
+		"notlan.example": net.IPv4(10, 1, 2, 3),
+	} {
+		response, err := stub.Resolve(dnsQuery(7, strings.TrimSuffix(name, ".")))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if ip := answeredIP(t, response); !ip.Equal(expected) {
+			t.Errorf("Expected %s to resolve to %v, got %v\n", name, expected, ip)
+		}
+	}
+
+	if _, err := tunnel.ParseDNSRule("lan=nowhere"); err == nil {
+		t.Errorf("Expected an upstream without a port to be rejected\n")
+	}
+}
+
+// TestDNSNoResolver tests that queries fail cleanly until the server configures a resolver
+func TestDNSNoResolver(t *testing.T) {
+	muxA, _ := muxPair(t)
+	stub, err := tunnel.ListenDNS("127.0.0.1:0", nil, func() string { return "" }, muxA)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	conn, err := net.Dial("udp", stub.Addr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+
+	conn.Write(dnsQuery(9, "example.com"))
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if n < 12 || response[3]&0x0f != 2 || binary.BigEndian.Uint16(response) != 9 {
+		t.Errorf("Expected SERVFAIL, got %x\n", response[:n])
+	}
+}
@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/tunnel"
+)
+
+// fileDirs writes a file of random data to a source directory and points the download dir at
+// an empty one
+func fileDirs(t *testing.T, size int) (path string, data []byte, cleanup func()) {
+	src, err := ioutil.TempDir("", "src")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	dst, err := ioutil.TempDir("", "dst")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	data = make([]byte, size)
+	rand.Read(data)
+	path = filepath.Join(src, "data.bin")
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	tunnel.DownloadDir = dst
+	return path, data, func() {
+		tunnel.DownloadDir = "."
+		os.RemoveAll(src)
+		os.RemoveAll(dst)
+	}
+}
+
+// fileMuxPair returns multiplexers over both ends of a session, with the second accepting files
+// if accept is set, and the first session so the transfer can be interrupted
+func fileMuxPair(t *testing.T, accept bool) (*remote.Mux, *remote.Session) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	muxA := remote.NewMux(a, true)
+	muxB := remote.NewMux(b, false)
+	go dispatch(a, muxA)
+	go dispatch(b, muxB)
+	go tunnel.Serve(muxB, tunnel.AcceptFiles(tunnel.ServerPolicy(nil, false), func(offer tunnel.FileOffer) bool {
+		return accept
+	}))
+	return muxA, a
+}
+
+// TestFileTransfer tests that an accepted file arrives intact without replacing earlier files
+func TestFileTransfer(t *testing.T) {
+	path, data, cleanup := fileDirs(t, 300*1024)
+	defer cleanup()
+	m, s := fileMuxPair(t, true)
+	defer s.Close()
+
+	for _, name := range []string{"data.bin", "data (1).bin"} {
+		var last int64
+		if err := tunnel.SendFile(m, path, func(sent, total int64) { last = sent }); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if last != int64(len(data)) {
+			t.Errorf("Expected progress up to %d bytes, was %d\n", len(data), last)
+		}
+		received, err := ioutil.ReadFile(filepath.Join(tunnel.DownloadDir, name))
+		if err != nil || !bytes.Equal(received, data) {
+			t.Errorf("Expected %s to hold the file (%v)\n", name, err)
+		}
+	}
+}
+
+// TestFileRejected tests that a rejected file is not saved
+func TestFileRejected(t *testing.T) {
+	path, _, cleanup := fileDirs(t, 1024)
+	defer cleanup()
+	m, s := fileMuxPair(t, false)
+	defer s.Close()
+
+	err := tunnel.SendFile(m, path, nil)
+	if err == nil || !strings.Contains(err.Error(), tunnel.ErrFileRejected.Error()) {
+		t.Errorf("Expected the file to be rejected, was %v\n", err)
+	}
+	if files, _ := ioutil.ReadDir(tunnel.DownloadDir); len(files) != 0 {
+		t.Errorf("Expected nothing to be saved, found %d files\n", len(files))
+	}
+
+	for _, bad := range []string{"", "../data.bin", "dir/data.bin", ".hidden"} {
+		if err := (tunnel.FileOffer{Name: bad, SHA256: strings.Repeat("00", 32)}).Validate(); err == nil {
+			t.Errorf("Expected the name %q to be rejected\n", bad)
+		}
+	}
+}
+
+// interruptedTransfer sends half of the file before the session ends
+func interruptedTransfer(t *testing.T, path string, size int) {
+	m, s := fileMuxPair(t, true)
+	err := tunnel.SendFile(m, path, func(sent, total int64) {
+		if sent >= int64(size/2) {
+			s.Close()
+		}
+	})
+	if err == nil {
+		t.Fatalf("Expected the transfer to be interrupted\n")
+	}
+	time.Sleep(100 * time.Millisecond)
+}
+
+// TestFileResume tests that sending a file again resumes an interrupted transfer
+func TestFileResume(t *testing.T) {
+	const size = 1024 * 1024
+	path, data, cleanup := fileDirs(t, size)
+	defer cleanup()
+	interruptedTransfer(t, path, size)
+
+	m, s := fileMuxPair(t, true)
+	defer s.Close()
+	var first int64
+	if err := tunnel.SendFile(m, path, func(sent, total int64) {
+		if first == 0 {
+			first = sent
+		}
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if first <= 32*1024 {
+		t.Errorf("Expected the transfer to resume, it restarted\n")
+	}
+	received, err := ioutil.ReadFile(filepath.Join(tunnel.DownloadDir, "data.bin"))
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("Expected the resumed file to be intact (%v)\n", err)
+	}
+}
+
+// TestFileChecksum tests that a corrupted transfer fails verification and starts over when sent again
+func TestFileChecksum(t *testing.T) {
+	const size = 256 * 1024
+	path, data, cleanup := fileDirs(t, size)
+	defer cleanup()
+	interruptedTransfer(t, path, size)
+
+	partials, _ := filepath.Glob(filepath.Join(tunnel.DownloadDir, ".data.bin.*.part"))
+	if len(partials) != 1 {
+		t.Fatalf("Expected a partial file to be kept, found %v\n", partials)
+	}
+	f, _ := os.OpenFile(partials[0], os.O_WRONLY, 0600)
+	f.WriteAt([]byte("corrupted"), 0)
+	f.Close()
+
+	m, s := fileMuxPair(t, true)
+	defer s.Close()
+	if err := tunnel.SendFile(m, path, nil); err == nil || !strings.Contains(err.Error(), tunnel.ErrFileChecksum.Error()) {
+		t.Errorf("Expected the checksum to fail, was %v\n", err)
+	}
+	if err := tunnel.SendFile(m, path, nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	received, err := ioutil.ReadFile(filepath.Join(tunnel.DownloadDir, "data.bin"))
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("Expected the file to be intact once sent again (%v)\n", err)
+	}
+}
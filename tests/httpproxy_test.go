@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/tunnel"
+)
+
+// httpProxy starts an HTTP proxy through a tunnel and returns its address
+func httpProxy(t *testing.T) string {
+	muxA, muxB := muxPair(t)
+	go tunnel.Serve(muxB, tunnel.ServerPolicy(nil, false))
+
+	l, err := tunnel.ListenHTTPProxy("127.0.0.1:0", muxA)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return l.Addr().String()
+}
+
+// TestHTTPProxyConnect tests tunnelling a connection with CONNECT
+func TestHTTPProxyConnect(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	conn, err := net.Dial("tcp", httpProxy(t))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target.Addr(), target.Addr())
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, was %d\n", resp.StatusCode)
+	}
+
+	conn.Write([]byte("ping"))
+	echoed := make([]byte, 4)
+	if _, err = reader.Read(echoed); err != nil || string(echoed) != "ping" {
+		t.Errorf("Expected ping to be echoed, was %s (%v)\n", echoed, err)
+	}
+}
+
+// TestHTTPProxyRequest tests forwarding a request for an absolute URI
+func TestHTTPProxyRequest(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	defer target.Close()
+
+	proxyURL, _ := url.Parse("http://" + httpProxy(t))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(target.URL + "/path")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello from /path" {
+		t.Errorf("Unexpected body %s\n", body)
+	}
+}
+
+// TestHTTPProxySilentClient tests that a proxy client which never finishes its request headers
+// is disconnected
+func TestHTTPProxySilentClient(t *testing.T) {
+	conn, err := net.Dial("tcp", httpProxy(t))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET http://example.com/ HTTP/1.1\r\n")
+	conn.SetReadDeadline(time.Now().Add(tunnel.DialTimeout + 5*time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the proxy to close the connection, was %v\n", err)
+	}
+}
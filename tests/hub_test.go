@@ -0,0 +1,334 @@
+package tests
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/hub"
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// hubClient returns the hub's end and the client's end of a session with its own key
+func hubClient(t *testing.T, key string) (server, client *remote.Session) {
+	connA, connB := tcpPair(t)
+	return remote.NewSession(connA, key, time.Hour), remote.NewSession(connB, key, time.Hour)
+}
+
+// readControl reads the next record, which must have the type, into v
+func readControl(t *testing.T, s *remote.Session, want remote.RecordType, v interface{}) {
+	ty, payload, err := s.ReadRecord()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ty != want {
+		t.Fatalf("Expected record type %d, was %d\n", want, ty)
+	}
+	if err = remote.ReadControl(payload, v); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+// TestHubRoster tests that every client is told who is online when a client joins or leaves
+func TestHubRoster(t *testing.T) {
+	var roster remote.Roster
+	h := hub.New()
+	defer h.Close()
+	rosters := make(chan []string, 4)
+	h.OnRoster = func(peers []string) { rosters <- peers }
+
+	aliceServer, alice := hubClient(t, "alice-key")
+	bobServer, bob := hubClient(t, "bob-key")
+	defer alice.Close()
+	defer bob.Close()
+
+	h.Join("alice", aliceServer)
+	readControl(t, alice, remote.RecordRoster, &roster)
+	if !reflect.DeepEqual(roster.Peers, []string{"alice"}) {
+		t.Errorf("Expected roster [alice], was %v\n", roster.Peers)
+	}
+
+	h.Join("bob", bobServer)
+	readControl(t, alice, remote.RecordRoster, &roster)
+	if !reflect.DeepEqual(roster.Peers, []string{"alice", "bob"}) {
+		t.Errorf("Expected roster [alice bob], was %v\n", roster.Peers)
+	}
+	readControl(t, bob, remote.RecordRoster, &roster)
+
+	h.Leave("bob", bobServer)
+	readControl(t, alice, remote.RecordRoster, &roster)
+	if !reflect.DeepEqual(roster.Peers, []string{"alice"}) {
+		t.Errorf("Expected roster [alice], was %v\n", roster.Peers)
+	}
+	<-rosters
+	<-rosters
+	if peers := <-rosters; !reflect.DeepEqual(peers, []string{"alice"}) {
+		t.Errorf("Expected the server to be told of [alice], was %v\n", peers)
+	}
+}
+
+// TestHubRelay tests that messages reach the addressed client, or every client but the sender
+func TestHubRelay(t *testing.T) {
+	var (
+		roster remote.Roster
+		relay  remote.Relay
+	)
+	h := hub.New()
+	defer h.Close()
+
+	aliceServer, alice := hubClient(t, "alice-key")
+	bobServer, bob := hubClient(t, "bob-key")
+	carolServer, carol := hubClient(t, "carol-key")
+	defer alice.Close()
+	defer bob.Close()
+	defer carol.Close()
+
+	h.Join("alice", aliceServer)
+	h.Join("bob", bobServer)
+	h.Join("carol", carolServer)
+	for i := 0; i < 3; i++ {
+		readControl(t, alice, remote.RecordRoster, &roster)
+	}
+	for i := 0; i < 2; i++ {
+		readControl(t, bob, remote.RecordRoster, &roster)
+	}
+	readControl(t, carol, remote.RecordRoster, &roster)
+
+	if err := h.Relay("alice", remote.Relay{To: "bob", Data: []byte("hi bob")}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	readControl(t, bob, remote.RecordRelay, &relay)
+	if relay.From != "alice" || !bytes.Equal(relay.Data, []byte("hi bob")) {
+		t.Errorf("Expected hi bob from alice, was %s from %s\n", relay.Data, relay.From)
+	}
+
+	// a client can't pose as another by filling in the sender
+	if err := h.Relay("bob", remote.Relay{From: "carol", Data: []byte("hi all")}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	readControl(t, alice, remote.RecordRelay, &relay)
+	if relay.From != "bob" {
+		t.Errorf("Expected the message from bob, was from %s\n", relay.From)
+	}
+	readControl(t, carol, remote.RecordRelay, &relay)
+	if relay.From != "bob" || !bytes.Equal(relay.Data, []byte("hi all")) {
+		t.Errorf("Expected hi all from bob, was %s from %s\n", relay.Data, relay.From)
+	}
+
+	// the sender must not receive its own broadcast, so the next record bob sees is from alice
+	if err := h.Relay("alice", remote.Relay{To: "bob", Data: []byte("again")}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	readControl(t, bob, remote.RecordRelay, &relay)
+	if relay.From != "alice" {
+		t.Errorf("Expected the sender's own broadcast not to be echoed, received one from %s\n", relay.From)
+	}
+
+	if err := h.Relay("alice", remote.Relay{To: "dave"}); err != hub.ErrUnknownPeer {
+		t.Errorf("Expected %v, was %v\n", hub.ErrUnknownPeer, err)
+	}
+	if err := h.Relay("", remote.Relay{To: "bob"}); err != hub.ErrNotJoined {
+		t.Errorf("Expected %v, was %v\n", hub.ErrNotJoined, err)
+	}
+}
+
+// TestHubRejoin tests that a client can't join under the identity of a client online, but can
+// once that client left
+func TestHubRejoin(t *testing.T) {
+	h := hub.New()
+	defer h.Close()
+
+	oldServer, old := hubClient(t, "old-key")
+	newServer, current := hubClient(t, "new-key")
+	defer old.Close()
+	defer current.Close()
+
+	if err := h.Join("alice", oldServer); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := h.Join("alice", newServer); err != hub.ErrIdentityTaken {
+		t.Errorf("Expected %v, was %v\n", hub.ErrIdentityTaken, err)
+	}
+	if s := h.Session("alice"); s != oldServer {
+		t.Errorf("Expected the session online to stay joined\n")
+	}
+
+	h.Leave("alice", newServer)
+	if s := h.Session("alice"); s != oldServer {
+		t.Errorf("Expected a session which never joined not to remove the one online\n")
+	}
+	h.Leave("alice", oldServer)
+	if err := h.Join("alice", newServer); err != nil {
+		t.Errorf("Expected the identity to be free once its client left, was %v\n", err)
+	}
+}
+
+// TestHubJoinAfterClose tests that a client which finishes authenticating after the hub closed
+// is closed too, instead of joining
+func TestHubJoinAfterClose(t *testing.T) {
+	h := hub.New()
+	h.Close()
+
+	server, client := hubClient(t, "s3cr3t")
+	defer client.Close()
+	h.Join("alice", server)
+
+	if peers := h.Peers(); len(peers) != 0 {
+		t.Errorf("Expected nobody to join a closed hub, were %v\n", peers)
+	}
+	if _, _, err := client.ReadRecord(); !remote.IsCleanClose(err) {
+		t.Errorf("Expected the client to be disconnected, was %v\n", err)
+	}
+}
+
+// TestListenTransport tests that a transport listener accepts more than one client
+func TestListenTransport(t *testing.T) {
+	port := freeTCPPort(t)
+	l, err := remote.ListenTransport(remote.TransportConfig{Kind: remote.TransportTCP}, port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer c.Close()
+		// the listener tells raw TCP from WebSocket by the first bytes sent
+		c.Write([]byte("hello"))
+
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		buf := make([]byte, 5)
+		if _, err = accepted.Read(buf); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if string(buf) != "hello" {
+			t.Errorf("Expected hello, was %s\n", buf)
+		}
+		accepted.Close()
+	}
+
+	if _, err = remote.ListenTransport(remote.TransportConfig{Kind: remote.TransportUDP}, port); err == nil {
+		t.Errorf("Expected listening for many clients over udp to fail\n")
+	}
+}
+
+// relayNet stands in for a hub relaying messages between endpoints, holding them until flushed
+type relayNet struct {
+	endpoints map[string]*hub.Endpoint
+	queue     []remote.Relay
+	received  map[string][]string
+}
+
+func newRelayNet(identities ...string) (n *relayNet) {
+	n = &relayNet{endpoints: make(map[string]*hub.Endpoint), received: make(map[string][]string)}
+	for _, identity := range identities {
+		from := identity
+		n.endpoints[identity] = hub.NewEndpoint(identity, func(msg remote.Relay) error {
+			msg.From = from
+			n.queue = append(n.queue, msg)
+			return nil
+		})
+	}
+	return
+}
+
+// flush delivers the queued messages, and those sent in reply, until none are left
+func (n *relayNet) flush(t *testing.T) {
+	for len(n.queue) > 0 {
+		msg := n.queue[0]
+		n.queue = n.queue[1:]
+		data, err := n.endpoints[msg.To].Receive(msg)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if data != nil {
+			n.received[msg.To] = append(n.received[msg.To], string(data))
+		}
+	}
+}
+
+// TestEndpointKeyExchange tests that clients agree a key through the hub, and that messages
+// sent before it was agreed are delivered once it is
+func TestEndpointKeyExchange(t *testing.T) {
+	n := newRelayNet("alice", "bob", "carol")
+	alice, bob, carol := n.endpoints["alice"], n.endpoints["bob"], n.endpoints["carol"]
+	roster := []string{"alice", "bob", "carol"}
+
+	alice.Introduce(roster)
+	if err := alice.Send("bob", []byte("early")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	bob.Introduce(roster)
+	carol.Introduce(roster)
+	n.flush(t)
+
+	if fingerprint := alice.Fingerprint("bob"); fingerprint == "" || fingerprint != bob.Fingerprint("alice") {
+		t.Errorf("Expected matching fingerprints, were %s and %s\n", fingerprint, bob.Fingerprint("alice"))
+	}
+	if alice.Fingerprint("bob") == alice.Fingerprint("carol") {
+		t.Errorf("Expected a different key with each client\n")
+	}
+
+	if err := alice.Send("", []byte("hi all")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, msg := range n.queue {
+		if bytes.Contains(msg.Data, []byte("hi all")) || !msg.Sealed {
+			t.Errorf("Expected the hub to only see sealed messages\n")
+		}
+	}
+	n.flush(t)
+
+	if !reflect.DeepEqual(n.received["bob"], []string{"early", "hi all"}) {
+		t.Errorf("Expected bob to receive [early hi all], was %v\n", n.received["bob"])
+	}
+	if !reflect.DeepEqual(n.received["carol"], []string{"hi all"}) {
+		t.Errorf("Expected carol to receive [hi all], was %v\n", n.received["carol"])
+	}
+	if len(n.received["alice"]) != 0 {
+		t.Errorf("Expected the sender not to receive its own broadcast\n")
+	}
+}
+
+// TestEndpointForgery tests that messages the hub forged, replayed or reflected are rejected
+func TestEndpointForgery(t *testing.T) {
+	n := newRelayNet("alice", "bob")
+	alice, bob := n.endpoints["alice"], n.endpoints["bob"]
+	alice.Introduce([]string{"alice", "bob"})
+	bob.Introduce([]string{"alice", "bob"})
+	n.flush(t)
+
+	if _, err := bob.Receive(remote.Relay{From: "alice", To: "bob", Data: []byte("forged")}); err != hub.ErrNotSealed {
+		t.Errorf("Expected %v, was %v\n", hub.ErrNotSealed, err)
+	}
+
+	alice.Send("bob", []byte("once"))
+	msg := n.queue[0]
+	n.flush(t)
+	if _, err := bob.Receive(msg); err != hub.ErrBadSeal {
+		t.Errorf("Expected a replayed message to fail with %v, was %v\n", hub.ErrBadSeal, err)
+	}
+
+	reflected := msg
+	reflected.From, reflected.To = "bob", "alice"
+	if _, err := alice.Receive(reflected); err != hub.ErrBadSeal {
+		t.Errorf("Expected a reflected message to fail with %v, was %v\n", hub.ErrBadSeal, err)
+	}
+
+	alice.Send("bob", []byte("twice"))
+	tampered := n.queue[0]
+	n.queue = nil
+	tampered.Data = append([]byte{}, tampered.Data...)
+	tampered.Data[0] ^= 1
+	if _, err := bob.Receive(tampered); err != hub.ErrBadSeal {
+		t.Errorf("Expected a tampered message to fail with %v, was %v\n", hub.ErrBadSeal, err)
+	}
+}
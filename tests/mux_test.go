@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// muxPair returns multiplexers over both ends of a session
+func muxPair(t *testing.T) (*remote.Mux, *remote.Mux) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	muxA := remote.NewMux(a, true)
+	muxB := remote.NewMux(b, false)
+	go dispatch(a, muxA)
+	go dispatch(b, muxB)
+	return muxA, muxB
+}
+
+// dispatch feeds the stream records of a session to its multiplexer
+func dispatch(s *remote.Session, m *remote.Mux) {
+	for {
+		ty, payload, err := s.ReadRecord()
+		if err != nil {
+			m.Close(err)
+			return
+		}
+		if remote.IsStreamRecord(ty) {
+			if err = m.HandleRecord(ty, payload); err != nil {
+				s.CloseWithAlert(remote.AlertProtocolViolation, err.Error())
+			}
+		}
+	}
+}
+
+// TestMuxStream tests that a stream carries more data than its window in both directions
+func TestMuxStream(t *testing.T) {
+	muxA, muxB := muxPair(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), remote.DefaultStreamWindow/4)
+
+	go func() {
+		st, err := muxA.Open([]byte("header"))
+		if err != nil {
+			t.Errorf(err.Error())
+			return
+		}
+		st.Write(data)
+		st.CloseWrite()
+		io.Copy(ioutil.Discard, st)
+		st.Close()
+	}()
+
+	st, err := muxB.Accept()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(st.Header()) != "header" {
+		t.Errorf("Expected header to be %s, was %s\n", "header", st.Header())
+	}
+
+	received, err := ioutil.ReadAll(st)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("Expected %d bytes, received %d\n", len(data), len(received))
+	}
+
+	// the stream is half-closed, so this side can still reply
+	if _, err = st.Write([]byte("reply")); err != nil {
+		t.Errorf(err.Error())
+	}
+	st.Close()
+}
+
+// TestMuxReset tests that closing an unfinished stream resets it on the peer
+func TestMuxReset(t *testing.T) {
+	muxA, muxB := muxPair(t)
+
+	st, err := muxA.Open(nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	peer, err := muxB.Accept()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	st.Close()
+	if _, err = peer.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected read from a reset stream to fail")
+	}
+}
+
+// TestMuxDeadline tests that reads time out
+func TestMuxDeadline(t *testing.T) {
+	muxA, _ := muxPair(t)
+
+	st, err := muxA.Open(nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	if netErr, ok := err.(interface{ Timeout() bool }); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, was %v\n", err)
+	}
+}
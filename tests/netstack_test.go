@@ -0,0 +1,365 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/packet"
+)
+
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+	flagACK = 0x10
+)
+
+var (
+	clientIP   = net.IPv4(10, 8, 0, 2).To4()
+	loopbackIP = net.IPv4(127, 0, 0, 1).To4()
+)
+
+// inetChecksum returns the internet checksum of the data
+func inetChecksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// synthPacket wraps a TCP or UDP segment from the client in an IPv4 header, filling in checksums
+func synthPacket(proto byte, dst net.IP, segment []byte) []byte {
+	pseudo := append(append(append([]byte{}, clientIP...), dst...), 0, proto, 0, 0)
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+	offset := 16
+	if proto == 17 {
+		offset = 6
+	}
+	binary.BigEndian.PutUint16(segment[offset:], inetChecksum(append(pseudo, segment...), 0))
+
+	header := make([]byte, 20)
+	header[0] = 0x45
+	binary.BigEndian.PutUint16(header[2:], uint16(20+len(segment)))
+	header[8] = 64
+	header[9] = proto
+	copy(header[12:], clientIP)
+	copy(header[16:], dst)
+	binary.BigEndian.PutUint16(header[10:], inetChecksum(header, 0))
+	return append(header, segment...)
+}
+
+// tcpPacket builds a TCP packet from the client to the loopback address
+func tcpPacket(srcPort, dstPort int, seq, ack uint32, flags byte, data string) []byte {
+	segment := make([]byte, 20+len(data))
+	binary.BigEndian.PutUint16(segment[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(segment[2:], uint16(dstPort))
+	binary.BigEndian.PutUint32(segment[4:], seq)
+	binary.BigEndian.PutUint32(segment[8:], ack)
+	segment[12] = 5 << 4
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], 65535)
+	copy(segment[20:], data)
+	return synthPacket(6, loopbackIP, segment)
+}
+
+// udpPacket builds a UDP packet from the client to the loopback address
+func udpPacket(srcPort, dstPort int, data string) []byte {
+	segment := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(segment[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(segment[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(segment[4:], uint16(len(segment)))
+	copy(segment[8:], data)
+	return synthPacket(17, loopbackIP, segment)
+}
+
+// tcpReply is a TCP segment sent back to the client
+type tcpReply struct {
+	srcPort int
+	dstPort int
+	seq     uint32
+	ack     uint32
+	flags   byte
+	data    []byte
+}
+
+// readPacket reads the next packet for the client from the stack, checking its checksums
+func readPacket(t *testing.T, packets chan []byte) (proto byte, segment []byte) {
+	select {
+	case pkt := <-packets:
+		if len(pkt) < 20 || pkt[0] != 0x45 || inetChecksum(pkt[:20], 0) != 0 {
+			t.Fatalf("Bad IP header %v", pkt)
+		}
+		if !bytes.Equal(pkt[12:16], loopbackIP) || !bytes.Equal(pkt[16:20], clientIP) {
+			t.Fatalf("Wrong addresses %v -> %v", net.IP(pkt[12:16]), net.IP(pkt[16:20]))
+		}
+		proto, segment = pkt[9], pkt[20:]
+		pseudo := append(append([]byte{}, pkt[12:20]...), 0, proto, 0, 0)
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+		if inetChecksum(append(pseudo, segment...), 0) != 0 {
+			t.Fatalf("Bad checksum")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a packet")
+	}
+	return
+}
+
+func readTCP(t *testing.T, packets chan []byte) tcpReply {
+	proto, segment := readPacket(t, packets)
+	if proto != 6 {
+		t.Fatalf("Expected TCP, got protocol %d", proto)
+	}
+	return tcpReply{
+		srcPort: int(binary.BigEndian.Uint16(segment[0:])),
+		dstPort: int(binary.BigEndian.Uint16(segment[2:])),
+		seq:     binary.BigEndian.Uint32(segment[4:]),
+		ack:     binary.BigEndian.Uint32(segment[8:]),
+		flags:   segment[13],
+		data:    segment[int(segment[12]>>4)*4:],
+	}
+}
+
+// newNetstack starts a stack whose outbound packets are delivered on a channel
+func newNetstack(t *testing.T) (*packet.Stack, chan []byte) {
+	stack := packet.NewStack()
+	packets := make(chan []byte, 64)
+	go func() {
+		buf := make([]byte, stack.MTU())
+		for {
+			n, err := stack.Read(buf)
+			if err != nil {
+				return
+			}
+			packets <- append([]byte{}, buf[:n]...)
+		}
+	}()
+	return stack, packets
+}
+
+func listenerPort(l net.Listener) int {
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestNetstackTCP tests that a TCP flow is terminated by the userspace stack and relayed to a
+// real connection, through the handshake, data in both directions and the closing handshake
+func TestNetstackTCP(t *testing.T) {
+	l := echoServer(t)
+	defer l.Close()
+	stack, packets := newNetstack(t)
+	defer stack.Close()
+	port := listenerPort(l)
+
+	stack.Write(tcpPacket(40000, port, 1000, 0, flagSYN, ""))
+	synAck := readTCP(t, packets)
+	if synAck.flags != flagSYN|flagACK || synAck.ack != 1001 || synAck.srcPort != port || synAck.dstPort != 40000 {
+		t.Fatalf("Expected SYN-ACK, got %+v", synAck)
+	}
+	seq, ack := uint32(1001), synAck.seq+1
+	stack.Write(tcpPacket(40000, port, seq, ack, flagACK, ""))
+
+	message := "through the userspace stack"
+	stack.Write(tcpPacket(40000, port, seq, ack, flagACK, message))
+	seq += uint32(len(message))
+
+	var echoed []byte
+	for len(echoed) < len(message) {
+		reply := readTCP(t, packets)
+		if reply.flags&flagRST != 0 {
+			t.Fatalf("Flow was reset")
+		}
+		if len(reply.data) > 0 {
+			if reply.seq != ack {
+				t.Fatalf("Expected sequence %d, got %d", ack, reply.seq)
+			}
+			echoed = append(echoed, reply.data...)
+			ack += uint32(len(reply.data))
+			stack.Write(tcpPacket(40000, port, seq, ack, flagACK, ""))
+		}
+	}
+	if string(echoed) != message {
+		t.Errorf("Expected %q, got %q", message, echoed)
+	}
+
+	// the echo server closes its side once it sees our FIN
+	stack.Write(tcpPacket(40000, port, seq, ack, flagFIN|flagACK, ""))
+	seq++
+	for {
+		reply := readTCP(t, packets)
+		if reply.flags&flagFIN != 0 {
+			if reply.ack != seq {
+				t.Errorf("Expected FIN to acknowledge %d, got %d", seq, reply.ack)
+			}
+			stack.Write(tcpPacket(40000, port, seq, reply.seq+1, flagACK, ""))
+			break
+		}
+	}
+
+	// the flow is gone, so anything more is reset
+	stack.Write(tcpPacket(40000, port, seq, ack+1, flagACK, "late"))
+	if reply := readTCP(t, packets); reply.flags&flagRST == 0 {
+		t.Errorf("Expected RST after the flow closed, got %+v", reply)
+	}
+}
+
+// TestNetstackTCPZeroMSS tests that a peer announcing a segment size of zero still gets data,
+// instead of the stack sending empty segments forever
+func TestNetstackTCPZeroMSS(t *testing.T) {
+	l := echoServer(t)
+	defer l.Close()
+	stack, packets := newNetstack(t)
+	defer stack.Close()
+	port := listenerPort(l)
+
+	// a SYN with the MSS option set to 0
+	syn := tcpPacket(40002, port, 1000, 0, flagSYN, "")
+	segment := append(append([]byte{}, syn[20:40]...), 2, 4, 0, 0)
+	segment[12] = 6 << 4
+	segment[16], segment[17] = 0, 0
+	stack.Write(synthPacket(6, loopbackIP, segment))
+
+	synAck := readTCP(t, packets)
+	if synAck.flags != flagSYN|flagACK {
+		t.Fatalf("Expected SYN-ACK, got %+v", synAck)
+	}
+	seq, ack := uint32(1001), synAck.seq+1
+	stack.Write(tcpPacket(40002, port, seq, ack, flagACK, ""))
+	message := "despite a zero MSS"
+	stack.Write(tcpPacket(40002, port, seq, ack, flagACK, message))
+
+	// only a few bare acknowledgements may come before the echo
+	for empty := 0; ; empty++ {
+		reply := readTCP(t, packets)
+		if reply.flags&flagRST != 0 {
+			t.Fatalf("Flow was reset")
+		}
+		if len(reply.data) > 0 {
+			if string(reply.data) != message {
+				t.Errorf("Expected %q, got %q", message, reply.data)
+			}
+			return
+		}
+		if empty == 4 {
+			t.Fatalf("Expected data, got empty segments")
+		}
+	}
+}
+
+// TestNetstackTCPRefused tests that a SYN to a closed port is answered with a reset
+func TestNetstackTCPRefused(t *testing.T) {
+	l := echoServer(t)
+	port := listenerPort(l)
+	l.Close()
+	stack, packets := newNetstack(t)
+	defer stack.Close()
+
+	stack.Write(tcpPacket(40001, port, 5000, 0, flagSYN, ""))
+	reply := readTCP(t, packets)
+	if reply.flags&flagRST == 0 || reply.ack != 5001 {
+		t.Errorf("Expected RST acknowledging the SYN, got %+v", reply)
+	}
+}
+
+// TestNetstackMaxFlows tests that flows beyond the limit are turned away, so a peer can't
+// exhaust the server's sockets
+func TestNetstackMaxFlows(t *testing.T) {
+	l := echoServer(t)
+	defer l.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	stack, packets := newNetstack(t)
+	defer stack.Close()
+	stack.MaxFlows = 1
+	port := listenerPort(l)
+
+	stack.Write(tcpPacket(40005, port, 1000, 0, flagSYN, ""))
+	if reply := readTCP(t, packets); reply.flags != flagSYN|flagACK {
+		t.Fatalf("Expected SYN-ACK for the first flow, got %+v", reply)
+	}
+	stack.Write(tcpPacket(40006, port, 2000, 0, flagSYN, ""))
+	if reply := readTCP(t, packets); reply.flags&flagRST == 0 || reply.dstPort != 40006 {
+		t.Errorf("Expected RST for a flow beyond the limit, got %+v", reply)
+	}
+
+	udpPort := conn.LocalAddr().(*net.UDPAddr).Port
+	stack.Write(udpPacket(53001, udpPort, "first"))
+	if proto, segment := readPacket(t, packets); proto != 17 || string(segment[8:]) != "first" {
+		t.Fatalf("Expected the first UDP flow to be relayed")
+	}
+	stack.Write(udpPacket(53002, udpPort, "second"))
+	select {
+	case pkt := <-packets:
+		t.Errorf("Expected a UDP flow beyond the limit to be dropped, got %x", pkt)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestNetstackUDP tests that UDP datagrams are relayed through a real socket and replies come back
+func TestNetstackUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	stack, packets := newNetstack(t)
+	defer stack.Close()
+
+	stack.Write(udpPacket(53000, port, "hello"))
+	proto, segment := readPacket(t, packets)
+	if proto != 17 {
+		t.Fatalf("Expected UDP, got protocol %d", proto)
+	}
+	if int(binary.BigEndian.Uint16(segment[0:])) != port || binary.BigEndian.Uint16(segment[2:]) != 53000 {
+		t.Errorf("Wrong ports on reply")
+	}
+	if string(segment[8:]) != "HELLO" {
+		t.Errorf("Expected %q, got %q", "HELLO", segment[8:])
+	}
+}
+
+// TestNetstackBadChecksum tests that corrupted packets are dropped
+func TestNetstackBadChecksum(t *testing.T) {
+	stack, packets := newNetstack(t)
+	defer stack.Close()
+
+	pkt := tcpPacket(40002, 9, 1, 0, flagSYN, "")
+	pkt[len(pkt)-1] ^= 0xff
+	stack.Write(pkt)
+	select {
+	case <-packets:
+		t.Errorf("Expected the packet to be dropped")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/packet"
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// fakeDevice is a device whose packets are read from and written to channels
+type fakeDevice struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{in: make(chan []byte, 8), out: make(chan []byte, 8)}
+}
+
+func (d *fakeDevice) Read(b []byte) (int, error) {
+	p, ok := <-d.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, p), nil
+}
+
+func (d *fakeDevice) Write(b []byte) (int, error) {
+	d.out <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (d *fakeDevice) Close() error {
+	close(d.in)
+	return nil
+}
+
+func (d *fakeDevice) Name() string {
+	return "fake0"
+}
+
+func (d *fakeDevice) MTU() int {
+	return packet.DefaultMTU
+}
+
+// ipv4Packet returns a minimal IPv4 header followed by the payload
+func ipv4Packet(payload string) []byte {
+	header := make([]byte, 20)
+	header[0] = 0x45
+	return append(header, payload...)
+}
+
+// TestPacketForward tests that IP packets read from a device are injected into the peer's device
+func TestPacketForward(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	devA, devB := newFakeDevice(), newFakeDevice()
+	go packet.Forward(devA, a, nil)
+	go func() {
+		for {
+			ty, payload, err := b.ReadRecord()
+			if err != nil {
+				return
+			}
+			if ty == remote.RecordPacket {
+				packet.Inject(devB, payload)
+			}
+		}
+	}()
+
+	devA.in <- []byte("not an IP packet")
+	devA.in <- ipv4Packet("first")
+	devA.in <- ipv4Packet("second")
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case p := <-devB.out:
+			if !bytes.Equal(p, ipv4Packet(expected)) {
+				t.Errorf("Expected packet %s, was %x\n", expected, p)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected packet %s to be injected\n", expected)
+		}
+	}
+	devA.Close()
+}
+
+// TestPacketConfig tests validation of TUN configs
+func TestPacketConfig(t *testing.T) {
+	cfg := packet.Config{Addresses: []string{"10.8.0.1/24", "fd00:8::1/64"}}
+	if err := cfg.Validate(); err != nil || cfg.MTU != packet.DefaultMTU {
+		t.Errorf("Expected config to be valid with the default MTU, was %v (%v)\n", cfg, err)
+	}
+
+	for _, bad := range []packet.Config{{}, {Addresses: []string{"10.8.0.1"}}, {Addresses: []string{"10.8.0.1/24"}, MTU: 100}} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Expected %v to be rejected\n", bad)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// countingConn counts the writes to a connection
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// paddedFrameSizes sends each message over a session padded with the config, and returns the
+// size of each frame sent after checking the message arrived unpadded
+func paddedFrameSizes(t *testing.T, p remote.PaddingConfig, messages []string) (sizes []int) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+	a.SetPadding(p)
+
+	frames := make(chan []byte, len(messages))
+	a.Trace = func(outbound bool, frame []byte) {
+		frames <- frame
+	}
+	for _, message := range messages {
+		go a.Send([]byte(message))
+		if _, payload, err := b.ReadRecord(); err != nil || string(payload) != message {
+			t.Fatalf("Expected %d bytes, got %d (%v)\n", len(message), len(payload), err)
+		}
+		frame := <-frames
+		if binary.LittleEndian.Uint64(frame) == uint64(len(frame)-8) {
+			t.Errorf("Expected the frame length to be hidden\n")
+		}
+		sizes = append(sizes, len(frame))
+	}
+	return
+}
+
+// TestPaddingBuckets tests that records of similar lengths can't be told apart when padded to buckets
+func TestPaddingBuckets(t *testing.T) {
+	sizes := paddedFrameSizes(t, remote.PaddingConfig{Mode: remote.PaddingBuckets}, []string{"a", "hello", strings.Repeat("x", 100), strings.Repeat("x", 200), strings.Repeat("x", 250)})
+	if sizes[0] != sizes[1] || sizes[1] != sizes[2] {
+		t.Errorf("Expected short records to share a size, were %v\n", sizes)
+	}
+	if sizes[3] != sizes[4] || sizes[3] <= sizes[2] {
+		t.Errorf("Expected longer records to share the next size, were %v\n", sizes)
+	}
+
+	sizes = paddedFrameSizes(t, remote.PaddingConfig{Mode: remote.PaddingNone}, []string{"a", "hello", strings.Repeat("x", 100)})
+	if sizes[0] == sizes[2] {
+		t.Errorf("Expected unpadded records to differ in size, were %v\n", sizes)
+	}
+}
+
+// TestPaddingFixed tests that records are padded to multiples of the fixed size
+func TestPaddingFixed(t *testing.T) {
+	p := remote.PaddingConfig{Mode: remote.PaddingFixed}
+	if err := p.Validate(); err != nil || p.Size != remote.DefaultPaddingSize {
+		t.Fatalf("Expected the default size, was %d (%v)\n", p.Size, err)
+	}
+	sizes := paddedFrameSizes(t, p, []string{"a", strings.Repeat("x", 1000), strings.Repeat("x", 1500), strings.Repeat("x", 2000)})
+	if sizes[0] != sizes[1] || sizes[2] != sizes[3] || sizes[2]-sizes[0] != p.Size {
+		t.Errorf("Expected records padded to multiples of %d, were %v\n", p.Size, sizes)
+	}
+}
+
+// TestCoverTraffic tests that cover records are sent while idle and discarded by the peer
+func TestCoverTraffic(t *testing.T) {
+	connA, connB := tcpPair(t)
+	counted := &countingConn{Conn: connA}
+	a := remote.NewSession(counted, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+	a.SetPadding(remote.PaddingConfig{Mode: remote.PaddingBuckets, CoverInterval: 20 * time.Millisecond})
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		a.Send([]byte("hello"))
+	}()
+	if _, payload, err := b.ReadRecord(); err != nil || string(payload) != "hello" {
+		t.Errorf("Expected hello after the cover records, got %s (%v)\n", payload, err)
+	}
+	if writes := atomic.LoadInt32(&counted.writes); writes < 5 {
+		t.Errorf("Expected cover records while idle, only %d records were sent\n", writes)
+	}
+
+	for _, bad := range []remote.PaddingConfig{{Size: -1}, {CoverInterval: time.Millisecond}} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Expected %v to be rejected\n", bad)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/packet"
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// TestPoolAssign tests that each identity gets its own addresses, and the same ones every time
+func TestPoolAssign(t *testing.T) {
+	pool, err := packet.NewPool([]string{"10.8.0.0/24", "fd00:8::/64"}, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if server := pool.ServerAddresses(); !reflect.DeepEqual(server, []string{"10.8.0.1/24", "fd00:8::1/64"}) {
+		t.Errorf("Unexpected server addresses %v\n", server)
+	}
+
+	alice, err := pool.Assign("alice")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(alice, []string{"10.8.0.2/24", "fd00:8::2/64"}) {
+		t.Errorf("Unexpected addresses %v\n", alice)
+	}
+	bob, _ := pool.Assign("bob")
+	if !reflect.DeepEqual(bob, []string{"10.8.0.3/24", "fd00:8::3/64"}) {
+		t.Errorf("Unexpected addresses %v\n", bob)
+	}
+	if again, _ := pool.Assign("alice"); !reflect.DeepEqual(again, alice) {
+		t.Errorf("Expected alice to keep %v, got %v\n", alice, again)
+	}
+}
+
+// TestPoolPersist tests that leases survive a restart
+func TestPoolPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+
+	pool, err := packet.NewPool([]string{"10.8.0.0/24"}, path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pool.Assign("alice")
+	bob, _ := pool.Assign("bob")
+
+	if pool, err = packet.NewPool([]string{"10.8.0.0/24"}, path); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if again, _ := pool.Assign("bob"); !reflect.DeepEqual(again, bob) {
+		t.Errorf("Expected bob to keep %v, got %v\n", bob, again)
+	}
+	if carol, _ := pool.Assign("carol"); !reflect.DeepEqual(carol, []string{"10.8.0.4/24"}) {
+		t.Errorf("Expected carol to get a new address, got %v\n", carol)
+	}
+}
+
+// TestPoolExhausted tests that the pool never leases the server's or the broadcast address
+func TestPoolExhausted(t *testing.T) {
+	pool, err := packet.NewPool([]string{"10.8.0.0/30"}, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = pool.Assign("alice"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = pool.Assign("bob"); err != packet.ErrPoolExhausted {
+		t.Errorf("Expected the pool to be exhausted, got %v\n", err)
+	}
+
+	for _, bad := range [][]string{{}, {"10.8.0.1"}, {"10.8.0.0/31"}, {"10.8.0.0/24", "10.9.0.0/24"}} {
+		if _, err = packet.NewPool(bad, ""); err == nil {
+			t.Errorf("Expected %v to be rejected\n", bad)
+		}
+	}
+}
+
+// TestControlRecord tests that control messages arrive as they were sent
+func TestControlRecord(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	sent := remote.InterfaceConfig{Addresses: []string{"10.8.0.2/24"}, MTU: 1400, DNS: []string{"10.8.0.1"}}
+	go a.WriteControl(remote.RecordConfig, sent)
+
+	ty, payload, err := b.ReadRecord()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var received remote.InterfaceConfig
+	if err = remote.ReadControl(payload, &received); err != nil || ty != remote.RecordConfig {
+		t.Fatalf("Could not read the control record (%v)\n", err)
+	}
+	if !reflect.DeepEqual(received, sent) {
+		t.Errorf("Expected %v, got %v\n", sent, received)
+	}
+}
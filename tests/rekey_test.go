@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// readData reads records from the session until it ends, passing on the data records
+func readData(s *remote.Session) <-chan string {
+	received := make(chan string, 1000)
+	go func() {
+		for {
+			ty, payload, err := s.ReadRecord()
+			if err != nil {
+				close(received)
+				return
+			}
+			if ty == remote.RecordData {
+				received <- string(payload)
+			}
+		}
+	}()
+	return received
+}
+
+// expectData checks that the data records arrive numbered from 0 up to count, in order
+func expectData(t *testing.T, received <-chan string, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case payload, ok := <-received:
+			if !ok {
+				t.Fatalf("Session ended before record %d\n", i)
+			}
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("Expected record %d, got %s\n", i, payload)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for record %d\n", i)
+		}
+	}
+}
+
+// waitEpoch waits until the session has agreed the number of new keys
+func waitEpoch(t *testing.T, s *remote.Session, epoch uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Epoch() != epoch {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected key epoch %d, was %d\n", epoch, s.Epoch())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitSameEpoch waits until both sessions have agreed the same new keys
+func waitSameEpoch(t *testing.T, a, b *remote.Session) {
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Epoch() == 0 || a.Epoch() != b.Epoch() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected both sides to agree new keys, epochs were %d and %d\n", a.Epoch(), b.Epoch())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rekeyDuringTraffic sends numbered data records from a to b while a and then b ask for new keys
+func rekeyDuringTraffic(t *testing.T, a, b *remote.Session) {
+	const count = 300
+	fromA, fromB := readData(b), readData(a)
+	go func() {
+		for i := 0; i < count; i++ {
+			a.Send([]byte(strconv.Itoa(i)))
+			b.Send([]byte(strconv.Itoa(i)))
+			switch i {
+			case count / 3:
+				if err := a.Rekey(); err != nil {
+					t.Errorf(err.Error())
+				}
+			case 2 * count / 3:
+				if err := b.Rekey(); err != nil && err != remote.ErrRekeyPending {
+					t.Errorf(err.Error())
+				}
+			}
+		}
+	}()
+	expectData(t, fromA, count)
+	expectData(t, fromB, count)
+	waitSameEpoch(t, a, b)
+}
+
+// TestRekey tests that a new session key is agreed without losing records in flight
+func TestRekey(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	epochs := make(chan uint64, 2)
+	b.OnRekey = func(epoch uint64) { epochs <- epoch }
+	rekeyDuringTraffic(t, a, b)
+	if epoch := <-epochs; epoch != 1 {
+		t.Errorf("Expected the first new key to be epoch 1, was %d\n", epoch)
+	}
+}
+
+// TestRekeyCollision tests that both sides asking for a new key at once agree on one of them
+func TestRekeyCollision(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	// neither side reads the other's request before sending its own
+	if err := a.Rekey(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := b.Rekey(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	fromA, fromB := readData(b), readData(a)
+	waitEpoch(t, a, 1)
+	waitEpoch(t, b, 1)
+
+	a.Send([]byte("0"))
+	b.Send([]byte("0"))
+	expectData(t, fromA, 1)
+	expectData(t, fromB, 1)
+	if err := a.Rekey(); err != nil {
+		t.Errorf("Expected a rekey to be possible again, was %v\n", err)
+	}
+	waitEpoch(t, b, 2)
+}
+
+// TestRekeyDatagram tests rekeying a session over a lossy datagram transport
+func TestRekeyDatagram(t *testing.T) {
+	serverPort := freeUDPPort(t)
+	proxyPort, closeProxy := lossyProxy(t, "127.0.0.1:"+serverPort, 5)
+	defer closeProxy()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := remote.ServeAndAcceptUDP(serverPort)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		accepted <- conn
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	connA, err := remote.ConnectUDP("127.0.0.1", proxyPort)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	defer a.Close()
+	a.WriteRecord(remote.RecordPacket, []byte("hello"))
+	b := remote.NewSession(<-accepted, "s3cr3t", time.Hour)
+	defer b.Close()
+
+	rekeyDuringTraffic(t, a, b)
+}
@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/packet"
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// TestRoutePolicy tests that a user's own routes win over its groups', which win over the default
+func TestRoutePolicy(t *testing.T) {
+	policy := &packet.RoutePolicy{
+		Default: packet.RouteSet{Include: []string{"10.8.0.0/24"}},
+		Groups: map[string]packet.RouteGroup{
+			"b-ops": {RouteSet: packet.RouteSet{Include: []string{"0.0.0.0/0"}}, Members: []string{"bob", "carol"}},
+			"a-dev": {RouteSet: packet.RouteSet{Include: []string{"10.0.0.0/8"}, Exclude: []string{"10.9.0.0/16"}}, Members: []string{"carol"}},
+		},
+		Users: map[string]packet.RouteSet{
+			"alice": {Include: []string{"192.168.0.0/16"}},
+		},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for identity, expected := range map[string]packet.RouteSet{
+		"alice": policy.Users["alice"],
+		"bob":   policy.Groups["b-ops"].RouteSet,
+		"carol": policy.Groups["a-dev"].RouteSet,
+		"dave":  policy.Default,
+	} {
+		if set := policy.For(identity); !reflect.DeepEqual(set, expected) {
+			t.Errorf("Expected %s to get %v, got %v\n", identity, expected, set)
+		}
+	}
+
+	policy.Users["eve"] = packet.RouteSet{Exclude: []string{"10.0.0.1"}}
+	if err := policy.Validate(); err == nil {
+		t.Errorf("Expected a prefix without a length to be rejected\n")
+	}
+}
+
+// TestRouteTable tests matching destinations against included and excluded prefixes
+func TestRouteTable(t *testing.T) {
+	table, err := packet.NewRouteTable(packet.RouteSet{Include: []string{"10.0.0.0/8", "fd00::/8"}, Exclude: []string{"10.9.0.0/16"}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for ip, expected := range map[string]bool{"10.1.2.3": true, "10.9.2.3": false, "8.8.8.8": false, "fd00::1": true, "2001:db8::1": false} {
+		if table.Match(net.ParseIP(ip)) != expected {
+			t.Errorf("Expected match of %s to be %v\n", ip, expected)
+		}
+	}
+
+	everything, _ := packet.NewRouteTable(packet.RouteSet{Exclude: []string{"192.168.0.0/16"}})
+	if !everything.Match(net.ParseIP("8.8.8.8")) || everything.Match(net.ParseIP("192.168.1.1")) {
+		t.Errorf("Expected an empty include list to match everything but the exclusions\n")
+	}
+}
+
+// TestRouteSetRoutes tests that a set with only exclusions routes every address through the tunnel
+func TestRouteSetRoutes(t *testing.T) {
+	tests := []struct {
+		set      packet.RouteSet
+		expected []string
+	}{
+		{packet.RouteSet{}, nil},
+		{packet.RouteSet{Include: []string{"10.0.0.0/8"}, Exclude: []string{"10.9.0.0/16"}}, []string{"10.0.0.0/8"}},
+		{packet.RouteSet{Exclude: []string{"192.168.0.0/16"}}, []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"}},
+	}
+	for _, test := range tests {
+		if routes := test.set.Routes(); !reflect.DeepEqual(routes, test.expected) {
+			t.Errorf("Expected routes %v for %s, were %v\n", test.expected, test.set, routes)
+		}
+	}
+
+	// the halves cover every address but the exclusions
+	table, _ := packet.NewRouteTable(packet.RouteSet{Include: packet.RouteSet{Exclude: []string{"192.168.0.0/16"}}.Routes()})
+	for _, ip := range []string{"1.2.3.4", "200.1.1.1", "2001:db8::1", "fd00::1"} {
+		if !table.Match(net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be routed through the tunnel\n", ip)
+		}
+	}
+}
+
+// TestPacketForwardRoutes tests that only packets to routed destinations are sent over the session
+func TestPacketForwardRoutes(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	table, _ := packet.NewRouteTable(packet.RouteSet{Include: []string{"10.0.0.0/8"}})
+	devA := newFakeDevice()
+	go packet.Forward(devA, a, table)
+	defer devA.Close()
+
+	outside, inside := ipv4Packet("outside"), ipv4Packet("inside")
+	copy(outside[16:20], net.IPv4(192, 168, 1, 1).To4())
+	copy(inside[16:20], net.IPv4(10, 1, 1, 1).To4())
+	devA.in <- outside
+	devA.in <- inside
+
+	ty, payload, err := b.ReadRecord()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ty != remote.RecordPacket || !reflect.DeepEqual(payload, inside) {
+		t.Errorf("Expected only the packet inside the routes, got %x\n", payload)
+	}
+}
+
+// TestPacketSentFrom tests that packets are only taken as sent from an address by their source
+func TestPacketSentFrom(t *testing.T) {
+	leased := []net.IP{net.ParseIP("10.8.0.2"), net.ParseIP("fd00:8::2")}
+
+	own, spoofed := ipv4Packet("own"), ipv4Packet("spoofed")
+	copy(own[12:16], net.IPv4(10, 8, 0, 2).To4())
+	copy(spoofed[12:16], net.IPv4(10, 8, 0, 3).To4())
+	copy(spoofed[16:20], net.IPv4(10, 8, 0, 2).To4())
+	if !packet.SentFrom(own, leased) {
+		t.Errorf("Expected a packet from the leased address to be accepted\n")
+	}
+	if packet.SentFrom(spoofed, leased) {
+		t.Errorf("Expected a packet from another address to be dropped\n")
+	}
+	if packet.SentFrom(own[:10], leased) || packet.SentFrom(own, nil) {
+		t.Errorf("Expected a malformed packet or one from a client without a lease to be dropped\n")
+	}
+
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	copy(ipv6[8:24], net.ParseIP("fd00:8::2"))
+	if !packet.SentFrom(ipv6, leased) {
+		t.Errorf("Expected an IPv6 packet from the leased address to be accepted\n")
+	}
+}
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return conn, <-accepted
+}
+
+// TestSessionRecord tests that a data record is received as it was sent
+func TestSessionRecord(t *testing.T) {
+	var (
+		ty      remote.RecordType
+		payload []byte
+		err     error
+	)
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	data := []byte("hello world, this is longer than one block")
+	go a.Send(data)
+
+	if ty, payload, err = b.ReadRecord(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ty != remote.RecordData {
+		t.Errorf("Expected record type %d, was %d\n", remote.RecordData, ty)
+	}
+	if !bytes.Equal(payload, data) {
+		t.Errorf("Expected was %s, received was %s\n", data, payload)
+	}
+}
+
+// TestSessionKeepalive tests that idle sessions measure the round trip time
+func TestSessionKeepalive(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", 300*time.Millisecond)
+	b := remote.NewSession(connB, "s3cr3t", 300*time.Millisecond)
+	defer a.Close()
+	defer b.Close()
+
+	measured := make(chan time.Duration, 1)
+	a.OnRTT = func(rtt time.Duration) {
+		select {
+		case measured <- rtt:
+		default:
+		}
+	}
+	go a.ReadRecord()
+	go b.ReadRecord()
+
+	select {
+	case <-measured:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected a keepalive echo within 2s")
+	}
+}
+
+// TestSessionDeadPeer tests that a silent peer is detected
+func TestSessionDeadPeer(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", 300*time.Millisecond)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	go b.Send([]byte("only message"))
+	if _, _, err := a.ReadRecord(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if _, _, err := a.ReadRecord(); err != remote.ErrPeerTimeout {
+		t.Errorf("Expected %v, was %v\n", remote.ErrPeerTimeout, err)
+	}
+}
+
+// TestSessionSilentPeer tests that a peer which never sends a record is detected
+func TestSessionSilentPeer(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", 300*time.Millisecond)
+	defer a.Close()
+	defer connB.Close()
+
+	if _, _, err := a.ReadRecord(); err != remote.ErrPeerTimeout {
+		t.Errorf("Expected %v, was %v\n", remote.ErrPeerTimeout, err)
+	}
+}
+
+// TestSessionCloseAlert tests that the reason for closing reaches the peer
+func TestSessionCloseAlert(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer b.Close()
+
+	a.CloseWithAlert(remote.AlertUserDisconnect, "")
+	_, _, err := b.ReadRecord()
+	if !remote.IsCleanClose(err) {
+		t.Errorf("Expected a clean close, was %v\n", err)
+	}
+}
+
+// TestSessionTruncated tests that closing without an alert is reported as truncation
+func TestSessionTruncated(t *testing.T) {
+	connA, connB := tcpPair(t)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer b.Close()
+
+	connA.Close()
+	if _, _, err := b.ReadRecord(); err != remote.ErrTruncated {
+		t.Errorf("Expected %v, was %v\n", remote.ErrTruncated, err)
+	}
+}
+
+// TestSessionWrongKey tests that records under another key fail authentication
+func TestSessionWrongKey(t *testing.T) {
+	connA, connB := tcpPair(t)
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "0th3r", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	go a.Send([]byte("hello"))
+	if _, _, err := b.ReadRecord(); err != remote.ErrBadRecordMAC {
+		t.Errorf("Expected %v, was %v\n", remote.ErrBadRecordMAC, err)
+	}
+}
@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/tunnel"
+)
+
+// socksProxy starts a SOCKS5 proxy through a tunnel and returns its address
+func socksProxy(t *testing.T, creds *tunnel.Credentials) string {
+	muxA, muxB := muxPair(t)
+	go tunnel.Serve(muxB, tunnel.ServerPolicy(nil, false))
+
+	l, err := tunnel.ListenSOCKS("127.0.0.1:0", creds, muxA)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return l.Addr().String()
+}
+
+// socksConnect sends a domain CONNECT request and returns the reply code
+func socksConnect(t *testing.T, conn net.Conn, address string) byte {
+	host, portString, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(portString)
+
+	request := []byte{5, 1, 0, 3, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	conn.Write(request)
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return reply[1]
+}
+
+// TestSOCKSConnect tests proxying a connection without authentication
+func TestSOCKSConnect(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+
+	conn, err := net.Dial("tcp", socksProxy(t, nil))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{5, 1, 0})
+	method := make([]byte, 2)
+	io.ReadFull(conn, method)
+	if !bytes.Equal(method, []byte{5, 0}) {
+		t.Fatalf("Expected no authentication, was %v\n", method)
+	}
+
+	if code := socksConnect(t, conn, target.Addr().String()); code != 0 {
+		t.Fatalf("Expected CONNECT to succeed, was %d\n", code)
+	}
+	expectEcho(t, conn)
+}
+
+// TestSOCKSPassword tests username and password authentication
+func TestSOCKSPassword(t *testing.T) {
+	target := echoServer(t)
+	defer target.Close()
+	proxy := socksProxy(t, &tunnel.Credentials{Username: "user", Password: "pass"})
+
+	for _, password := range []string{"wrong", "pass"} {
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer conn.Close()
+
+		conn.Write([]byte{5, 2, 0, 2})
+		method := make([]byte, 2)
+		io.ReadFull(conn, method)
+		if !bytes.Equal(method, []byte{5, 2}) {
+			t.Fatalf("Expected password authentication, was %v\n", method)
+		}
+
+		login := append([]byte{1, 4}, "user"...)
+		login = append(login, byte(len(password)))
+		login = append(login, password...)
+		conn.Write(login)
+		status := make([]byte, 2)
+		io.ReadFull(conn, status)
+
+		if password == "wrong" {
+			if status[1] == 0 {
+				t.Errorf("Expected the wrong password to be rejected")
+			}
+			continue
+		}
+		if status[1] != 0 {
+			t.Fatalf("Expected the password to be accepted")
+		}
+		if code := socksConnect(t, conn, target.Addr().String()); code != 0 {
+			t.Fatalf("Expected CONNECT to succeed, was %d\n", code)
+		}
+		expectEcho(t, conn)
+	}
+}
+
+// TestSOCKSRefused tests that failed connections are reported with a reply code
+func TestSOCKSRefused(t *testing.T) {
+	closed := echoServer(t)
+	closed.Close()
+
+	conn, err := net.Dial("tcp", socksProxy(t, nil))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{5, 1, 0})
+	io.ReadFull(conn, make([]byte, 2))
+	if code := socksConnect(t, conn, closed.Addr().String()); code != 5 {
+		t.Errorf("Expected connection refused, was %d\n", code)
+	}
+}
+
+// TestSOCKSSilentClient tests that a proxy client which never sends its request is disconnected
+func TestSOCKSSilentClient(t *testing.T) {
+	conn, err := net.Dial("tcp", socksProxy(t, nil))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(tunnel.DialTimeout + 5*time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the proxy to close the connection, was %v\n", err)
+	}
+}
@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// writeCert issues a certificate for 127.0.0.1 signed by the parent, or self-signed if it is nil,
+// and writes it and its key as PEM files in the directory
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// tlsFiles writes a CA and a server and client certificate it signed to a temporary directory
+func tlsFiles(t *testing.T) (dir string) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	return
+}
+
+// tlsSession connects a client to a server over the transports and checks a record gets through
+func tlsSession(t *testing.T, server, client remote.TransportConfig) {
+	port := freeTCPPort(t)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := remote.ServeAndAcceptTransport(server, port)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		accepted <- conn
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	connA, err := remote.ConnectTransport(client, "127.0.0.1", port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	defer a.Close()
+	go a.Send([]byte("hello"))
+	b := remote.NewSession(<-accepted, "s3cr3t", time.Hour)
+	defer b.Close()
+
+	if _, payload, err := b.ReadRecord(); err != nil || string(payload) != "hello" {
+		t.Errorf("Expected hello over %s, got %s (%v)\n", client.Kind, payload, err)
+	}
+}
+
+// TestTLSTransport tests that sessions run inside TLS over both the tcp and ws transports
+func TestTLSTransport(t *testing.T) {
+	dir := tlsFiles(t)
+	defer os.RemoveAll(dir)
+
+	for _, kind := range []remote.Transport{remote.TransportTCP, remote.TransportWebSocket} {
+		server := remote.TransportConfig{
+			Kind:          kind,
+			WebSocketPath: remote.DefaultWebSocketPath,
+			TLS:           true,
+			CertFile:      filepath.Join(dir, "server.pem"),
+			KeyFile:       filepath.Join(dir, "server.key"),
+		}
+		client := remote.TransportConfig{Kind: kind, WebSocketPath: remote.DefaultWebSocketPath, TLS: true, CAFile: filepath.Join(dir, "ca.pem")}
+		tlsSession(t, server, client)
+	}
+
+	// the server's certificate isn't trusted by the system roots
+	port := freeTCPPort(t)
+	go remote.ServeAndAcceptTransport(remote.TransportConfig{Kind: remote.TransportTCP, TLS: true, CertFile: filepath.Join(dir, "server.pem"), KeyFile: filepath.Join(dir, "server.key")}, port)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := remote.ConnectTransport(remote.TransportConfig{Kind: remote.TransportTCP, TLS: true}, "127.0.0.1", port); err == nil {
+		t.Errorf("Expected an untrusted server certificate to be rejected\n")
+	}
+
+	if err := (remote.TransportConfig{Kind: remote.TransportUDP, TLS: true}).Validate(); err != remote.ErrTLSDatagram {
+		t.Errorf("Expected TLS over udp to be rejected, was %v\n", err)
+	}
+}
+
+// TestTLSClientCertificate tests that a server with a CA file only accepts clients with certificates it signed
+func TestTLSClientCertificate(t *testing.T) {
+	dir := tlsFiles(t)
+	defer os.RemoveAll(dir)
+
+	server := remote.TransportConfig{
+		Kind:     remote.TransportTCP,
+		TLS:      true,
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	}
+	client := remote.TransportConfig{Kind: remote.TransportTCP, TLS: true, CAFile: filepath.Join(dir, "ca.pem")}
+
+	// in TLS 1.3 the client only learns it was rejected once it reads
+	port := freeTCPPort(t)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := remote.ServeAndAcceptTransport(server, port)
+		accepted <- conn
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn, err := remote.ConnectTransport(client, "127.0.0.1", port)
+	if err == nil {
+		conn.Write([]byte("hello"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Errorf("Expected a client without a certificate to be rejected\n")
+	}
+
+	// the server keeps waiting for a client it accepts
+	client.CertFile = filepath.Join(dir, "client.pem")
+	client.KeyFile = filepath.Join(dir, "client.key")
+	if conn, err = remote.ConnectTransport(client, "127.0.0.1", port); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	select {
+	case c := <-accepted:
+		if c == nil {
+			t.Fatalf("Expected the client with a certificate to be accepted\n")
+		}
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the client with a certificate to be accepted\n")
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/auth"
+)
+
+// TestTOTPCode tests one-time codes against the SHA-1 vectors of RFC 6238
+func TestTOTPCode(t *testing.T) {
+	seed := []byte("12345678901234567890")
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if code := auth.TOTPCode(seed, test.unix/30); code != test.expected {
+			t.Errorf("Expected code %s at %d, was %s\n", test.expected, test.unix, code)
+		}
+	}
+}
+
+// TestTOTPVerify tests that codes are accepted within the allowed drift, and only once
+func TestTOTPVerify(t *testing.T) {
+	path, cleanup := usersFile(t)
+	defer cleanup()
+	totp, err := auth.LoadTOTP(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	seed, err := totp.Enroll("alice")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	now := time.Unix(1600000000, 0)
+	counter := now.Unix() / 30
+
+	if err = totp.Verify("alice", auth.TOTPCode(seed, counter-1), now); err != nil {
+		t.Errorf("Expected the previous period's code to be accepted, was %v\n", err)
+	}
+	if err = totp.Verify("alice", auth.TOTPCode(seed, counter), now); err != nil {
+		t.Errorf("Expected the current code to be accepted, was %v\n", err)
+	}
+	if err = totp.Verify("alice", auth.TOTPCode(seed, counter), now); err != auth.ErrCodeReused {
+		t.Errorf("Expected %v, was %v\n", auth.ErrCodeReused, err)
+	}
+	if err = totp.Verify("alice", auth.TOTPCode(seed, counter-1), now); err != auth.ErrCodeReused {
+		t.Errorf("Expected an older code to fail with %v, was %v\n", auth.ErrCodeReused, err)
+	}
+	if err = totp.Verify("alice", auth.TOTPCode(seed, counter+2), now); err != auth.ErrBadCode {
+		t.Errorf("Expected a code too far ahead to fail with %v, was %v\n", auth.ErrBadCode, err)
+	}
+	if err = totp.Verify("bob", "000000", now); err != auth.ErrNotEnrolled {
+		t.Errorf("Expected %v, was %v\n", auth.ErrNotEnrolled, err)
+	}
+
+	// a restarted server must still refuse the codes already used
+	restarted, err := auth.LoadTOTP(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = restarted.Verify("alice", auth.TOTPCode(seed, counter), now); err != auth.ErrCodeReused {
+		t.Errorf("Expected %v after a restart, was %v\n", auth.ErrCodeReused, err)
+	}
+	if err = restarted.Verify("alice", auth.TOTPCode(seed, counter+1), now); err != nil {
+		t.Errorf("Expected the next period's code to be accepted, was %v\n", err)
+	}
+}
+
+// TestOTPAuthURI tests that the enrollment URI carries the seed in base32
+func TestOTPAuthURI(t *testing.T) {
+	uri, err := url.Parse(auth.OTPAuthURI("simple-vpn", "alice", []byte("12345678901234567890")))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || !strings.HasSuffix(uri.Path, "simple-vpn:alice") {
+		t.Errorf("Expected an otpauth://totp/simple-vpn:alice URI, was %s\n", uri)
+	}
+	if secret := uri.Query().Get("secret"); secret != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" {
+		t.Errorf("Expected secret GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ, was %s\n", secret)
+	}
+	if uri.Query().Get("digits") != "6" || uri.Query().Get("period") != "30" {
+		t.Errorf("Expected 6 digit codes every 30 seconds, was %s\n", uri.RawQuery)
+	}
+}
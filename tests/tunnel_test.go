@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/tunnel"
+)
+
+// echoServer starts a TCP server which echoes everything back
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// expectEcho writes to the connection and checks that the same data comes back
+func expectEcho(t *testing.T, conn net.Conn) {
+	message := []byte("through the tunnel")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatalf(err.Error())
+	}
+	echoed := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(echoed) != string(message) {
+		t.Errorf("Expected was %s, echoed was %s\n", message, echoed)
+	}
+}
+
+// TestParseForward tests parsing of forward specifications
+func TestParseForward(t *testing.T) {
+	fwd, err := tunnel.ParseForward("8000:intranet:80")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if fwd.ListenAddress() != "127.0.0.1:8000" || fwd.TargetAddress() != "intranet:80" {
+		t.Errorf("Unexpected forward %s\n", fwd)
+	}
+
+	if fwd, err = tunnel.ParseForward("0.0.0.0:8000:intranet:80"); err != nil || fwd.ListenAddress() != "0.0.0.0:8000" {
+		t.Errorf("Unexpected forward %s (%v)\n", fwd, err)
+	}
+
+	for _, spec := range []string{"8000", "8000:intranet", "port:intranet:80", "8000::80", "8000:intranet:99999"} {
+		if _, err = tunnel.ParseForward(spec); err == nil {
+			t.Errorf("Expected %s to be rejected\n", spec)
+		}
+	}
+}
+
+// TestLocalForward tests that a local port reaches the target through the tunnel
+func TestLocalForward(t *testing.T) {
+	muxA, muxB := muxPair(t)
+	go tunnel.Serve(muxB, tunnel.ServerPolicy(nil, false))
+
+	target := echoServer(t)
+	defer target.Close()
+	_, targetPort, _ := net.SplitHostPort(target.Addr().String())
+
+	l, err := tunnel.ListenLocal(tunnel.Forward{BindAddress: "127.0.0.1", Port: "0", Host: "127.0.0.1", HostPort: targetPort}, muxA)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+}
+
+// TestDialRefused tests that a failed connection on the peer is reported to the opener
+func TestDialRefused(t *testing.T) {
+	muxA, muxB := muxPair(t)
+	go tunnel.Serve(muxB, tunnel.ServerPolicy(nil, false))
+
+	closed := echoServer(t)
+	closed.Close()
+
+	_, err := tunnel.Dial(muxA, closed.Addr().String())
+	if _, ok := err.(*remote.StreamResetError); !ok {
+		t.Errorf("Expected a stream reset, was %v\n", err)
+	}
+}
+
+// TestRemoteForward tests that a port on the peer reaches a target on this side
+func TestRemoteForward(t *testing.T) {
+	muxA, muxB := muxPair(t)
+
+	target := echoServer(t)
+	defer target.Close()
+	_, targetPort, _ := net.SplitHostPort(target.Addr().String())
+
+	// reserve a free port for the peer to listen on
+	reserved := echoServer(t)
+	reserved.Close()
+	_, port, _ := net.SplitHostPort(reserved.Addr().String())
+	ranges, _ := tunnel.ParsePortRanges(port)
+
+	fwd := tunnel.Forward{BindAddress: "127.0.0.1", Port: port, Host: "127.0.0.1", HostPort: targetPort}
+	go tunnel.Serve(muxA, tunnel.ClientPolicy([]tunnel.Forward{fwd}))
+	go tunnel.Serve(muxB, tunnel.ServerPolicy(ranges, false))
+
+	st, err := tunnel.ListenRemote(fwd, muxA)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer st.Close()
+
+	conn, err := net.Dial("tcp", fwd.ListenAddress())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+}
+
+// TestRemoteForwardPolicy tests that the server only binds allowed ports
+func TestRemoteForwardPolicy(t *testing.T) {
+	muxA, muxB := muxPair(t)
+	ranges, err := tunnel.ParsePortRanges("8000-8100, 9000")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	go tunnel.Serve(muxB, tunnel.ServerPolicy(ranges, false))
+
+	fwd := tunnel.Forward{BindAddress: "127.0.0.1", Port: "8200", Host: "127.0.0.1", HostPort: "80"}
+	if _, err = tunnel.ListenRemote(fwd, muxA); err == nil {
+		t.Errorf("Expected port 8200 to be rejected")
+	}
+	fwd = tunnel.Forward{BindAddress: "0.0.0.0", Port: "8050", Host: "127.0.0.1", HostPort: "80"}
+	if _, err = tunnel.ListenRemote(fwd, muxA); err == nil {
+		t.Errorf("Expected binding every interface to be rejected")
+	}
+	if !ranges.Contains(8050) || !ranges.Contains(9000) || ranges.Contains(8999) {
+		t.Errorf("Unexpected port ranges %v\n", ranges)
+	}
+}
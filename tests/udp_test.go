@@ -0,0 +1,287 @@
+package tests
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/crypto"
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// freeUDPPort returns a port which was free a moment ago
+func freeUDPPort(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer pc.Close()
+	return strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// lossyProxy relays datagrams to the target, dropping every nth one in each direction and
+// duplicating and reordering some others
+func lossyProxy(t *testing.T, target string, drop int) (port string, closer func()) {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	targetAddr, _ := net.ResolveUDPAddr("udp", target)
+	back, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var (
+		mutex  sync.Mutex
+		client *net.UDPAddr
+	)
+	relay := func(read func([]byte) (int, error), write func([]byte)) {
+		var held []byte
+		buf := make([]byte, 65535)
+		for count := 1; ; count++ {
+			n, err := read(buf)
+			if err != nil {
+				return
+			}
+			datagram := append([]byte{}, buf[:n]...)
+			switch {
+			case count%drop == 0:
+			case count%7 == 0:
+				write(datagram)
+				write(datagram)
+			case count%4 == 0 && held == nil:
+				held = datagram
+				continue
+			default:
+				write(datagram)
+			}
+			if held != nil {
+				write(held)
+				held = nil
+			}
+		}
+	}
+	go relay(func(b []byte) (int, error) {
+		n, from, err := front.ReadFromUDP(b)
+		mutex.Lock()
+		client = from
+		mutex.Unlock()
+		return n, err
+	}, func(b []byte) { back.Write(b) })
+	go relay(back.Read, func(b []byte) {
+		mutex.Lock()
+		to := client
+		mutex.Unlock()
+		front.WriteToUDP(b, to)
+	})
+
+	return strconv.Itoa(front.LocalAddr().(*net.UDPAddr).Port), func() { front.Close(); back.Close() }
+}
+
+// TestUDPHandshake tests that handshake messages get through loss by being retransmitted
+func TestUDPHandshake(t *testing.T) {
+	crypto.Init()
+	serverPort := freeUDPPort(t)
+	proxyPort, closeProxy := lossyProxy(t, "127.0.0.1:"+serverPort, 2)
+	defer closeProxy()
+
+	done := make(chan error)
+	go func() {
+		conn, err := remote.ServeAndAcceptUDP(serverPort)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < 3; i++ {
+			msg, err := remote.ReadMessageStruct(conn)
+			if err != nil {
+				done <- err
+				return
+			}
+			begin := msg.(crypto.AuthenticationPayloadBeginAB)
+			begin.ChallengeAB[0]++
+			if err = remote.WriteMessageStruct(conn, begin); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := remote.ConnectUDP("127.0.0.1", proxyPort)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+
+	var msg crypto.AuthenticationPayloadBeginAB
+	for i := 0; i < 3; i++ {
+		msg.ChallengeAB[0] = byte(10 * i)
+		if err = remote.WriteMessageStruct(conn, msg); err != nil {
+			t.Fatalf(err.Error())
+		}
+		reply, err := remote.ReadMessageStruct(conn)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got := reply.(crypto.AuthenticationPayloadBeginAB).ChallengeAB[0]; got != byte(10*i+1) {
+			t.Errorf("Expected reply %d, got %d\n", 10*i+1, got)
+		}
+	}
+	if err = <-done; err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+// udpSessions connects two sessions over UDP through a lossy proxy
+func udpSessions(t *testing.T, drop int) (a, b *remote.Session, closer func()) {
+	serverPort := freeUDPPort(t)
+	proxyPort, closeProxy := lossyProxy(t, "127.0.0.1:"+serverPort, drop)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := remote.ServeAndAcceptUDP(serverPort)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		accepted <- conn
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	connA, err := remote.ConnectUDP("127.0.0.1", proxyPort)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// the server only learns about the client from its first datagram
+	a = remote.NewSession(connA, "s3cr3t", time.Hour)
+	a.WriteRecord(remote.RecordPacket, []byte("hello"))
+	connB := <-accepted
+	b = remote.NewSession(connB, "s3cr3t", time.Hour)
+	return a, b, func() {
+		a.Close()
+		b.Close()
+		closeProxy()
+	}
+}
+
+// expectInOrder checks that the data records read from the session count up from 0
+func expectInOrder(t *testing.T, b *remote.Session, count int, timeout time.Duration) {
+	received := make(chan string, count)
+	go func() {
+		for {
+			ty, payload, err := b.ReadRecord()
+			if err != nil {
+				return
+			}
+			if ty == remote.RecordData {
+				received <- string(payload)
+			}
+		}
+	}()
+	for i := 0; i < count; i++ {
+		select {
+		case payload := <-received:
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("Expected record %d, got %s\n", i, payload)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("Timed out waiting for record %d\n", i)
+		}
+	}
+}
+
+// TestUDPSession tests that records arrive once and in order despite loss, duplication and reordering
+func TestUDPSession(t *testing.T) {
+	a, b, closer := udpSessions(t, 5)
+	defer closer()
+
+	const count = 200
+	go func() {
+		for i := 0; i < count; i++ {
+			a.Send([]byte(strconv.Itoa(i)))
+			a.WriteRecord(remote.RecordPacket, []byte("packet"))
+		}
+	}()
+	expectInOrder(t, b, count, 10*time.Second)
+}
+
+// TestUDPSessionBurst tests that a burst of more records than the peer can reorder, with some
+// lost, still arrives in full
+func TestUDPSessionBurst(t *testing.T) {
+	a, b, closer := udpSessions(t, 5)
+	defer closer()
+
+	// acknowledgements are only handled while reading
+	go func() {
+		for {
+			if _, _, err := a.ReadRecord(); err != nil {
+				return
+			}
+		}
+	}()
+
+	const count = 10000
+	for i := 0; i < count; i++ {
+		a.Send([]byte(strconv.Itoa(i)))
+	}
+	expectInOrder(t, b, count, 10*time.Second)
+}
+
+// TestUDPSessionForgedDatagrams tests that datagrams failing authentication don't keep a session
+// with a dead peer alive
+func TestUDPSessionForgedDatagrams(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer server.Close()
+
+	conn, err := remote.ConnectUDP("127.0.0.1", strconv.Itoa(server.LocalAddr().(*net.UDPAddr).Port))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	s := remote.NewSession(conn, "s3cr3t", 300*time.Millisecond)
+	defer s.Close()
+	s.WriteRecord(remote.RecordPacket, []byte("hello"))
+
+	buf := make([]byte, 65535)
+	_, client, err := server.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+				// shaped like a record datagram, but under no key
+				forged := make([]byte, 64)
+				forged[0] = 1
+				server.WriteToUDP(forged, client)
+			}
+		}
+	}()
+
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := s.ReadRecord()
+		read <- err
+	}()
+	select {
+	case err = <-read:
+		if err != remote.ErrPeerTimeout {
+			t.Errorf("Expected %v, was %v\n", remote.ErrPeerTimeout, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the session to time out despite the forged datagrams\n")
+	}
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pwang347/simple-vpn/auth"
+)
+
+// usersFile returns the path of a user database in a temporary directory
+func usersFile(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return filepath.Join(dir, "users.json"), func() { os.RemoveAll(dir) }
+}
+
+// TestVerifier tests that verifiers are derived with PBKDF2-HMAC-SHA256
+func TestVerifier(t *testing.T) {
+	tests := []struct {
+		secret     string
+		salt       string
+		iterations int
+		expected   string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, test := range tests {
+		if verifier := auth.Verifier(test.secret, []byte(test.salt), test.iterations); fmt.Sprintf("%x", verifier) != test.expected {
+			t.Errorf("Expected verifier %s, was %x\n", test.expected, verifier)
+		}
+	}
+}
+
+// TestUsersLookup tests that a user's client derives the key the server looks up, and that
+// unknown and disabled users can't be told apart from the salt
+func TestUsersLookup(t *testing.T) {
+	path, cleanup := usersFile(t)
+	defer cleanup()
+	users, err := auth.LoadUsers(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = users.Add("alice", "s3cr3t"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = users.Add("alice", "other"); err != auth.ErrUserExists {
+		t.Errorf("Expected %v, was %v\n", auth.ErrUserExists, err)
+	}
+	if err = users.Add(" bob", "other"); err != auth.ErrBadUsername {
+		t.Errorf("Expected %v, was %v\n", auth.ErrBadUsername, err)
+	}
+
+	salt, iterations, key, err := users.Lookup("alice")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if clientKey, _ := auth.ClientKey("s3cr3t", salt, iterations); clientKey != key {
+		t.Errorf("Expected the client to derive the server's key\n")
+	}
+	if clientKey, _ := auth.ClientKey("wrong", salt, iterations); clientKey == key {
+		t.Errorf("Expected a wrong secret to derive another key\n")
+	}
+	if data, _ := ioutil.ReadFile(path); bytes.Contains(data, []byte("s3cr3t")) {
+		t.Errorf("Expected the secret not to be stored\n")
+	}
+
+	unknownSalt, _, unknownKey, err := users.Lookup("mallory")
+	if err != auth.ErrUnknownUser {
+		t.Errorf("Expected %v, was %v\n", auth.ErrUnknownUser, err)
+	}
+	if againSalt, _, againKey, _ := users.Lookup("mallory"); !bytes.Equal(unknownSalt, againSalt) || unknownKey == againKey {
+		t.Errorf("Expected an unknown user to get the same salt and a new key each time\n")
+	}
+
+	if err = users.SetDisabled("alice", true); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, _, _, err = users.Lookup("alice"); err != auth.ErrUserDisabled {
+		t.Errorf("Expected %v, was %v\n", auth.ErrUserDisabled, err)
+	}
+	users.SetDisabled("alice", false)
+	if _, _, _, err = users.Lookup("alice"); err != nil {
+		t.Errorf("Expected an enabled user to authenticate, was %v\n", err)
+	}
+}
+
+// TestUsersReload tests that changes made from the command line reach a running server
+func TestUsersReload(t *testing.T) {
+	path, cleanup := usersFile(t)
+	defer cleanup()
+	server, err := auth.LoadUsers(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	command, _ := auth.LoadUsers(path)
+	if err = command.Add("alice", "s3cr3t"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, _, _, err = server.Lookup("alice"); err != nil {
+		t.Errorf("Expected an added user to authenticate, was %v\n", err)
+	}
+
+	command, _ = auth.LoadUsers(path)
+	if err = command.Remove("alice"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, _, _, err = server.Lookup("alice"); err != auth.ErrUnknownUser {
+		t.Errorf("Expected %v for a removed user, was %v\n", auth.ErrUnknownUser, err)
+	}
+	if names, _ := server.List(); len(names) != 0 {
+		t.Errorf("Expected no users, was %v\n", names)
+	}
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pwang347/simple-vpn/crypto"
+	"github.com/pwang347/simple-vpn/remote"
+)
+
+// freeTCPPort returns a port which was free a moment ago
+func freeTCPPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// serveWebSocket accepts a single connection on the port in the background
+func serveWebSocket(t *testing.T, port string) chan net.Conn {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := remote.ServeAndAcceptWebSocket(port, remote.DefaultWebSocketPath)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		accepted <- conn
+	}()
+	time.Sleep(50 * time.Millisecond)
+	return accepted
+}
+
+// TestWebSocketSession tests that the handshake and session records pass over a WebSocket,
+// and that plain HTTP requests are answered without ending the wait for a client
+func TestWebSocketSession(t *testing.T) {
+	crypto.Init()
+	port := freeTCPPort(t)
+	accepted := serveWebSocket(t, port)
+
+	for path, status := range map[string]int{"/": http.StatusNotFound, remote.DefaultWebSocketPath: http.StatusUpgradeRequired} {
+		resp, err := http.Get("http://127.0.0.1:" + port + path)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Expected status %d for %s, was %d\n", status, path, resp.StatusCode)
+		}
+	}
+
+	connA, err := remote.ConnectWebSocket("127.0.0.1", port, remote.DefaultWebSocketPath)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	connB := <-accepted
+
+	var msg crypto.AuthenticationPayloadBeginAB
+	msg.ChallengeAB[0] = 42
+	if err = remote.WriteMessageStruct(connA, msg); err != nil {
+		t.Fatalf(err.Error())
+	}
+	reply, err := remote.ReadMessageStruct(connB)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if got := reply.(crypto.AuthenticationPayloadBeginAB).ChallengeAB[0]; got != 42 {
+		t.Errorf("Expected challenge 42, got %d\n", got)
+	}
+
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer a.Close()
+	defer b.Close()
+
+	// records longer than 64KB need the longest frame length encoding
+	for _, data := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), 1000), bytes.Repeat([]byte("y"), 100000)} {
+		go b.Send(data)
+		ty, payload, err := a.ReadRecord()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if ty != remote.RecordData || !bytes.Equal(payload, data) {
+			t.Errorf("Expected a data record of %d bytes, got type %d with %d bytes\n", len(data), ty, len(payload))
+		}
+	}
+}
+
+// TestWebSocketRawTCP tests that a server serving WebSockets also accepts raw TCP clients
+func TestWebSocketRawTCP(t *testing.T) {
+	port := freeTCPPort(t)
+	accepted := serveWebSocket(t, port)
+
+	connA, err := remote.Connect("127.0.0.1", port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// raw clients are told apart by their first bytes, so the server only returns once they are sent
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	defer a.Close()
+	go a.Send([]byte("hello"))
+	b := remote.NewSession(<-accepted, "s3cr3t", time.Hour)
+	defer b.Close()
+
+	if _, payload, err := b.ReadRecord(); err != nil || string(payload) != "hello" {
+		t.Errorf("Expected hello, got %s (%v)\n", payload, err)
+	}
+}
+
+// TestTransportSilentConnection tests that a connection which never sends anything is closed
+// once the handshake timeout passes, and doesn't keep others from being accepted
+func TestTransportSilentConnection(t *testing.T) {
+	defer func(timeout time.Duration) { remote.HandshakeTimeout = timeout }(remote.HandshakeTimeout)
+	remote.HandshakeTimeout = 200 * time.Millisecond
+	port := freeTCPPort(t)
+	l, err := remote.ListenTransport(remote.TransportConfig{Kind: remote.TransportTCP, WebSocketPath: remote.DefaultWebSocketPath}, port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer l.Close()
+
+	silent, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer silent.Close()
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = silent.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the silent connection to be closed\n")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Errorf("Expected the silent connection to be closed within the handshake timeout\n")
+	}
+
+	// a connection accepted after its deadline passed must not inherit it
+	connA, err := remote.Connect("127.0.0.1", port)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	a := remote.NewSession(connA, "s3cr3t", time.Hour)
+	defer a.Close()
+	go a.Send([]byte("hello"))
+	connB, err := l.Accept()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	b := remote.NewSession(connB, "s3cr3t", time.Hour)
+	defer b.Close()
+	if _, payload, err := b.ReadRecord(); err != nil || string(payload) != "hello" {
+		t.Errorf("Expected hello, got %s (%v)\n", payload, err)
+	}
+	time.Sleep(2 * remote.HandshakeTimeout)
+	go b.Send([]byte("still here"))
+	if _, payload, err := a.ReadRecord(); err != nil || string(payload) != "still here" {
+		t.Errorf("Expected still here, got %s (%v)\n", payload, err)
+	}
+}
@@ -0,0 +1,531 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/ui"
+)
+
+// see https://tools.ietf.org/html/rfc1035 and https://tools.ietf.org/html/rfc6891
+const (
+	// DNSTunnel is the upstream of DNS rules which send queries through the tunnel
+	DNSTunnel = "tunnel"
+
+	// DNSTimeout is how long to wait for an upstream resolver
+	DNSTimeout = 5 * time.Second
+
+	dnsHeaderLength  = 12
+	dnsTypeOPT       = 41
+	dnsMaxUDPLength  = 512
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsFlagQR        = 0x80
+	dnsFlagTC        = 0x02
+
+	dnsCacheSize    = 256
+	dnsMaxTTL       = 5 * time.Minute
+	dnsNegativeTTL  = 30 * time.Second
+	dnsMaxLength    = 65535
+	resolvConf      = "/etc/resolv.conf"
+	defaultResolver = "127.0.0.1:53"
+)
+
+var (
+	// ErrMalformedDNS is returned for DNS messages which cannot be parsed
+	ErrMalformedDNS = errors.New("Malformed DNS message")
+
+	// ErrNoResolver is returned when the server has not said which resolver to use
+	ErrNoResolver = errors.New("Server did not configure a DNS resolver")
+)
+
+// DNSRule sends queries for a domain and its subdomains to an upstream resolver, or through the tunnel
+type DNSRule struct {
+	// Domain is matched with its subdomains; an empty domain matches every name
+	Domain string
+
+	// Upstream is the address of a resolver, or DNSTunnel
+	Upstream string
+}
+
+// ParseDNSRule parses a rule in the form domain=upstream, where upstream is host:port or tunnel
+func ParseDNSRule(spec string) (rule DNSRule, err error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		err = errors.New("DNS rule must be in the form domain=host:port or domain=tunnel")
+		return
+	}
+	rule = DNSRule{Domain: normalizeName(parts[0]), Upstream: parts[1]}
+	if rule.Upstream != DNSTunnel {
+		if _, _, err = net.SplitHostPort(rule.Upstream); err != nil {
+			err = errors.New("DNS rule upstream must be host:port or tunnel")
+		}
+	}
+	return
+}
+
+func (rule DNSRule) matches(name string) bool {
+	return rule.Domain == "" || name == rule.Domain || strings.HasSuffix(name, "."+rule.Domain)
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// SystemResolver returns the first name server of the host, which the server offers to clients by default
+func SystemResolver() string {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return defaultResolver
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return defaultResolver
+}
+
+type dnsCacheEntry struct {
+	response []byte
+	stored   time.Time
+	expires  time.Time
+}
+
+// DNSStub answers DNS queries over UDP and TCP, sending them through the tunnel to the resolver
+// configured on the server unless a rule says otherwise, and caching the answers
+type DNSStub struct {
+	addr     net.Addr
+	m        *remote.Mux
+	rules    []DNSRule
+	resolver func() string
+	mutex    sync.Mutex
+	cache    map[string]dnsCacheEntry
+}
+
+// NewDNSStub creates a DNS stub; resolver returns the address of the resolver on the server side
+func NewDNSStub(rules []DNSRule, resolver func() string, m *remote.Mux) *DNSStub {
+	return &DNSStub{
+		m:        m,
+		rules:    rules,
+		resolver: resolver,
+		cache:    make(map[string]dnsCacheEntry),
+	}
+}
+
+// ListenDNS serves a DNS stub over UDP and TCP on the address until the session ends; resolver
+// returns the address of the resolver on the server side
+func ListenDNS(address string, rules []DNSRule, resolver func() string, m *remote.Mux) (stub *DNSStub, err error) {
+	var (
+		pc net.PacketConn
+		l  net.Listener
+	)
+	if pc, err = net.ListenPacket("udp", address); err != nil {
+		return
+	}
+	if l, err = net.Listen("tcp", pc.LocalAddr().String()); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	stub = NewDNSStub(rules, resolver, m)
+	stub.addr = pc.LocalAddr()
+
+	go func() {
+		<-stub.m.Done()
+		pc.Close()
+		l.Close()
+	}()
+	go func() {
+		buf := make([]byte, dnsMaxLength)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte{}, buf[:n]...)
+			go func() {
+				if response := stub.answer(query, true); response != nil {
+					pc.WriteTo(response, addr)
+				}
+			}()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serveTCP(conn)
+		}
+	}()
+	return
+}
+
+// Addr returns the address the stub is served on
+func (stub *DNSStub) Addr() net.Addr {
+	return stub.addr
+}
+
+// serveTCP answers queries framed with their length until the client closes the connection
+func (stub *DNSStub) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(DNSTimeout * 2))
+		query, err := readDNSFrame(conn)
+		if err != nil {
+			return
+		}
+		response := stub.answer(query, false)
+		if response == nil {
+			return
+		}
+		if err = writeDNSFrame(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// answer resolves a query, answering SERVFAIL if that fails and nothing if the query is malformed
+func (stub *DNSStub) answer(query []byte, udp bool) []byte {
+	response, err := stub.Resolve(query)
+	if err == ErrMalformedDNS {
+		return nil
+	}
+	if err != nil {
+		ui.LogE(err)
+		response = dnsFailure(query)
+	}
+	if limit := dnsUDPLimit(query); udp && len(response) > limit {
+		response = dnsTruncate(response)
+	}
+	return response
+}
+
+// Resolve answers a query from the cache or the upstream chosen by the rules
+func (stub *DNSStub) Resolve(query []byte) (response []byte, err error) {
+	var (
+		name string
+		key  string
+	)
+	if name, key, err = dnsQuestion(query); err != nil {
+		return
+	}
+
+	if response = stub.lookup(key); response != nil {
+		copy(response[:2], query[:2])
+		return
+	}
+
+	upstream := stub.upstream(name)
+	if upstream == DNSTunnel {
+		response, err = stub.exchangeTunnel(query)
+	} else {
+		response, err = exchangeUDP(upstream, query)
+	}
+	if err != nil {
+		return nil, errors.New("Could not resolve " + name + ": " + err.Error())
+	}
+	if len(response) < dnsHeaderLength || response[0] != query[0] || response[1] != query[1] {
+		return nil, ErrMalformedDNS
+	}
+	stub.store(key, response)
+	return
+}
+
+// upstream returns the upstream of the most specific rule matching the name
+func (stub *DNSStub) upstream(name string) string {
+	upstream, longest := DNSTunnel, -1
+	for _, rule := range stub.rules {
+		if rule.matches(name) && len(rule.Domain) > longest {
+			upstream, longest = rule.Upstream, len(rule.Domain)
+		}
+	}
+	return upstream
+}
+
+func (stub *DNSStub) exchangeTunnel(query []byte) (response []byte, err error) {
+	var st *remote.Stream
+	resolver := stub.resolver()
+	if resolver == "" {
+		return nil, ErrNoResolver
+	}
+	if st, err = Dial(stub.m, resolver); err != nil {
+		return
+	}
+	defer st.Close()
+	st.SetDeadline(time.Now().Add(DNSTimeout))
+	if err = writeDNSFrame(st, query); err != nil {
+		return
+	}
+	return readDNSFrame(st)
+}
+
+// exchangeUDP asks a resolver outside the tunnel, retrying over TCP if the answer was truncated
+func exchangeUDP(upstream string, query []byte) (response []byte, err error) {
+	var (
+		conn net.Conn
+		n    int
+	)
+	if conn, err = net.DialTimeout("udp", upstream, DNSTimeout); err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNSTimeout))
+	if _, err = conn.Write(query); err != nil {
+		return
+	}
+	buf := make([]byte, dnsMaxLength)
+	if n, err = conn.Read(buf); err != nil {
+		return
+	}
+	response = buf[:n]
+	if len(response) < dnsHeaderLength || response[2]&dnsFlagTC == 0 {
+		return
+	}
+
+	if conn, err = net.DialTimeout("tcp", upstream, DNSTimeout); err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNSTimeout))
+	if err = writeDNSFrame(conn, query); err != nil {
+		return
+	}
+	return readDNSFrame(conn)
+}
+
+// lookup returns a copy of a cached response with its TTLs reduced by the time it was cached
+func (stub *DNSStub) lookup(key string) []byte {
+	stub.mutex.Lock()
+	entry, ok := stub.cache[key]
+	stub.mutex.Unlock()
+	now := time.Now()
+	if !ok || now.After(entry.expires) {
+		return nil
+	}
+
+	response := append([]byte{}, entry.response...)
+	offsets, _ := dnsTTLOffsets(response)
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, offset := range offsets {
+		ttl := binary.BigEndian.Uint32(response[offset:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(response[offset:], ttl)
+	}
+	return response
+}
+
+// store caches successful and negative answers for their smallest TTL, within limits
+func (stub *DNSStub) store(key string, response []byte) {
+	rcode := response[3] & 0x0f
+	if response[2]&dnsFlagTC != 0 || (rcode != 0 && rcode != dnsRcodeNXDomain) {
+		return
+	}
+	offsets, err := dnsTTLOffsets(response)
+	if err != nil {
+		return
+	}
+	ttl := dnsMaxTTL
+	if len(offsets) == 0 {
+		ttl = dnsNegativeTTL
+	}
+	for _, offset := range offsets {
+		if t := time.Duration(binary.BigEndian.Uint32(response[offset:])) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	if len(stub.cache) >= dnsCacheSize {
+		for k, entry := range stub.cache {
+			if now.After(entry.expires) {
+				delete(stub.cache, k)
+			}
+		}
+	}
+	if len(stub.cache) >= dnsCacheSize {
+		for k := range stub.cache {
+			delete(stub.cache, k)
+			break
+		}
+	}
+	stub.cache[key] = dnsCacheEntry{append([]byte{}, response...), now, now.Add(ttl)}
+}
+
+// dnsQuestion returns the name in the only question of a query and a cache key for it
+func dnsQuestion(msg []byte) (name string, key string, err error) {
+	if len(msg) < dnsHeaderLength || msg[2]&dnsFlagQR != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", "", ErrMalformedDNS
+	}
+
+	var labels []string
+	off := dnsHeaderLength
+	for {
+		if off >= len(msg) {
+			return "", "", ErrMalformedDNS
+		}
+		length := int(msg[off])
+		off++
+		if length == 0 {
+			break
+		}
+		if length > 63 || off+length > len(msg) {
+			return "", "", ErrMalformedDNS
+		}
+		labels = append(labels, string(msg[off:off+length]))
+		off += length
+	}
+	if off+4 > len(msg) {
+		return "", "", ErrMalformedDNS
+	}
+	name = normalizeName(strings.Join(labels, "."))
+	key = name + "/" + strconv.Itoa(int(binary.BigEndian.Uint16(msg[off:]))) + "/" + strconv.Itoa(int(binary.BigEndian.Uint16(msg[off+2:])))
+	return
+}
+
+// dnsSkipName returns the offset after a possibly compressed name
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, ErrMalformedDNS
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return 0, ErrMalformedDNS
+			}
+			return off + 2, nil
+		}
+		off += 1 + length
+	}
+}
+
+// dnsTTLOffsets returns the offsets of the TTLs of every resource record in a message
+func dnsTTLOffsets(msg []byte) (offsets []int, err error) {
+	if len(msg) < dnsHeaderLength {
+		return nil, ErrMalformedDNS
+	}
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off, err := dnsQuestionEnd(msg)
+	if err != nil {
+		return
+	}
+	for i := 0; i < records; i++ {
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return
+		}
+		if off+10 > len(msg) {
+			return nil, ErrMalformedDNS
+		}
+		if binary.BigEndian.Uint16(msg[off:]) != dnsTypeOPT {
+			offsets = append(offsets, off+4)
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	if off > len(msg) {
+		return nil, ErrMalformedDNS
+	}
+	return
+}
+
+// dnsUDPLimit returns the largest UDP response the client accepts, which EDNS may raise
+func dnsUDPLimit(query []byte) int {
+	limit := dnsMaxUDPLength
+	if len(query) < dnsHeaderLength || binary.BigEndian.Uint16(query[10:]) == 0 {
+		return limit
+	}
+
+	// the OPT record is the last additional record; its class is the client's UDP payload size
+	off, err := dnsQuestionEnd(query)
+	for err == nil && off < len(query) {
+		if off, err = dnsSkipName(query, off); err != nil || off+10 > len(query) {
+			break
+		}
+		if binary.BigEndian.Uint16(query[off:]) == dnsTypeOPT {
+			if size := int(binary.BigEndian.Uint16(query[off+2:])); size > limit {
+				limit = size
+			}
+		}
+		off += 10 + int(binary.BigEndian.Uint16(query[off+8:]))
+	}
+	return limit
+}
+
+func dnsQuestionEnd(msg []byte) (off int, err error) {
+	off = dnsHeaderLength
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return
+		}
+		off += 4
+	}
+	return
+}
+
+// dnsTruncate cuts a response down to its header and question, telling the client to retry over TCP
+func dnsTruncate(response []byte) []byte {
+	end, err := dnsQuestionEnd(response)
+	if err != nil || end > len(response) {
+		end = dnsHeaderLength
+		binary.BigEndian.PutUint16(response[4:], 0)
+	}
+	truncated := append([]byte{}, response[:end]...)
+	truncated[2] |= dnsFlagTC
+	for i := 6; i < dnsHeaderLength; i++ {
+		truncated[i] = 0
+	}
+	return truncated
+}
+
+// dnsFailure builds a SERVFAIL response to the query
+func dnsFailure(query []byte) []byte {
+	response := dnsTruncate(query)
+	response[2] = (response[2] | dnsFlagQR) &^ dnsFlagTC
+	response[3] = response[3]&0xf0 | dnsRcodeServFail
+	return response
+}
+
+func readDNSFrame(r io.Reader) (msg []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	msg = make([]byte, binary.BigEndian.Uint16(header))
+	_, err = io.ReadFull(r, msg)
+	return
+}
+
+func writeDNSFrame(w io.Writer, msg []byte) (err error) {
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err = w.Write(frame)
+	return
+}
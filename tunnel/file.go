@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/ui"
+)
+
+// KindFile offers the peer a file, which it may accept or reject
+const KindFile = "file"
+
+// fileChunk is how much of a file is sent between progress updates
+const fileChunk = 32 * 1024
+
+// DownloadDir is where files accepted from the peer are saved
+var DownloadDir = "."
+
+var (
+	// ErrFileRejected is returned when the peer's user rejects a file
+	ErrFileRejected = errors.New("File was rejected")
+
+	// ErrFileChecksum is returned when a received file doesn't match the SHA-256 it was offered with
+	ErrFileChecksum = errors.New("File does not match its SHA-256")
+)
+
+// FileOffer describes a file offered to the peer
+type FileOffer struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// Validate checks the offer names a plain file, so it can't be saved outside the download dir
+func (offer FileOffer) Validate() error {
+	name := offer.Name
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return errors.New("invalid file name " + strconv.Quote(name))
+	}
+	if offer.Size < 0 {
+		return errors.New("invalid file size")
+	}
+	if sum, err := hex.DecodeString(offer.SHA256); err != nil || len(sum) != sha256.Size {
+		return errors.New("invalid SHA-256")
+	}
+	return nil
+}
+
+// AcceptFiles extends the policy to let the peer offer files, which are saved if the prompt accepts them
+func AcceptFiles(policy Policy, prompt func(offer FileOffer) bool) Policy {
+	return func(req Request) error {
+		if req.Kind != KindFile {
+			return policy(req)
+		}
+		if req.File == nil {
+			return errors.New("missing file offer")
+		}
+		if err := req.File.Validate(); err != nil {
+			return err
+		}
+		if !prompt(*req.File) {
+			return ErrFileRejected
+		}
+		return nil
+	}
+}
+
+// SendFile offers the file at the path to the peer and sends it once accepted, resuming from
+// however much the peer kept of an earlier attempt; progress is called as the file is sent
+func SendFile(m *remote.Mux, path string, progress func(sent, total int64)) (err error) {
+	var (
+		f      *os.File
+		info   os.FileInfo
+		st     *remote.Stream
+		offset int64
+	)
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	if info, err = f.Stat(); err != nil {
+		return
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New(path + " is not a regular file")
+	}
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return
+	}
+	offer := FileOffer{Name: filepath.Base(path), Size: info.Size(), SHA256: hex.EncodeToString(hash.Sum(nil))}
+
+	if st, err = open(m, Request{Kind: KindFile, File: &offer}); err != nil {
+		return
+	}
+	defer st.Close()
+
+	start := make([]byte, 8)
+	if _, err = io.ReadFull(st, start); err != nil {
+		return
+	}
+	if offset = int64(binary.BigEndian.Uint64(start)); offset > offer.Size {
+		st.Reset("invalid resume offset")
+		return errors.New("Peer asked to resume past the end of the file")
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		st.Reset(err.Error())
+		return
+	}
+	if offset > 0 {
+		ui.Log("Resuming " + offer.Name + " from byte " + strconv.FormatInt(offset, 10))
+	}
+
+	buf := make([]byte, fileChunk)
+	for sent := offset; sent < offer.Size; {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			if _, err = st.Write(buf[:n]); err != nil {
+				return
+			}
+			sent += int64(n)
+			if progress != nil {
+				progress(sent, offer.Size)
+			}
+		}
+		if readErr != nil {
+			st.Reset("file changed while sending")
+			return errors.New(path + " changed while sending")
+		}
+	}
+	if err = st.CloseWrite(); err != nil {
+		return
+	}
+
+	// the peer confirms once it verified the whole file
+	status := make([]byte, 1)
+	_, err = io.ReadFull(st, status)
+	return
+}
+
+// handleFile receives a file the user accepted, keeping a partial file if the transfer is
+// interrupted so that sending it again resumes where it stopped
+func handleFile(st *remote.Stream, req *FileOffer) {
+	if req == nil || req.Validate() != nil {
+		st.Reset("invalid file offer")
+		return
+	}
+	offer := *req
+	partial := filepath.Join(DownloadDir, "."+offer.Name+"."+offer.SHA256[:16]+".part")
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		ui.LogE(err)
+		st.Reset(err.Error())
+		return
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err == nil && offset > offer.Size {
+		if err = f.Truncate(0); err == nil {
+			offset, err = f.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		ui.LogE(err)
+		st.Reset(err.Error())
+		return
+	}
+
+	start := make([]byte, 9)
+	start[0] = statusOK
+	binary.BigEndian.PutUint64(start[1:], uint64(offset))
+	if _, err = st.Write(start); err != nil {
+		st.Close()
+		return
+	}
+	ui.Log("Receiving " + offer.Name + " (" + strconv.FormatInt(offer.Size, 10) + " bytes) on stream " + fmtID(st))
+
+	received, err := io.Copy(f, io.LimitReader(st, offer.Size-offset))
+	if err == nil && offset+received < offer.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		ui.Log("Interrupted " + offer.Name + " after " + strconv.FormatInt(offset+received, 10) + " bytes, sending it again resumes")
+		st.Close()
+		return
+	}
+
+	hash := sha256.New()
+	if _, err = f.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(hash, f)
+	}
+	if err != nil || hex.EncodeToString(hash.Sum(nil)) != offer.SHA256 {
+		f.Close()
+		os.Remove(partial)
+		ui.LogE(errors.New(ErrFileChecksum.Error() + ": " + offer.Name))
+		st.Reset(ErrFileChecksum.Error())
+		return
+	}
+
+	f.Close()
+	path := availablePath(filepath.Join(DownloadDir, offer.Name))
+	if err = os.Rename(partial, path); err != nil {
+		ui.LogE(err)
+		st.Reset(err.Error())
+		return
+	}
+	st.Write([]byte{statusOK})
+	st.Close()
+	ui.Log("Received " + offer.Name + " as " + path + ", SHA-256 verified")
+}
+
+// availablePath returns the path, numbered if a file already exists there
+func availablePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = base + " (" + strconv.Itoa(i) + ")" + ext
+	}
+}
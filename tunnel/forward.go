@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/ui"
+)
+
+// DefaultBindAddress is the address forwarded ports listen on unless one is given
+const DefaultBindAddress = "127.0.0.1"
+
+// Forward describes a port forwarded through the tunnel
+type Forward struct {
+	BindAddress string
+	Port        string
+	Host        string
+	HostPort    string
+}
+
+// ParseForward parses a forward in the form [bind:]port:host:hostport
+func ParseForward(spec string) (fwd Forward, err error) {
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 3:
+		fwd = Forward{BindAddress: DefaultBindAddress, Port: parts[0], Host: parts[1], HostPort: parts[2]}
+	case 4:
+		fwd = Forward{BindAddress: parts[0], Port: parts[1], Host: parts[2], HostPort: parts[3]}
+	default:
+		err = errors.New("Forward " + spec + " is not in the form [bind:]port:host:hostport")
+		return
+	}
+
+	for _, port := range []string{fwd.Port, fwd.HostPort} {
+		if n, convErr := strconv.Atoi(port); convErr != nil || n < 0 || n > 65535 {
+			err = errors.New("Forward " + spec + " has an invalid port " + port)
+			return
+		}
+	}
+	if fwd.Host == "" {
+		err = errors.New("Forward " + spec + " is missing a host")
+	}
+	return
+}
+
+// ListenAddress returns the address the forward listens on
+func (fwd Forward) ListenAddress() string {
+	return net.JoinHostPort(fwd.BindAddress, fwd.Port)
+}
+
+// TargetAddress returns the address the forward connects to
+func (fwd Forward) TargetAddress() string {
+	return net.JoinHostPort(fwd.Host, fwd.HostPort)
+}
+
+func (fwd Forward) String() string {
+	return fwd.ListenAddress() + " -> " + fwd.TargetAddress()
+}
+
+// ListenLocal listens on the port of the forward until the session ends, and relays every
+// accepted connection through a new stream, for which the peer connects to the target address
+func ListenLocal(fwd Forward, m *remote.Mux) (l net.Listener, err error) {
+	if l, err = net.Listen("tcp", fwd.ListenAddress()); err != nil {
+		return
+	}
+
+	go func() {
+		<-m.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go forwardLocal(conn, m, fwd.TargetAddress())
+		}
+	}()
+	return
+}
+
+func forwardLocal(conn net.Conn, m *remote.Mux, address string) {
+	st, err := Dial(m, address)
+	if err != nil {
+		ui.LogE(err)
+		conn.Close()
+		return
+	}
+
+	ui.Log("Forwarding " + conn.RemoteAddr().String() + " to " + address + " on stream " + fmtID(st))
+	Relay(conn, st)
+}
+
+// ListenRemote asks the peer to listen on the port of the forward and to relay every
+// accepted connection back through a new stream; closing the returned stream stops the peer
+// from listening
+func ListenRemote(fwd Forward, m *remote.Mux) (st *remote.Stream, err error) {
+	return open(m, Request{Kind: KindListen, Address: fwd.ListenAddress(), Target: fwd.TargetAddress()})
+}
@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/ui"
+)
+
+// hopHeaders are only meaningful between the proxy client and the proxy
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// bufferedConn reads from a buffer which may already hold data sent after a request
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// ListenHTTPProxy serves an HTTP/1.1 proxy on the address until the session ends, supporting
+// CONNECT and requests for absolute http URIs; the server makes the actual connections
+func ListenHTTPProxy(address string, m *remote.Mux) (l net.Listener, err error) {
+	if l, err = net.Listen("tcp", address); err != nil {
+		return
+	}
+
+	go func() {
+		<-m.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveHTTPProxy(conn, m)
+		}
+	}()
+	return
+}
+
+func serveHTTPProxy(conn net.Conn, m *remote.Mux) {
+	// a proxy client which never finishes its request headers must not hold the connection open
+	conn.SetReadDeadline(time.Now().Add(DialTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if req.Method == http.MethodConnect {
+		proxyConnect(&bufferedConn{Conn: conn, reader: reader}, req, m)
+		return
+	}
+	defer conn.Close()
+	proxyRequest(conn, req, m)
+}
+
+// proxyConnect tunnels the raw connection to the requested host
+func proxyConnect(conn net.Conn, req *http.Request, m *remote.Mux) {
+	st, err := Dial(m, req.Host)
+	if err != nil {
+		ui.LogE(err)
+		httpError(conn, req, http.StatusBadGateway, err)
+		conn.Close()
+		return
+	}
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		st.Close()
+		conn.Close()
+		return
+	}
+
+	ui.Log("Proxying CONNECT from " + conn.RemoteAddr().String() + " to " + req.Host + " on stream " + fmtID(st))
+	Relay(conn, st)
+}
+
+// proxyRequest forwards a single request for an absolute URI and closes the connection afterwards
+func proxyRequest(conn net.Conn, req *http.Request, m *remote.Mux) {
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		httpError(conn, req, http.StatusBadRequest, errors.New("only absolute http URIs and CONNECT are proxied"))
+		return
+	}
+
+	address := req.URL.Host
+	if req.URL.Port() == "" {
+		address = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	st, err := Dial(m, address)
+	if err != nil {
+		ui.LogE(err)
+		httpError(conn, req, http.StatusBadGateway, err)
+		return
+	}
+	defer st.Close()
+
+	for _, header := range hopHeaders {
+		req.Header.Del(header)
+	}
+	req.Close = true
+	ui.Log("Proxying " + req.Method + " " + req.URL.String() + " on stream " + fmtID(st))
+	if err = req.Write(st); err != nil {
+		httpError(conn, req, http.StatusBadGateway, err)
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(st), req)
+	if err != nil {
+		httpError(conn, req, http.StatusBadGateway, err)
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range hopHeaders {
+		resp.Header.Del(header)
+	}
+	resp.Close = true
+	resp.Write(conn)
+}
+
+func httpError(conn net.Conn, req *http.Request, status int, err error) {
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Close:         true,
+		ContentLength: int64(len(err.Error())),
+		Body:          ioutil.NopCloser(strings.NewReader(err.Error())),
+	}
+	resp.Write(conn)
+}
@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Policy decides whether a request from the peer is allowed, returning the reason if not
+type Policy func(req Request) error
+
+// PortRanges is a set of ports such as 8000-8100,9000
+type PortRanges [][2]int
+
+// ParsePortRanges parses a comma separated list of ports and port ranges
+func ParsePortRanges(s string) (ranges PortRanges, err error) {
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		var low, high int
+		if low, err = parsePort(bounds[0]); err != nil {
+			return
+		}
+		high = low
+		if len(bounds) == 2 {
+			if high, err = parsePort(bounds[1]); err != nil {
+				return
+			}
+		}
+		if low > high {
+			err = errors.New("Port range " + part + " is empty")
+			return
+		}
+		ranges = append(ranges, [2]int{low, high})
+	}
+	return
+}
+
+func parsePort(s string) (port int, err error) {
+	if port, err = strconv.Atoi(strings.TrimSpace(s)); err != nil || port < 0 || port > 65535 {
+		err = errors.New("Invalid port " + s)
+	}
+	return
+}
+
+// Contains returns whether the port is in one of the ranges
+func (ranges PortRanges) Contains(port int) bool {
+	for _, r := range ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerPolicy lets the peer connect anywhere, and listen on the ports in the ranges; it may only
+// listen on loopback addresses unless gatewayPorts lets it listen on other hosts' behalf
+func ServerPolicy(listenPorts PortRanges, gatewayPorts bool) Policy {
+	return func(req Request) error {
+		switch req.Kind {
+		case KindConnect:
+			return nil
+		case KindListen:
+			host, port, err := net.SplitHostPort(req.Address)
+			if err != nil {
+				return err
+			}
+			if n, err := strconv.Atoi(port); err != nil || !listenPorts.Contains(n) {
+				return errors.New("port " + port + " may not be bound by clients")
+			}
+			if ip := net.ParseIP(host); !gatewayPorts && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				return errors.New("address " + host + " may not be bound by clients, only loopback addresses")
+			}
+			return nil
+		}
+		return errors.New("unsupported request " + req.Kind)
+	}
+}
+
+// ClientPolicy only lets the peer connect to the targets of the remote forwards
+func ClientPolicy(remoteForwards []Forward) Policy {
+	return func(req Request) error {
+		if req.Kind != KindConnect {
+			return errors.New("unsupported request " + req.Kind)
+		}
+		for _, fwd := range remoteForwards {
+			if req.Address == fwd.TargetAddress() {
+				return nil
+			}
+		}
+		return errors.New(req.Address + " is not the target of a remote forward")
+	}
+}
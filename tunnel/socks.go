@@ -0,0 +1,261 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/ui"
+)
+
+// see https://tools.ietf.org/html/rfc1928 and https://tools.ietf.org/html/rfc1929
+const (
+	socksVersion         = 5
+	socksAuthVersion     = 1
+	socksMethodNone      = 0
+	socksMethodPassword  = 2
+	socksMethodRejected  = 0xff
+	socksCommandConnect  = 1
+	socksAddressIPv4     = 1
+	socksAddressDomain   = 3
+	socksAddressIPv6     = 4
+	socksSucceeded       = 0
+	socksGeneralFailure  = 1
+	socksNetUnreachable  = 3
+	socksHostUnreachable = 4
+	socksConnRefused     = 5
+	socksTTLExpired      = 6
+	socksBadCommand      = 7
+	socksBadAddressType  = 8
+)
+
+// Credentials are the username and password proxy clients must present
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// ParseCredentials parses credentials in the form username:password
+func ParseCredentials(s string) (creds *Credentials, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		err = errors.New("Credentials must be in the form username:password")
+		return
+	}
+	creds = &Credentials{Username: parts[0], Password: parts[1]}
+	return
+}
+
+// Verify compares the credentials in constant time
+func (c *Credentials) Verify(username, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(c.Username))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.Password))
+	return userOK&passOK == 1
+}
+
+// ListenSOCKS serves a SOCKS5 proxy on the address until the session ends; the server connects
+// to the destination of every proxied connection. If creds is not nil, proxy clients must log in
+func ListenSOCKS(address string, creds *Credentials, m *remote.Mux) (l net.Listener, err error) {
+	if l, err = net.Listen("tcp", address); err != nil {
+		return
+	}
+
+	go func() {
+		<-m.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS(conn, creds, m)
+		}
+	}()
+	return
+}
+
+func serveSOCKS(conn net.Conn, creds *Credentials, m *remote.Mux) {
+	var (
+		address string
+		st      *remote.Stream
+		err     error
+	)
+
+	// a proxy client which never finishes its request must not hold the connection open
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	if err = socksNegotiate(conn, creds); err != nil {
+		ui.LogE(err)
+		conn.Close()
+		return
+	}
+	if address, err = socksReadRequest(conn); err != nil {
+		ui.LogE(err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if st, err = Dial(m, address); err != nil {
+		ui.LogE(err)
+		socksReply(conn, socksReplyCode(err))
+		conn.Close()
+		return
+	}
+	if err = socksReply(conn, socksSucceeded); err != nil {
+		st.Close()
+		conn.Close()
+		return
+	}
+
+	ui.Log("Proxying " + conn.RemoteAddr().String() + " to " + address + " on stream " + fmtID(st))
+	Relay(conn, st)
+}
+
+// socksNegotiate agrees on an authentication method and authenticates the proxy client
+func socksNegotiate(conn net.Conn, creds *Credentials) (err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socksVersion {
+		return errors.New("Unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	method := byte(socksMethodNone)
+	if creds != nil {
+		method = socksMethodPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksMethodRejected})
+		return errors.New("SOCKS client offered no acceptable authentication method")
+	}
+	if _, err = conn.Write([]byte{socksVersion, method}); err != nil || creds == nil {
+		return
+	}
+
+	var username, password string
+	if username, password, err = socksReadCredentials(conn); err != nil {
+		return
+	}
+	if !creds.Verify(username, password) {
+		conn.Write([]byte{socksAuthVersion, 1})
+		return errors.New("SOCKS client " + conn.RemoteAddr().String() + " failed authentication")
+	}
+	_, err = conn.Write([]byte{socksAuthVersion, 0})
+	return
+}
+
+func socksReadCredentials(conn net.Conn) (username, password string, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socksAuthVersion {
+		err = errors.New("Unsupported SOCKS authentication version " + strconv.Itoa(int(header[0])))
+		return
+	}
+	user := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, user); err != nil {
+		return
+	}
+
+	passLength := make([]byte, 1)
+	if _, err = io.ReadFull(conn, passLength); err != nil {
+		return
+	}
+	pass := make([]byte, passLength[0])
+	if _, err = io.ReadFull(conn, pass); err != nil {
+		return
+	}
+	return string(user), string(pass), nil
+}
+
+// socksReadRequest reads a request and returns the destination address of a CONNECT
+func socksReadRequest(conn net.Conn) (address string, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socksVersion {
+		err = errors.New("Unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+		return
+	}
+
+	var host string
+	switch header[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == socksAddressIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case socksAddressDomain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		domain := make([]byte, length[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksBadAddressType)
+		err = errors.New("Unsupported SOCKS address type " + strconv.Itoa(int(header[3])))
+		return
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return
+	}
+
+	if header[1] != socksCommandConnect {
+		socksReply(conn, socksBadCommand)
+		err = errors.New("Unsupported SOCKS command " + strconv.Itoa(int(header[1])))
+		return
+	}
+	address = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return
+}
+
+// socksReply sends a reply; the bound address is not meaningful through the tunnel, so it is zero
+func socksReply(conn net.Conn, code byte) (err error) {
+	_, err = conn.Write([]byte{socksVersion, code, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return
+}
+
+// socksReplyCode maps the reason the server could not connect to a reply code
+func socksReplyCode(err error) byte {
+	reason := err.Error()
+	switch {
+	case strings.Contains(reason, "connection refused"):
+		return socksConnRefused
+	case strings.Contains(reason, "network is unreachable"):
+		return socksNetUnreachable
+	case strings.Contains(reason, "no such host"), strings.Contains(reason, "no route to host"):
+		return socksHostUnreachable
+	case strings.Contains(reason, "timeout"):
+		return socksTTLExpired
+	}
+	return socksGeneralFailure
+}
@@ -0,0 +1,191 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pwang347/simple-vpn/remote"
+	"github.com/pwang347/simple-vpn/ui"
+)
+
+const (
+	// KindConnect asks the peer to open a TCP connection to the address
+	KindConnect = "connect"
+
+	// KindListen asks the peer to listen on the address and connect back to the target
+	// for every accepted connection, for as long as the stream is open
+	KindListen = "listen"
+
+	// DialTimeout is how long the peer tries to reach the address of a stream
+	DialTimeout = 10 * time.Second
+
+	statusOK = 0
+)
+
+// Request is the header of a stream opened through the tunnel
+type Request struct {
+	Kind    string
+	Address string     `json:",omitempty"`
+	Target  string     `json:",omitempty"`
+	File    *FileOffer `json:",omitempty"`
+}
+
+// Dial asks the peer to connect to the address and returns a stream relaying to it; the
+// call blocks until the peer has either connected or reset the stream
+func Dial(m *remote.Mux, address string) (st *remote.Stream, err error) {
+	return open(m, Request{Kind: KindConnect, Address: address})
+}
+
+// open opens a stream for the request and waits for the peer to accept it
+func open(m *remote.Mux, req Request) (st *remote.Stream, err error) {
+	var header []byte
+	if header, err = json.Marshal(req); err != nil {
+		return
+	}
+	if st, err = m.Open(header); err != nil {
+		return
+	}
+
+	status := make([]byte, 1)
+	if _, err = io.ReadFull(st, status); err != nil {
+		st.Close()
+		return
+	}
+	return
+}
+
+// Serve accepts streams opened by the peer until the session ends, rejecting requests
+// which the policy does not allow
+func Serve(m *remote.Mux, policy Policy) {
+	for {
+		st, err := m.Accept()
+		if err != nil {
+			return
+		}
+		go handle(m, st, policy)
+	}
+}
+
+func handle(m *remote.Mux, st *remote.Stream, policy Policy) {
+	var req Request
+	if err := json.Unmarshal(st.Header(), &req); err != nil {
+		st.Reset("malformed request")
+		return
+	}
+	if err := policy(req); err != nil {
+		ui.LogE(errors.New("Rejected " + req.Kind + " request: " + err.Error()))
+		st.Reset(err.Error())
+		return
+	}
+
+	switch req.Kind {
+	case KindConnect:
+		handleConnect(st, req.Address)
+	case KindListen:
+		handleListen(m, st, req)
+	case KindFile:
+		handleFile(st, req.File)
+	default:
+		st.Reset("unsupported request " + req.Kind)
+	}
+}
+
+func handleConnect(st *remote.Stream, address string) {
+	conn, err := net.DialTimeout("tcp", address, DialTimeout)
+	if err != nil {
+		ui.LogE(err)
+		st.Reset(err.Error())
+		return
+	}
+	if _, err = st.Write([]byte{statusOK}); err != nil {
+		conn.Close()
+		st.Close()
+		return
+	}
+
+	ui.Log("Opened stream " + fmtID(st) + " to " + address)
+	Relay(st, conn)
+}
+
+func handleListen(m *remote.Mux, st *remote.Stream, req Request) {
+	l, err := net.Listen("tcp", req.Address)
+	if err != nil {
+		ui.LogE(err)
+		st.Reset(err.Error())
+		return
+	}
+	if _, err = st.Write([]byte{statusOK}); err != nil {
+		l.Close()
+		st.Close()
+		return
+	}
+
+	// the listener lives for as long as the peer keeps the stream open
+	go func() {
+		io.Copy(ioutil.Discard, st)
+		l.Close()
+	}()
+
+	ui.Log("Listening on " + l.Addr().String() + " for " + req.Target + " on the peer")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			ui.Log("Stopped listening on " + l.Addr().String())
+			st.Close()
+			return
+		}
+		go forwardRemote(conn, m, req.Target)
+	}
+}
+
+func forwardRemote(conn net.Conn, m *remote.Mux, target string) {
+	st, err := Dial(m, target)
+	if err != nil {
+		ui.LogE(err)
+		conn.Close()
+		return
+	}
+
+	ui.Log("Forwarding " + conn.RemoteAddr().String() + " to " + target + " on the peer on stream " + fmtID(st))
+	Relay(conn, st)
+}
+
+// Relay copies data in both directions until both sides are done, then closes them
+func Relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go pipe(a, b, done)
+	go pipe(b, a, done)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+func pipe(dst, src net.Conn, done chan struct{}) {
+	if _, err := io.Copy(dst, src); err != nil {
+		// the other direction cannot finish cleanly either
+		dst.Close()
+		src.Close()
+	} else {
+		closeWrite(dst)
+	}
+	done <- struct{}{}
+}
+
+// closeWrite half-closes the connection if it supports it
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+func fmtID(st *remote.Stream) string {
+	return "#" + strconv.FormatUint(uint64(st.ID()), 10)
+}
@@ -1,6 +1,7 @@
 package ui
 
 import (
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -114,6 +115,12 @@ func log(text string, ty string) {
 	mutex.Lock()
 	defer mutex.Unlock()
 	numLogItems++
+
+	// there is no event log outside of the GUI, e.g. in tests
+	if content == nil {
+		fmt.Println("Event #" + strconv.Itoa(numLogItems) + " [" + ty + "]\n" + text)
+		return
+	}
 	content.Prepend(widget.NewLabel(text))
 	content.Prepend(NewBoldedLabel("Event #" + strconv.Itoa(numLogItems) + " [" + ty + "]"))
 	if len(content.Children) > MaxLogEntries*2 {